@@ -10,21 +10,33 @@ import (
 	"path/filepath"
 	config "simple_kerberos/configs"
 	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
 	"simple_kerberos/internal/security"
 	"strings"
 )
 
 var stdin = bufio.NewScanner(os.Stdin)
+var args []string
 
 func main() {
 
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: asconfig <command>")
+	var err error
+	args, err = config.LoadFromArgs(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if len(args) < 2 {
+		fmt.Println("Usage: asconfig [--config file] <command>")
 		fmt.Println("Available commands:")
 		fmt.Println("add-client\t\tRegister a new client")
 		fmt.Println("show-cleints\t\tShow all the clients registered")
 		fmt.Println("get-client\t\tRetrieve a specific client")
 		fmt.Println("delete-client\t\tDelete a specific client")
+		fmt.Println("set-password\t\tChange the password of a client, deriving the key with the string-to-key of the configuration")
+		fmt.Println("set-preauth\t\tEnable or disable pre-authentication for a client")
+		fmt.Println("set-max-lifetime\tSet the max ticket lifetime for a client")
 		fmt.Println("add-tgs\t\t\tRegister a new TGS")
 		fmt.Println("show-tgs\t\tShow all the TGS registered")
 		fmt.Println("get-tgs\t\t\tRetrieve a specific TGS")
@@ -32,7 +44,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	cmd := os.Args[1]
+	cmd := args[1]
 
 	switch cmd {
 	case "add-client":
@@ -47,6 +59,15 @@ func main() {
 	case "delete-client":
 		deleteClient()
 
+	case "set-password":
+		setPassword()
+
+	case "set-preauth":
+		setPreAuth()
+
+	case "set-max-lifetime":
+		setMaxLifetime()
+
 	case "add-tgs":
 		addTGS()
 
@@ -91,7 +112,7 @@ func showClients() {
 	}
 	fmt.Println("\nRegistered clients:")
 	for _, c := range clients {
-		fmt.Printf("DbId: %d, ClientId: %s, Key: %s\n", c.DbId, c.ClientId, hex.EncodeToString(c.Key))
+		fmt.Printf("DbId: %d, ClientId: %s, Key: %s, StringToKey: %s, Salt: %s, PreAuth: %t, MaxLifetime: %d min\n", c.DbId, c.ClientId, hex.EncodeToString(c.Key), c.StringToKey, hex.EncodeToString(c.StringToKey.Salt), c.RequirePreAuth, c.MaxLifetime/1000/60)
 	}
 }
 
@@ -110,7 +131,7 @@ func getClient() {
 		panic(err)
 	}
 	fmt.Println("\nClient:")
-	fmt.Printf("DbId: %d, ClientId: %s, Key: %s\n", c.DbId, c.ClientId, hex.EncodeToString(c.Key))
+	fmt.Printf("DbId: %d, ClientId: %s, Key: %s, StringToKey: %s, Salt: %s, PreAuth: %t, MaxLifetime: %d min\n", c.DbId, c.ClientId, hex.EncodeToString(c.Key), c.StringToKey, hex.EncodeToString(c.StringToKey.Salt), c.RequirePreAuth, c.MaxLifetime/1000/60)
 }
 
 func deleteClient() {
@@ -143,12 +164,98 @@ func addClient() {
 	stdin.Scan()
 	clientPwd := stdin.Text()
 
+	fmt.Print("Require pre-authentication for " + clientId + "? (y/N): ")
+	stdin.Scan()
+	requirePreAuth := strings.EqualFold(strings.TrimSpace(stdin.Text()), "y")
+
+	maxLifetime := readMaxLifetime(clientId)
+
 	//GENERATE KEY AND SAVE CLIENT
-	clientKey, err := security.GenerateClientKeyFromPwd(clientPwd, config.SymmKeyDim)
+	params, clientKey := generateClientKey(clientId, clientPwd)
+	dao.InsertClient(clientId, clientKey, params, requirePreAuth, maxLifetime, db)
+}
+
+func setPassword() {
+	db := readAdminPwAndOpenDb()
+	defer db.Close()
+
+	fmt.Print("ClientId: ")
+	stdin.Scan()
+	clientId := stdin.Text()
+
+	fmt.Print("Insert new password for client " + clientId + ": ")
+	stdin.Scan()
+	clientPwd := stdin.Text()
+
+	//GENERATE KEY WITH THE STRING-TO-KEY OF THE CONFIGURATION, SO THAT OLD KEYS ARE MIGRATED, AND UPDATE CLIENT
+	params, clientKey := generateClientKey(clientId, clientPwd)
+	err := dao.UpdateClientKey(clientId, clientKey, params, db)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("\nPassword of %s changed, key derived with %s and salt %s\n", clientId, params, hex.EncodeToString(params.Salt))
+}
+
+// generateClientKey derives the key of clientId from its password with the salt type and iterations of the configuration
+func generateClientKey(clientId string, clientPwd string) (security.StringToKeyParams, []byte) {
+	params, err := security.NewStringToKeyParams(clientId)
+	if err != nil {
+		panic(err)
+	}
+	clientKey, err := security.GenerateClientKeyFromPwd(clientPwd, params, config.SymmKeyDim)
+	if err != nil {
+		panic(err)
+	}
+	return params, clientKey
+}
+
+func setMaxLifetime() {
+	db := readAdminPwAndOpenDb()
+	defer db.Close()
+
+	fmt.Print("ClientId: ")
+	stdin.Scan()
+	clientId := stdin.Text()
+
+	maxLifetime := readMaxLifetime(clientId)
+
+	//UPDATE CLIENT
+	err := dao.UpdateClientMaxLifetime(clientId, maxLifetime, db)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("\nMax lifetime for %s: %d min\n", clientId, maxLifetime/1000/60)
+}
+
+func readMaxLifetime(principal string) int64 {
+	fmt.Print("Max ticket lifetime in minutes for " + principal + " (OPTIONAL, if not provided the realm maximum is used): ")
+	stdin.Scan()
+	maxLifetime, err := dto.ParseMaxLifetime(stdin.Text())
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		os.Exit(1)
+	}
+	return maxLifetime
+}
+
+func setPreAuth() {
+	db := readAdminPwAndOpenDb()
+	defer db.Close()
+
+	fmt.Print("ClientId: ")
+	stdin.Scan()
+	clientId := stdin.Text()
+
+	fmt.Print("Require pre-authentication for " + clientId + "? (y/N): ")
+	stdin.Scan()
+	requirePreAuth := strings.EqualFold(strings.TrimSpace(stdin.Text()), "y")
+
+	//UPDATE CLIENT
+	err := dao.UpdateClientPreAuth(clientId, requirePreAuth, db)
 	if err != nil {
 		panic(err)
 	}
-	dao.InsertClient(clientId, clientKey, db)
+	fmt.Printf("\nPre-authentication for %s: %t\n", clientId, requirePreAuth)
 }
 
 // TGSERVERS
@@ -164,7 +271,7 @@ func showTGS() {
 	}
 	fmt.Println("\nRegistered TGS:")
 	for _, t := range tgs {
-		fmt.Printf("DbId: %d, TgsId: %s, Key: %s\n", t.DbId, t.TgsId, hex.EncodeToString(t.Key))
+		fmt.Printf("DbId: %d, TgsId: %s, Kvno: %d, Key: %s\n", t.DbId, t.TgsId, t.Kvno, hex.EncodeToString(t.Key))
 	}
 }
 
@@ -182,7 +289,7 @@ func getTGS() {
 		panic(err)
 	}
 	fmt.Println("\nClient:")
-	fmt.Printf("DbId: %d, TgsId: %s, Key: %s\n", t.DbId, t.TgsId, hex.EncodeToString(t.Key))
+	fmt.Printf("DbId: %d, TgsId: %s, Kvno: %d, Key: %s\n", t.DbId, t.TgsId, t.Kvno, hex.EncodeToString(t.Key))
 }
 
 func deleteTGS() {
@@ -236,6 +343,6 @@ func addTGS() {
 		}
 	}
 
-	//SAVE TGS
-	dao.InsertTGS(tgsId, key, db)
+	//SAVE TGS, THE KEY IS THE FIRST VERSION
+	dao.InsertTGS(tgsId, key, 1, db)
 }
@@ -5,39 +5,69 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dto"
 	"simple_kerberos/internal/kerrors"
 	"simple_kerberos/internal/messages"
 	"simple_kerberos/internal/protocol"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var stdin = bufio.NewScanner(os.Stdin)
+var args []string
 
 // CLIENT
 func main() {
 
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: client <server ip (as, tgs or service)> <command>")
+	var err error
+	args, err = config.LoadFromArgs(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if len(args) < 3 {
+		fmt.Println("Usage: client [--config file] <server ip (as, tgs or service)> <command>")
+		fmt.Println("For AS and TGS a comma separated list of ips can be given, they are tried in order,")
+		fmt.Println("with - the addresses of the configuration file are used")
 		fmt.Println("Available commands:")
 		fmt.Println("auth-as\t\t\tAuthenticate to an AS")
 		fmt.Println("auth-tgs\t\tAuthenticate to a TGS")
 		fmt.Println("auth-service\t\tAuthenticate to a service")
+		fmt.Println("renew\t\t\tRenew the renewable TGS tickets without typing the password again")
+		fmt.Println("validate\t\tValidate a postdated TGS ticket once its start time has come")
+		fmt.Println("s4u\t\t\tAs a service, get a ticket to another service on behalf of a user")
+		fmt.Println("auth-user\t\tAuthenticate to a user-to-user peer (service --user-to-user)")
 		os.Exit(1)
 	}
 
-	serverIp := os.Args[1]
-	cmd := os.Args[2]
+	//WITH - THE KDC ADDRESSES ARE TAKEN FROM THE CONFIGURATION ONCE THE TGS ID IS KNOWN
+	serverIps := splitIps(args[1])
+	cmd := args[2]
 
 	switch cmd {
 	case "auth-as":
-		authAs(serverIp)
+		authAs(serverIps)
 
 	case "auth-tgs":
-		authTgs(serverIp)
+		authTgs(serverIps)
 
 	case "auth-service":
-		authService(serverIp)
+		authService(serviceIp(serverIps))
+
+	case "renew":
+		renewTgsTickets(serverIps)
+
+	case "validate":
+		validateTgsTicket(serverIps)
+
+	case "s4u":
+		s4u(serverIps)
+
+	case "auth-user":
+		authUser(serviceIp(serverIps))
 
 	default:
 		fmt.Println("Unknown command: ", cmd)
@@ -45,7 +75,9 @@ func main() {
 
 }
 
-func authAs(serverIp string) {
+func authAs(serverIps []string) {
+
+	serverIps = kdcIps(serverIps, config.AsAddresses, "the AS")
 
 	fmt.Print("Insert your ClientId: ")
 	stdin.Scan()
@@ -55,6 +87,14 @@ func authAs(serverIp string) {
 	stdin.Scan()
 	tgsId := stdin.Text()
 
+	till := readRequestedTill()
+
+	options := readTicketOptions(dto.FlagRenewable)
+	var from int64
+	if options.Has(dto.FlagPostdated) {
+		from = readPostdatedFrom()
+	}
+
 	fmt.Print(clientId + "'s password: ")
 	stdin.Scan()
 	clientPwd := stdin.Text()
@@ -63,10 +103,22 @@ func authAs(serverIp string) {
 		ClientId:  clientId,
 		TGSId:     tgsId,
 		Timestamp: time.Now().UnixMilli(),
+		From:      from,
+		Till:      till,
+		Options:   options,
 	}
 
-	ticketData, err := protocol.RequestToAs(serverIp, req, clientPwd)
-	if err != nil && errors.Is(err, &kerrors.ReplyError{}) {
+	ticketData, err := protocol.RequestToAs(serverIps, req, clientPwd)
+	var preAuthErr *kerrors.PreAuthError
+	var timeoutErr *kerrors.TimeoutError
+	var networkErr *kerrors.NetworkError
+	if errors.As(err, &preAuthErr) {
+		fmt.Println("The AS requires pre-authentication for "+clientId+": ", err)
+		os.Exit(1)
+	} else if errors.As(err, &timeoutErr) || errors.As(err, &networkErr) {
+		fmt.Println("No AS reachable: ", err)
+		os.Exit(1)
+	} else if err != nil && errors.Is(err, &kerrors.ReplyError{}) {
 		fmt.Println("Error from AS: ", err)
 		os.Exit(1)
 	} else if err != nil && errors.Is(err, &kerrors.PasswordError{}) {
@@ -74,7 +126,7 @@ func authAs(serverIp string) {
 		os.Exit(1)
 	} else if err != nil {
 		fmt.Println(err)
-		panic(err)
+		os.Exit(1)
 	}
 
 	err = protocol.SaveTGSTicket(clientId, ticketData)
@@ -83,11 +135,12 @@ func authAs(serverIp string) {
 		os.Exit(1)
 	}
 
-	fmt.Println("Ticket for "+ticketData.TargetId+" saved with the temporary key in your local database. Expires in ", ticketData.Lifetime/1000/60, " minutes")
+	fmt.Println("Ticket for "+ticketData.TargetId+" saved with the temporary key in your credential cache. Expires in ", ticketData.Lifetime/1000/60, " minutes")
+	fmt.Println("Ticket flags: " + ticketData.Flags.String())
 
 }
 
-func authTgs(serverIp string) {
+func authTgs(serverIps []string) {
 
 	fmt.Print("Insert your ClientId: ")
 	stdin.Scan()
@@ -96,11 +149,16 @@ func authTgs(serverIp string) {
 	fmt.Print("Insert the TgsId of the Ticket Granting server where you want to authenticate: ")
 	stdin.Scan()
 	tgsId := stdin.Text()
+	serverIps = kdcIps(serverIps, config.TgsAddresses[tgsId], tgsId)
 
-	fmt.Print("Insert the ServiceId of the service where you want to authenticate: ")
+	fmt.Print("Insert the ServiceId of the service where you want to authenticate (service@REALM for other realms): ")
 	stdin.Scan()
 	serviceId := stdin.Text()
 
+	till := readRequestedTill()
+
+	options := readTicketOptions(0)
+
 	/*
 		fmt.Print(clientId + "'s password: ")
 		stdin.Scan()
@@ -113,15 +171,25 @@ func authTgs(serverIp string) {
 		os.Exit(1)
 	}
 
-	req, err := protocol.PrepareTGSRequest(serverIp, clientId, serviceId, tgsTicketData)
+	req, err := protocol.PrepareTGSRequest(serverIps[0], clientId, serviceId, tgsTicketData)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	req.Till = till
+	req.Options = options
 
-	serviceTicketData, err := protocol.RequestToTgs(serverIp, req, tgsTicketData)
+	serviceTicketData, err := protocol.RequestToTgsFollowingReferrals(serverIps, clientId, req, tgsTicketData)
 
-	if err != nil && errors.Is(err, &kerrors.ReplyError{}) {
+	var expiredErr *kerrors.TicketExpiredError
+	var unknownErr *kerrors.PrincipalUnknownError
+	if errors.As(err, &expiredErr) {
+		fmt.Println("The TGS ticket of "+clientId+" is expired, authenticate again with auth-as: ", err)
+		os.Exit(1)
+	} else if errors.As(err, &unknownErr) {
+		fmt.Println("Unknown service "+serviceId+": ", err)
+		os.Exit(1)
+	} else if err != nil && errors.Is(err, &kerrors.ReplyError{}) {
 		fmt.Println("Error from TGS: ", err)
 		os.Exit(1)
 	} else if err != nil && errors.Is(err, &kerrors.PasswordError{}) {
@@ -139,10 +207,132 @@ func authTgs(serverIp string) {
 		os.Exit(1)
 	}
 
-	fmt.Println("Ticket for service "+serviceTicketData.TargetId+" saved with the temporary key in your local database. Expires in ", serviceTicketData.Lifetime/1000/60, " minutes")
+	fmt.Println("Ticket for service "+serviceTicketData.TargetId+" saved with the temporary key in your credential cache. Expires in ", serviceTicketData.Lifetime/1000/60, " minutes")
 
 }
 
+// renewTgsTickets asks the TGSs to renew every renewable TGS ticket of the client, the expired ones and the ones
+// that can't be renewed are skipped. Each ticket is reported, the command fails if one couldn't be renewed
+func renewTgsTickets(serverIps []string) {
+
+	fmt.Print("Insert your ClientId: ")
+	stdin.Scan()
+	clientId := stdin.Text()
+
+	tgsTickets, err := protocol.RetriveTGSTickets(clientId)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(tgsTickets) == 0 {
+		fmt.Println("No TGS ticket found for " + clientId + ". Authentication with AS needed")
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, tgsTicketData := range tgsTickets {
+		tgsId := tgsTicketData.TargetId
+		now := time.Now().UnixMilli()
+
+		//SKIP THE TICKETS THE TGS WOULD REFUSE
+		switch {
+		case !tgsTicketData.Flags.Has(dto.FlagRenewable):
+			fmt.Println("Ticket for " + tgsId + " skipped: not renewable")
+			continue
+		case now > tgsTicketData.Timestamp+tgsTicketData.Lifetime:
+			fmt.Println("Ticket for " + tgsId + " skipped: expired, authenticate again with auth-as")
+			continue
+		case now >= tgsTicketData.RenewTill:
+			fmt.Println("Ticket for " + tgsId + " skipped: it can't be renewed anymore, authenticate again with auth-as")
+			continue
+		}
+
+		//THE ADDRESSES GIVEN BY THE USER ARE USED FOR EVERY TGS, OTHERWISE THE CONFIGURED ONES OF EACH TGS
+		tgsIps := serverIps
+		if len(tgsIps) == 0 {
+			tgsIps = config.TgsAddresses[tgsId]
+		}
+		if len(tgsIps) == 0 {
+			tgsIps = config.RealmTgs[tgsId]
+		}
+		if len(tgsIps) == 0 {
+			fmt.Println("Ticket for " + tgsId + " not renewed: no address configured for " + tgsId + ", give its ip")
+			failed = true
+			continue
+		}
+
+		renewedTicketData, err := requestReissue(tgsIps, clientId, tgsTicketData, false)
+		if err != nil {
+			fmt.Println("Ticket for "+tgsId+" not renewed: ", err)
+			failed = true
+			continue
+		}
+		fmt.Println("Ticket for "+renewedTicketData.TargetId+" renewed. Expires in ", renewedTicketData.Lifetime/1000/60, " minutes, renewable until ", time.UnixMilli(renewedTicketData.RenewTill).Format(time.DateTime))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// validateTgsTicket asks the TGS to validate a postdated TGS ticket once its start time has come
+func validateTgsTicket(serverIps []string) {
+
+	fmt.Print("Insert your ClientId: ")
+	stdin.Scan()
+	clientId := stdin.Text()
+
+	fmt.Print("Insert the TgsId of the Ticket Granting server that issued the ticket: ")
+	stdin.Scan()
+	tgsId := stdin.Text()
+	serverIps = kdcIps(serverIps, config.TgsAddresses[tgsId], tgsId)
+
+	tgsTicketData, err := protocol.RetriveTGSTicket(clientId, tgsId)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	validatedTicketData, err := requestReissue(serverIps, clientId, tgsTicketData, true)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Ticket for "+validatedTicketData.TargetId+" validated. Expires in ", (validatedTicketData.Timestamp+validatedTicketData.Lifetime-time.Now().UnixMilli())/1000/60, " minutes")
+	fmt.Println("Ticket flags: " + validatedTicketData.Flags.String())
+}
+
+// requestReissue asks the TGS to renew a TGS ticket, or to validate it if it's postdated, and saves the new one
+func requestReissue(serverIps []string, clientId string, tgsTicketData dto.TicketData, validate bool) (dto.TicketData, error) {
+
+	var req messages.TGSRequest
+	var err error
+	if validate {
+		req, err = protocol.PrepareTGSValidateRequest(serverIps[0], clientId, tgsTicketData)
+	} else {
+		req, err = protocol.PrepareTGSRenewRequest(serverIps[0], clientId, tgsTicketData)
+	}
+	if err != nil {
+		return dto.TicketData{}, err
+	}
+
+	reissuedTicketData, err := protocol.RequestToTgs(serverIps, req, tgsTicketData)
+	if err != nil && errors.Is(err, &kerrors.ReplyError{}) {
+		return dto.TicketData{}, fmt.Errorf("error from TGS: %w", err)
+	} else if err != nil && errors.Is(err, &kerrors.PasswordError{}) {
+		return dto.TicketData{}, fmt.Errorf("wrong client-tgs key: %w", err)
+	} else if err != nil {
+		return dto.TicketData{}, err
+	}
+
+	err = protocol.SaveTGSTicket(clientId, reissuedTicketData)
+	if err != nil {
+		return dto.TicketData{}, err
+	}
+	return reissuedTicketData, nil
+}
+
 func authService(serverIp string) {
 
 	fmt.Print("Insert the service port: ")
@@ -157,7 +347,7 @@ func authService(serverIp string) {
 	stdin.Scan()
 	clientId := stdin.Text()
 
-	fmt.Print("Insert the ServiceId of the service where you want to authenticate: ")
+	fmt.Print("Insert the ServiceId of the service where you want to authenticate (service@REALM for other realms): ")
 	stdin.Scan()
 	serviceId := stdin.Text()
 
@@ -179,6 +369,13 @@ func authService(serverIp string) {
 		os.Exit(1)
 	}
 
+	fmt.Print("Insert the TgsId of the TGS ticket to forward to the service (OPTIONAL, if not provided no ticket is forwarded): ")
+	stdin.Scan()
+	forwardTgsId := strings.TrimSpace(stdin.Text())
+	if forwardTgsId != "" {
+		forwardTicket(serverIp, clientId, forwardTgsId, &req, serviceTicketData)
+	}
+
 	serviceMsg, err := protocol.RequestToService(serverIp, int(servicePort), req, serviceTicketData, serviceTimestamp)
 
 	if err != nil && errors.Is(err, &kerrors.ReplyError{}) {
@@ -195,3 +392,248 @@ func authService(serverIp string) {
 	fmt.Println("Service reply: " + serviceMsg)
 
 }
+
+// authUser authenticates to a peer that holds only its TGS ticket: the TGS ticket of the peer is sent to the TGS,
+// which encrypts the ticket for the peer with its session key
+func authUser(serverIp string) {
+
+	fmt.Print("Insert the peer port: ")
+	stdin.Scan()
+	peerPort, err := strconv.ParseInt(stdin.Text(), 10, 32)
+	if err != nil {
+		fmt.Println("peer port must be an integer")
+		os.Exit(1)
+	}
+
+	fmt.Print("Insert your ClientId: ")
+	stdin.Scan()
+	clientId := stdin.Text()
+
+	fmt.Print("Insert the ClientId of the peer user: ")
+	stdin.Scan()
+	peerId := stdin.Text()
+
+	fmt.Print("Insert the ip of the Ticket Granting server that issued the TGS ticket of the peer (- for the configured addresses): ")
+	stdin.Scan()
+	tgsIps := splitIps(stdin.Text())
+
+	peerTicket, err := protocol.RequestPeerTGSTicket(serverIp, int(peerPort))
+	if err != nil {
+		fmt.Println("Can't get the TGS ticket of the peer: ", err)
+		os.Exit(1)
+	}
+
+	tgsId := peerTicket.TargetId
+	tgsTicketData, err := protocol.RetriveTGSTicket(clientId, tgsId)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tgsIps = kdcIps(tgsIps, config.TgsAddresses[tgsId], tgsId)
+
+	tgsReq, err := protocol.PrepareUserToUserRequest(tgsIps[0], clientId, peerId, peerTicket, tgsTicketData)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	peerTicketData, err := protocol.RequestToTgs(tgsIps, tgsReq, tgsTicketData)
+	if err != nil {
+		fmt.Println("Error from TGS: ", err)
+		os.Exit(1)
+	}
+
+	err = protocol.SaveServiceTicket(clientId, peerTicketData)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	req, peerTimestamp, err := protocol.PrepareServiceRequest(serverIp, clientId, peerId, peerTicketData)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	peerMsg, err := protocol.RequestToService(serverIp, int(peerPort), req, peerTicketData, peerTimestamp)
+	if err != nil {
+		fmt.Println("Error from "+peerId+": ", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(peerId + " reply: " + peerMsg)
+}
+
+// s4u gets, with S4U2Self and S4U2Proxy, a ticket to a target service for a user authenticated to the service by other
+// means. The ticket is saved as a service ticket of the user, so auth-service can use it
+func s4u(serverIps []string) {
+
+	fmt.Print("Insert your ServiceId: ")
+	stdin.Scan()
+	serviceId := stdin.Text()
+
+	fmt.Print("Insert the TgsId of the Ticket Granting server where you are authenticated: ")
+	stdin.Scan()
+	tgsId := stdin.Text()
+	serverIps = kdcIps(serverIps, config.TgsAddresses[tgsId], tgsId)
+
+	fmt.Print("Insert the ClientId of the user: ")
+	stdin.Scan()
+	forUser := stdin.Text()
+
+	fmt.Print("Insert the ServiceId of the target service: ")
+	stdin.Scan()
+	targetServiceId := stdin.Text()
+
+	tgsTicketData, err := protocol.RetriveTGSTicket(serviceId, tgsId)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	//S4U2SELF
+	req, err := protocol.PrepareS4U2SelfRequest(serverIps[0], serviceId, forUser, tgsTicketData)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	evidenceTicketData, err := protocol.RequestToTgs(serverIps, req, tgsTicketData)
+	if err != nil {
+		fmt.Println("Error from TGS: ", err)
+		os.Exit(1)
+	}
+
+	//S4U2PROXY
+	req, err = protocol.PrepareS4U2ProxyRequest(serverIps[0], serviceId, targetServiceId, evidenceTicketData, tgsTicketData)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	serviceTicketData, err := protocol.RequestToTgs(serverIps, req, tgsTicketData)
+	if err != nil {
+		fmt.Println("Error from TGS: ", err)
+		os.Exit(1)
+	}
+
+	err = protocol.SaveServiceTicket(forUser, serviceTicketData)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Ticket for service "+serviceTicketData.TargetId+" on behalf of "+forUser+" saved in your credential cache. Expires in ", serviceTicketData.Lifetime/1000/60, " minutes")
+}
+
+// forwardTicket gets from the TGS a copy of the TGS ticket bound to the service address and attaches it to the service request
+func forwardTicket(serviceIp string, clientId string, tgsId string, req *messages.ServiceRequest, serviceTicketData dto.TicketData) {
+
+	fmt.Print("Insert the ip of TGS " + tgsId + " (- for the configured addresses): ")
+	stdin.Scan()
+	tgsIps := kdcIps(splitIps(stdin.Text()), config.TgsAddresses[tgsId], tgsId)
+
+	tgsTicketData, err := protocol.RetriveTGSTicket(clientId, tgsId)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	tgsReq, err := protocol.PrepareTGSForwardRequest(tgsIps[0], clientId, serviceIp, tgsTicketData)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	forwardedTicketData, err := protocol.RequestToTgs(tgsIps, tgsReq, tgsTicketData)
+	if err != nil {
+		fmt.Println("Error from TGS: ", err)
+		os.Exit(1)
+	}
+
+	err = protocol.AttachForwardedTicket(req, serviceTicketData, forwardedTicketData)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// readRequestedTill asks for the wanted ticket lifetime and returns the requested end time (0 for the default lifetime)
+func readRequestedTill() int64 {
+	fmt.Print("Insert the wanted ticket lifetime in minutes (OPTIONAL, if not provided the default lifetime is used): ")
+	stdin.Scan()
+	text := strings.TrimSpace(stdin.Text())
+	if text == "" {
+		return 0
+	}
+
+	minutes, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || minutes <= 0 {
+		fmt.Println("lifetime must be a positive integer")
+		os.Exit(1)
+	}
+	return time.Now().UnixMilli() + minutes*60*1000
+}
+
+// readTicketOptions asks for the wanted ticket flags, defaultOptions are used if none is provided
+func readTicketOptions(defaultOptions dto.TicketFlags) dto.TicketFlags {
+	fmt.Print("Insert the wanted ticket options separated by commas (OPTIONAL: forwardable, proxiable, renewable, may-postdate, postdated; default: " + defaultOptions.String() + "): ")
+	stdin.Scan()
+	text := strings.TrimSpace(stdin.Text())
+	if text == "" {
+		return defaultOptions
+	}
+
+	var options dto.TicketFlags
+	for _, name := range strings.Split(text, ",") {
+		flag, ok := dto.ParseTicketFlag(name)
+		if !ok {
+			fmt.Println("Unknown ticket option: ", name)
+			os.Exit(1)
+		}
+		options |= flag
+	}
+	return options
+}
+
+// readPostdatedFrom asks when a postdated ticket has to start and returns the start time
+func readPostdatedFrom() int64 {
+	fmt.Print("Insert in how many minutes the postdated ticket has to start: ")
+	stdin.Scan()
+	minutes, err := strconv.ParseInt(strings.TrimSpace(stdin.Text()), 10, 64)
+	if err != nil || minutes <= 0 {
+		fmt.Println("start time must be a positive integer")
+		os.Exit(1)
+	}
+	return time.Now().UnixMilli() + minutes*60*1000
+}
+
+// splitIps splits a comma separated list of ips, - (or nothing) means the addresses of the configuration file
+func splitIps(text string) []string {
+	text = strings.TrimSpace(text)
+	if text == "-" || text == "" {
+		return nil
+	}
+	return strings.Split(text, ",")
+}
+
+// kdcIps returns the ips given by the user or, if none were given, the configured addresses of kdc
+func kdcIps(serverIps []string, configured []string, kdc string) []string {
+	if len(serverIps) > 0 {
+		return serverIps
+	}
+	if len(configured) == 0 {
+		fmt.Println("No address configured for " + kdc + ", give its ip")
+		os.Exit(1)
+	}
+	return configured
+}
+
+// serviceIp returns the ip of the service, services are not in the configuration file
+func serviceIp(serverIps []string) string {
+	if len(serverIps) == 0 {
+		fmt.Println("The ip of the service is needed")
+		os.Exit(1)
+	}
+	return serverIps[0]
+}
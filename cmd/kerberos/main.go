@@ -2,19 +2,33 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"os/signal"
 	config "simple_kerberos/configs"
 	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
 	"simple_kerberos/internal/protocol"
 	"simple_kerberos/internal/security"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 var stdin = bufio.NewScanner(os.Stdin)
 
 // KERBEROS
 func main() {
+	_, err := config.LoadFromArgs(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	fmt.Println("Kerberos KDC started")
 
 	//READ ADMIN PWD
@@ -27,25 +41,165 @@ func main() {
 		os.Exit(1)
 	}
 
-	endCh := make(chan bool)
-
-	for i, tgsId := range config.TgsList {
+	//SERVERS STOP ON SIGINT OR SIGTERM, AFTER ANSWERING THE REQUESTS IN PROGRESS
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	//ON SIGHUP THE CONFIGURATION FILE IS RELOADED
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+
+	//SERVERS STARTED WITH THE KDC ARE NEEDED: IF ONE CAN'T START, ALL THE OTHERS ARE STOPPED.
+	//THE ONES STARTED BY A RELOAD CAN FAIL ALONE
+	startServer := func(address string, start func(context.Context) error, needed bool) *server {
+		serverCtx, cancel := context.WithCancel(ctx)
+		s := &server{address: address, cancel: cancel, done: make(chan struct{})}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(s.done)
+			if err := start(serverCtx); err != nil {
+				fmt.Println("Server error: ", err)
+				if needed {
+					failed.Store(true)
+					stop()
+				}
+			}
+		}()
+		return s
+	}
 
-		initTgsConfigIfNotExists(tgsId, adminPwd)
+	//THE KEY OF A NEW TGS IS CREATED IN ITS DB AND REGISTERED IN THE AS DB BEFORE IT STARTS SERVING
+	startTgs := func(tgsId string, needed bool) (*server, error) {
+		if err := initTgsConfigIfNotExists(tgsId, adminPwd); err != nil {
+			return nil, err
+		}
 
-		key := retriveTgsConfig(tgsId, adminPwd)
+		key, err := retriveTgsConfig(tgsId, adminPwd)
+		if err != nil {
+			return nil, err
+		}
 
 		if err := protocol.AddTGS(tgsId, key, adminPwd); err != nil {
-			fmt.Println(err)
+			return nil, err
+		}
+
+		tgsIp := config.Current().TgsListenAddresses[tgsId]
+		return startServer(tgsAddress(tgsId), func(ctx context.Context) error {
+			return protocol.StartTGS(ctx, tgsIp, tgsId, adminPwd)
+		}, needed), nil
+	}
+
+	startAs := func(needed bool) *server {
+		asIp := config.Current().AsListenAddress
+		return startServer(asAddress(), func(ctx context.Context) error {
+			return protocol.StartAS(ctx, asIp, adminPwd)
+		}, needed)
+	}
+
+	tgsServers := map[string]*server{}
+	for _, tgsId := range config.Current().TgsList {
+		s, err := startTgs(tgsId, true)
+		if err != nil {
+			fmt.Println("TGS "+tgsId+" not started: ", err)
+			stop()
+			for _, started := range tgsServers {
+				started.shutdown()
+			}
 			os.Exit(1)
 		}
+		tgsServers[tgsId] = s
+	}
+	asServer := startAs(true)
+
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-hup:
+			fmt.Println("Reloading configuration...")
+			if err := config.Reload(); err != nil {
+				fmt.Println(err)
+				fmt.Println("Configuration not changed")
+				continue
+			}
+
+			//SERVERS REMOVED OR MOVED TO ANOTHER ADDRESS ARE STOPPED BEFORE STARTING THE NEW ONES, SO THAT THEY CAN
+			//TAKE THEIR ADDRESSES. THE OTHERS KEEP SERVING AND USE THE NEW LIFETIMES AND POLICIES FROM THE NEXT REQUEST
+			for tgsId, s := range tgsServers {
+				_, listed := config.Current().TgsListenAddresses[tgsId]
+				if listed && s.address == tgsAddress(tgsId) && !s.stopped() {
+					continue
+				}
+				s.shutdown()
+				delete(tgsServers, tgsId)
+				if !listed {
+					if err := protocol.RemoveTGS(tgsId, adminPwd); err != nil {
+						fmt.Println(err)
+					}
+					fmt.Println("TGS " + tgsId + " removed")
+				}
+			}
+			if asServer.address != asAddress() || asServer.stopped() {
+				asServer.shutdown()
+				asServer = startAs(false)
+			}
+			for _, tgsId := range config.Current().TgsList {
+				if _, running := tgsServers[tgsId]; running {
+					continue
+				}
+				//A TGS THAT CAN'T BE STARTED IS SKIPPED, THE NEXT RELOAD TRIES AGAIN
+				s, err := startTgs(tgsId, false)
+				if err != nil {
+					fmt.Println("TGS "+tgsId+" not started: ", err)
+					continue
+				}
+				tgsServers[tgsId] = s
+			}
+			fmt.Println("Configuration reloaded")
+		}
+	}
 
-		go protocol.StartTGS("127.0.0."+fmt.Sprint(i+2), tgsId, key, adminPwd)
+	wg.Wait()
+
+	fmt.Println("Kerberos KDC stopped")
+	if failed.Load() {
+		os.Exit(1)
 	}
+	os.Exit(0)
+}
+
+// server is an AS or TGS running on its own goroutine
+type server struct {
+	address string
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// shutdown stops the server and waits until the requests in progress have been answered
+func (s *server) shutdown() {
+	s.cancel()
+	<-s.done
+}
 
-	go protocol.StartAS("127.0.0.1", adminPwd)
+// stopped reports whether the server is no longer running, e.g. because it couldn't start
+func (s *server) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func asAddress() string {
+	return net.JoinHostPort(config.Current().AsListenAddress, strconv.Itoa(config.Current().AsPort))
+}
 
-	<-endCh
+func tgsAddress(tgsId string) string {
+	return net.JoinHostPort(config.Current().TgsListenAddresses[tgsId], strconv.Itoa(config.Current().TgsPort))
 }
 
 func checkDbPwd(pwd string) bool {
@@ -63,7 +217,7 @@ func checkDbPwd(pwd string) bool {
 		return false
 	}
 
-	for _, tgsId := range config.TgsList {
+	for _, tgsId := range config.Current().TgsList {
 
 		db, err = dao.OpenEncryptedTGSDb(config.TgsDbPath+tgsId+".db", pwd)
 
@@ -83,43 +237,41 @@ func checkDbPwd(pwd string) bool {
 	return true
 }
 
-func initTgsConfigIfNotExists(tgsId string, adminPwd string) {
+func initTgsConfigIfNotExists(tgsId string, adminPwd string) error {
 
 	db, err := dao.OpenEncryptedTGSDb(config.TgsDbPath+tgsId+".db", adminPwd)
 	if err != nil {
-		fmt.Println("Db opening problem: ", err)
-		os.Exit(1)
+		return fmt.Errorf("db opening problem: %w", err)
 	}
 	defer db.Close()
 
 	exists, err := dao.TgsConfigExists(db)
 	if err != nil {
-		fmt.Println("Db opening problem: ", err)
-		os.Exit(1)
+		return fmt.Errorf("db opening problem: %w", err)
 	}
 	if exists {
-		return
+		return nil
 	}
 
 	key := security.GenerateRandomKey(config.SymmKeyDim)
 
-	dao.InsertTgsConfig(tgsId, key, db)
+	return dao.InsertTgsConfig(tgsId, key, db)
 }
 
-func retriveTgsConfig(tgsId string, adminPwd string) []byte {
+func retriveTgsConfig(tgsId string, adminPwd string) (dto.VersionedKey, error) {
 
 	db, err := dao.OpenEncryptedTGSDb(config.TgsDbPath+tgsId+".db", adminPwd)
 	if err != nil {
-		fmt.Println("Db opening problem: ", err)
-		os.Exit(1)
+		return dto.VersionedKey{}, fmt.Errorf("db opening problem: %w", err)
 	}
 
+	defer db.Close()
+
 	_, key, err := dao.GetTgsConfig(db)
 	if err != nil {
-		fmt.Println("Db opening problem: ", err)
-		os.Exit(1)
+		return dto.VersionedKey{}, fmt.Errorf("db opening problem: %w", err)
 	}
 
-	return key
+	return key, nil
 
 }
@@ -1,50 +1,120 @@
 package main
 
 import (
-	"encoding/hex"
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	config "simple_kerberos/configs"
 	"simple_kerberos/internal/protocol"
 	"strconv"
-	"strings"
+	"syscall"
 )
 
+var args []string
+
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: service serviceId serviceIp servicePort")
+	var err error
+	args, err = config.LoadFromArgs(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if len(args) > 1 && args[1] == "--user-to-user" {
+		startUserToUser()
+		return
+	}
+
+	//FORWARDED TICKETS ARE KEPT ONLY IF ASKED
+	app := protocol.ServiceApplication(nil)
+	if len(args) > 1 && args[1] == "--keep-forwarded" {
+		app = protocol.KeepForwardedHelloApplication
+		args = append(args[:1], args[2:]...)
+	}
+
+	//A KEYTAB CAN BE GIVEN INSTEAD OF THE KEY FILE OF THE SERVICE
+	var keyFilePath string
+	if len(args) > 2 && args[1] == "--keytab" {
+		keyFilePath = args[2]
+		args = append(args[:1], args[3:]...)
+	}
+
+	if len(args) < 4 {
+		fmt.Println("Usage: service [--config file] [--keep-forwarded] [--keytab file] serviceId serviceIp servicePort")
+		fmt.Println("       service [--config file] --user-to-user clientId tgsId serviceIp servicePort")
 		os.Exit(1)
 	}
 
-	serviceId := os.Args[1]
-	serviceIp := os.Args[2]
-	servicePort, err := strconv.ParseInt(os.Args[3], 10, 32)
+	serviceId := args[1]
+	serviceIp := args[2]
+	servicePort, err := strconv.ParseInt(args[3], 10, 32)
 	if err != nil {
 		fmt.Println("servicePort must be an integer")
 		os.Exit(1)
 	}
 
-	var key []byte
-	keyFilePath := config.ServiceKeyPath + serviceId + ".key"
-	if _, err := os.Stat(filepath.Clean(keyFilePath)); keyFilePath == "" || err != nil {
-		fmt.Println("Can't find " + serviceId + ".key file")
+	if keyFilePath == "" {
+		keyFilePath = config.ServiceKeyPath + serviceId + ".key"
+	}
+	if _, err := os.Stat(filepath.Clean(keyFilePath)); err != nil {
+		fmt.Println("Can't find " + keyFilePath + " file")
 		os.Exit(1)
 	}
 
-	key, err = os.ReadFile(filepath.Clean(keyFilePath))
+	//CHECK THE KEY FILE, THE SERVICE READS IT AGAIN WHEN IT CHANGES TO PICK UP ROTATED KEYS
+	keys, err := protocol.ReadServiceKeys(keyFilePath, serviceId)
 	if err != nil {
-		panic(err)
+		fmt.Println("ERROR: ", err)
+		os.Exit(1)
+	}
+	fmt.Println("Current key version: " + fmt.Sprint(keys.Current().Kvno))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if app != nil {
+		err = protocol.StartServiceWithApplication(ctx, serviceIp, int(servicePort), serviceId, keyFilePath, app)
+	} else {
+		err = protocol.StartService(ctx, serviceIp, int(servicePort), serviceId, keyFilePath)
 	}
-	key, err = hex.DecodeString(strings.TrimSpace(string(key)))
 	if err != nil {
-		fmt.Println("ERROR: Malformed key")
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	if len(key) != config.SymmKeyDim/8 {
-		fmt.Println("ERROR: Key lenght not matching with symmetric key dim")
+	fmt.Println("Service " + serviceId + " stopped")
+}
+
+// startUserToUser serves clients as a user holding only its TGS ticket (got with client auth-as), without a long-term key
+func startUserToUser() {
+	if len(args) < 6 {
+		fmt.Println("Usage: service [--config file] --user-to-user clientId tgsId serviceIp servicePort")
+		os.Exit(1)
+	}
+
+	clientId := args[2]
+	tgsId := args[3]
+	serviceIp := args[4]
+	servicePort, err := strconv.ParseInt(args[5], 10, 32)
+	if err != nil {
+		fmt.Println("servicePort must be an integer")
 		os.Exit(1)
 	}
 
-	protocol.StartService(serviceIp, int(servicePort), serviceId, key)
+	tgsTicketData, err := protocol.RetriveTGSTicket(clientId, tgsId)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = protocol.StartUserToUserService(ctx, serviceIp, int(servicePort), clientId, tgsTicketData)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Service " + clientId + " stopped")
 }
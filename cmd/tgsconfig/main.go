@@ -4,32 +4,54 @@ import (
 	"bufio"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
 	"path/filepath"
 	config "simple_kerberos/configs"
 	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/protocol"
 	"simple_kerberos/internal/security"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var stdin = bufio.NewScanner(os.Stdin)
+var args []string
 
 func main() {
 
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: tgsconfig tgsName <command>")
+	var err error
+	args, err = config.LoadFromArgs(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if len(args) < 3 {
+		fmt.Println("Usage: tgsconfig [--config file] tgsName <command>")
 		fmt.Println("Available commands:")
 		fmt.Println("add-service\t\tRegister a new service")
 		fmt.Println("show-services\t\tShow all the services registered")
 		fmt.Println("get-service\t\tRetrieve a specific service")
 		fmt.Println("delete-service\t\tDelete a specific service")
+		fmt.Println("set-max-lifetime\tSet the max ticket lifetime for a service")
+		fmt.Println("set-delegation\t\tSet the services to which a service can delegate")
+		fmt.Println("set-enctypes\t\tSet the enctypes supported by a service or by a trusted realm")
+		fmt.Println("add-realm\t\tAdd a trusted realm sharing an inter-realm key")
+		fmt.Println("show-realms\t\tShow all the trusted realms")
+		fmt.Println("delete-realm\t\tDelete a trusted realm")
+		fmt.Println("rotate-key\t\tReplace the key of the TGS, of a service or of a trusted realm")
+		fmt.Println("export-keytab\t\tExport the keys of a service to a keytab")
 		os.Exit(1)
 	}
 
-	tgsName := os.Args[1]
-	cmd := os.Args[2]
+	tgsName := args[1]
+	cmd := args[2]
 
 	switch cmd {
 	case "add-service":
@@ -44,6 +66,30 @@ func main() {
 	case "delete-service":
 		deleteService(tgsName)
 
+	case "set-max-lifetime":
+		setMaxLifetime(tgsName)
+
+	case "set-delegation":
+		setDelegation(tgsName)
+
+	case "set-enctypes":
+		setEnctypes(tgsName)
+
+	case "add-realm":
+		addRealm(tgsName)
+
+	case "show-realms":
+		showRealms(tgsName)
+
+	case "delete-realm":
+		deleteRealm(tgsName)
+
+	case "rotate-key":
+		rotateKey(tgsName)
+
+	case "export-keytab":
+		exportKeytab(tgsName)
+
 	default:
 		fmt.Println("Unknown command: ", cmd)
 	}
@@ -51,11 +97,16 @@ func main() {
 }
 
 func readAdminPwAndOpenDb(tgsName string) *sql.DB {
-	//GET ADMIN PWD
+	return openDb(tgsName, readAdminPw())
+}
+
+func readAdminPw() string {
 	fmt.Print("Administrator password: ")
 	stdin.Scan()
-	adminPwd := url.QueryEscape(stdin.Text())
+	return url.QueryEscape(stdin.Text())
+}
 
+func openDb(tgsName string, adminPwd string) *sql.DB {
 	//OPEN DB
 	db, err := dao.OpenEncryptedTGSDb(config.TgsDbPath+tgsName+".db", adminPwd)
 	if err != nil {
@@ -76,7 +127,7 @@ func showServices(tgsName string) {
 	}
 	fmt.Println("\nRegistered services:")
 	for _, s := range services {
-		fmt.Printf("DbId: %d, ServiceId: %s, Key: %s\n", s.DbId, s.ServiceId, hex.EncodeToString(s.Key))
+		fmt.Printf("DbId: %d, ServiceId: %s, Kvno: %d, Key: %s, MaxLifetime: %d min, Delegation: %s, Enctypes: %s\n", s.DbId, s.ServiceId, s.Kvno, hex.EncodeToString(s.Key), s.MaxLifetime/1000/60, strings.Join(s.DelegationTargets, ","), security.FormatEnctypes(s.Enctypes))
 	}
 }
 
@@ -95,7 +146,7 @@ func getService(tgsName string) {
 		panic(err)
 	}
 	fmt.Println("\nService:")
-	fmt.Printf("DbId: %d, ClientId: %s, Key: %s\n", s.DbId, s.ServiceId, hex.EncodeToString(s.Key))
+	fmt.Printf("DbId: %d, ClientId: %s, Kvno: %d, Key: %s, MaxLifetime: %d min, Delegation: %s, Enctypes: %s\n", s.DbId, s.ServiceId, s.Kvno, hex.EncodeToString(s.Key), s.MaxLifetime/1000/60, strings.Join(s.DelegationTargets, ","), security.FormatEnctypes(s.Enctypes))
 }
 
 func deleteService(tgsName string) {
@@ -107,8 +158,12 @@ func deleteService(tgsName string) {
 	stdin.Scan()
 	serviceId := stdin.Text()
 
-	//GET CLIENTS
-	err := dao.DeleteClientByClientId(serviceId, db)
+	//DELETE THE SERVICE AND THE PREVIOUS VERSIONS OF ITS KEY
+	err := dao.DeletePreviousKeys(dao.KeyKindService, serviceId, db)
+	if err != nil {
+		panic(err)
+	}
+	err = dao.DeleteServiceByServiceId(serviceId, db)
 	if err != nil {
 		panic(err)
 	}
@@ -134,11 +189,11 @@ func addService(tgsName string) {
 		fmt.Println("File not specified or file not found: generate key")
 		key = security.GenerateRandomKey(config.SymmKeyDim)
 		fmt.Println(hex.EncodeToString(key))
-		err := os.WriteFile("data/"+serviceId+".key", []byte(hex.EncodeToString(key)), 0600)
+		err := protocol.WriteKeyFile(config.ServiceKeyPath+serviceId+".key", dto.KeySet{{Kvno: 1, Key: key}})
 		if err != nil {
-			fmt.Println("Couldn't save key in data folder")
+			fmt.Println("Couldn't save key in " + config.ServiceKeyPath)
 		} else {
-			fmt.Println("Key saved in data/" + serviceId + ".key")
+			fmt.Println("Key saved in " + config.ServiceKeyPath + serviceId + ".key")
 		}
 
 	} else {
@@ -157,6 +212,363 @@ func addService(tgsName string) {
 		}
 	}
 
+	maxLifetime := readMaxLifetime(serviceId)
+	enctypes := readEnctypes(serviceId)
+
 	//SAVE TGS
-	dao.InsertService(serviceId, key, db)
+	dao.InsertService(serviceId, key, maxLifetime, enctypes, db)
+}
+
+func addRealm(tgsName string) {
+	db := readAdminPwAndOpenDb(tgsName)
+	defer db.Close()
+
+	//GET REALM DATA
+	fmt.Print("Insert the trusted realm: ")
+	stdin.Scan()
+	realm := strings.TrimSpace(stdin.Text())
+
+	fmt.Print("Insert the TgsId of the TGS of " + realm + " that accepts referrals from this realm: ")
+	stdin.Scan()
+	tgsId := strings.TrimSpace(stdin.Text())
+
+	fmt.Print("Insert inter-realm key file shared with " + realm + " (OPTIONAL, if not provided a new symmetric key will be generated and printed in the terminal): ")
+	stdin.Scan()
+	keyFilePath := strings.TrimSpace(stdin.Text())
+
+	//RETRIVE OR GENERATE KEY
+	var key []byte
+	if _, err := os.Stat(filepath.Clean(keyFilePath)); keyFilePath == "" || err != nil {
+		fmt.Println("File not specified or file not found: generate key")
+		key = security.GenerateRandomKey(config.SymmKeyDim)
+		fmt.Println(hex.EncodeToString(key))
+		err := os.WriteFile(config.TgsDbPath+realm+".key", []byte(hex.EncodeToString(key)), 0600)
+		if err != nil {
+			fmt.Println("Couldn't save key in " + config.TgsDbPath)
+		} else {
+			fmt.Println("Key saved in " + config.TgsDbPath + realm + ".key, give it to the administrator of " + realm)
+		}
+
+	} else {
+		key, err = os.ReadFile(filepath.Clean(keyFilePath))
+		if err != nil {
+			panic(err)
+		}
+		key, err = hex.DecodeString(string(key))
+		if err != nil {
+			fmt.Println("ERROR: Malformed key")
+			os.Exit(1)
+		}
+		if len(key) != config.SymmKeyDim/8 {
+			fmt.Println("ERROR: Key lenght not matching with symmetric key dim")
+			os.Exit(1)
+		}
+	}
+
+	enctypes := readEnctypes("the TGS of " + realm)
+
+	//SAVE REALM
+	err := dao.InsertRealm(realm, tgsId, key, enctypes, db)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func showRealms(tgsName string) {
+	db := readAdminPwAndOpenDb(tgsName)
+	defer db.Close()
+
+	//GET ALL REALMS
+	realms, err := dao.GetAllRealms(db)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("\nTrusted realms:")
+	for _, r := range realms {
+		fmt.Printf("DbId: %d, Realm: %s, TgsId: %s, Kvno: %d, Key: %s, Enctypes: %s\n", r.DbId, r.Realm, r.TgsId, r.Kvno, hex.EncodeToString(r.Key), security.FormatEnctypes(r.Enctypes))
+	}
+}
+
+func deleteRealm(tgsName string) {
+	db := readAdminPwAndOpenDb(tgsName)
+	defer db.Close()
+
+	fmt.Print("Realm: ")
+	stdin.Scan()
+	realm := stdin.Text()
+
+	err := dao.DeleteRealm(realm, db)
+	if err != nil {
+		panic(err)
+	}
+	err = dao.DeletePreviousKeys(dao.KeyKindRealm, realm, db)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("\nRealm " + realm + " deleted")
+}
+
+func setMaxLifetime(tgsName string) {
+	db := readAdminPwAndOpenDb(tgsName)
+	defer db.Close()
+
+	fmt.Print("ServiceId: ")
+	stdin.Scan()
+	serviceId := stdin.Text()
+
+	maxLifetime := readMaxLifetime(serviceId)
+
+	//UPDATE SERVICE
+	err := dao.UpdateServiceMaxLifetime(serviceId, maxLifetime, db)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("\nMax lifetime for %s: %d min\n", serviceId, maxLifetime/1000/60)
+}
+
+func setDelegation(tgsName string) {
+	db := readAdminPwAndOpenDb(tgsName)
+	defer db.Close()
+
+	fmt.Print("ServiceId: ")
+	stdin.Scan()
+	serviceId := stdin.Text()
+
+	fmt.Print("Insert the services to which " + serviceId + " can get tickets on behalf of its clients, separated by commas (empty to disable delegation): ")
+	stdin.Scan()
+	var targets []string
+	for _, t := range strings.Split(stdin.Text(), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
+		}
+	}
+
+	//UPDATE SERVICE
+	err := dao.UpdateServiceDelegationTargets(serviceId, targets, db)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("\nDelegation targets for " + serviceId + ": " + strings.Join(targets, ","))
+}
+
+// setEnctypes sets the enctypes that a service, or the TGS of a trusted realm, supports with its key:
+// the tickets for it are encrypted with the strongest one also supported by the client
+func setEnctypes(tgsName string) {
+	db := readAdminPwAndOpenDb(tgsName)
+	defer db.Close()
+
+	fmt.Print("ServiceId, or realm:REALM for a trusted realm: ")
+	stdin.Scan()
+	principal := strings.TrimSpace(stdin.Text())
+
+	var err error
+	if realm, found := strings.CutPrefix(principal, "realm:"); found {
+		enctypes := readEnctypes("the TGS of " + realm)
+		err = dao.UpdateRealmEnctypes(realm, enctypes, db)
+	} else {
+		enctypes := readEnctypes(principal)
+		err = dao.UpdateServiceEnctypes(principal, enctypes, db)
+	}
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("\nEnctypes for " + principal + " updated")
+}
+
+// rotateKey replaces the key of a service, of the TGS or of a trusted realm with a new version. The previous key
+// stays valid for a grace period, so that the tickets already issued with it can still be used
+func rotateKey(tgsName string) {
+	adminPwd := readAdminPw()
+	db := openDb(tgsName, adminPwd)
+	defer db.Close()
+
+	fmt.Print("ServiceId, realm:REALM for a trusted realm (OPTIONAL, if not provided the key of " + tgsName + " is rotated): ")
+	stdin.Scan()
+	principal := strings.TrimSpace(stdin.Text())
+
+	fmt.Print("Insert the new key file (OPTIONAL, if not provided a new symmetric key will be generated): ")
+	stdin.Scan()
+	keyFilePath := strings.TrimSpace(stdin.Text())
+
+	//RETRIVE OR GENERATE KEY
+	var key []byte
+	if _, err := os.Stat(filepath.Clean(keyFilePath)); keyFilePath == "" || err != nil {
+		fmt.Println("File not specified or file not found: generate key")
+		key = security.GenerateRandomKey(config.SymmKeyDim)
+	} else {
+		keys, err := protocol.ReadKeyFile(keyFilePath)
+		if err != nil {
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
+		}
+		key = keys.Current().Key
+	}
+
+	//THE PREVIOUS KEY MUST OUTLIVE THE TICKETS ISSUED WITH IT
+	settings := config.Current()
+	grace := readGracePeriod(max(settings.MaxLifetime, settings.MaxRenewableLifetime))
+	now := time.Now().UnixMilli()
+	expires := now + grace
+
+	err := dao.DeleteExpiredKeys(now, db)
+	if err != nil {
+		panic(err)
+	}
+
+	var kvno int
+	if realm, found := strings.CutPrefix(principal, "realm:"); found {
+		kvno, err = dao.RotateRealmKey(realm, key, expires, db)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(hex.EncodeToString(key))
+		err = os.WriteFile(config.TgsDbPath+realm+".key", []byte(hex.EncodeToString(key)), 0600)
+		if err != nil {
+			fmt.Println("Couldn't save key in " + config.TgsDbPath)
+		} else {
+			fmt.Println("Key saved in " + config.TgsDbPath + realm + ".key, the administrator of " + realm + " must rotate to it too")
+		}
+
+	} else if principal != "" {
+		kvno, err = dao.RotateServiceKey(principal, key, expires, db)
+		if err != nil {
+			panic(err)
+		}
+
+		//THE SERVICE READS ALL ITS VALID KEYS FROM ITS KEY FILE
+		keys, err := dao.GetKeySet(dao.KeyKindService, principal, dto.VersionedKey{Kvno: kvno, Key: key}, db)
+		if err != nil {
+			panic(err)
+		}
+		err = protocol.WriteKeyFile(config.ServiceKeyPath+principal+".key", keys)
+		if err != nil {
+			fmt.Println("Couldn't save keys in " + config.ServiceKeyPath)
+		} else {
+			fmt.Println("Keys saved in " + config.ServiceKeyPath + principal + ".key")
+		}
+
+		//KEYTABS HAVE NO EXPIRATION: THEY MUST BE EXPORTED AGAIN WITH THE NEW KEY AND AFTER THE GRACE PERIOD
+		fmt.Println("If the service uses a keytab, run export-keytab now for the new key and again after " +
+			time.UnixMilli(expires).Format(time.DateTime) + " to remove the previous one")
+
+	} else {
+		principal = tgsName
+		kvno, err = dao.RotateTgsKey(tgsName, key, expires, db)
+		if err != nil {
+			panic(err)
+		}
+
+		//THE AS ENCRYPTS THE TICKETS FOR THE TGS WITH THE NEW KEY
+		err = protocol.AddTGS(tgsName, dto.VersionedKey{Kvno: kvno, Key: key}, adminPwd)
+		if err != nil {
+			fmt.Println("Couldn't update the key in the AS db, it will be updated when the KDC is restarted: ", err)
+		}
+	}
+
+	fmt.Printf("\nKey of %s rotated, new key version: %d, previous key valid until %s\n", principal, kvno, time.UnixMilli(expires).Format(time.DateTime))
+}
+
+// exportKeytab writes the valid keys of a service to a keytab, with an entry for every enctype supported by the
+// service. The entries of the service already in the keytab are replaced, the ones of other services are kept.
+// Keytabs can't store the expiration of the previous keys, so the expired ones are left out: the keytab must be
+// exported again at every rotation and at the end of its grace period
+func exportKeytab(tgsName string) {
+	db := readAdminPwAndOpenDb(tgsName)
+	defer db.Close()
+
+	fmt.Print("ServiceId: ")
+	stdin.Scan()
+	serviceId := strings.TrimSpace(stdin.Text())
+
+	s, err := dao.GetServiceByServiceId(serviceId, db)
+	if err != nil {
+		panic(err)
+	}
+	keys, err := dao.GetKeySet(dao.KeyKindService, serviceId, s.VersionedKey(), db)
+	if err != nil {
+		panic(err)
+	}
+
+	keytabPath := config.ServiceKeyPath + serviceId + ".keytab"
+	fmt.Print("Keytab file (OPTIONAL, if not provided " + keytabPath + "): ")
+	stdin.Scan()
+	if text := strings.TrimSpace(stdin.Text()); text != "" {
+		keytabPath = text
+	}
+
+	//KEEP THE ENTRIES OF THE OTHER SERVICES
+	entries, err := security.ReadKeytab(keytabPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("ERROR: ", err)
+		os.Exit(1)
+	}
+	entries = slices.DeleteFunc(entries, func(e security.KeytabEntry) bool {
+		return dto.SamePrincipal(e.Principal+"@"+e.Realm, serviceId, config.Realm)
+	})
+
+	now := time.Now()
+	for _, k := range keys {
+		if k.Expires != 0 && k.Expires <= now.UnixMilli() {
+			continue
+		}
+		for _, enctype := range s.Enctypes {
+			entries = append(entries, security.KeytabEntry{
+				Principal: serviceId,
+				Realm:     config.Realm,
+				Timestamp: uint32(now.Unix()),
+				Kvno:      uint32(k.Kvno),
+				Enctype:   enctype,
+				Key:       k.Key,
+			})
+		}
+	}
+
+	err = security.WriteKeytab(keytabPath, entries)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("\nKeys of " + serviceId + " exported to " + keytabPath + ", start the service with --keytab " + keytabPath)
+}
+
+func readGracePeriod(defaultGrace int64) int64 {
+	fmt.Print("Grace period in minutes for the previous key (OPTIONAL, if not provided " + fmt.Sprint(defaultGrace/1000/60) + " min): ")
+	stdin.Scan()
+	text := strings.TrimSpace(stdin.Text())
+	if text == "" {
+		return defaultGrace
+	}
+
+	minutes, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || minutes < 0 {
+		fmt.Println("ERROR: grace period must be a positive integer")
+		os.Exit(1)
+	}
+	return minutes * 60 * 1000
+}
+
+func readEnctypes(principal string) []security.Enctype {
+	fmt.Print("Enctypes supported by " + principal + ", separated by commas (OPTIONAL, if not provided all: " + security.FormatEnctypes(security.SupportedEnctypes) + "): ")
+	stdin.Scan()
+	text := strings.TrimSpace(stdin.Text())
+	if text == "" {
+		return security.SupportedEnctypes
+	}
+
+	enctypes, err := security.ParseEnctypes(text)
+	if err != nil || len(enctypes) == 0 {
+		fmt.Println("ERROR: ", err)
+		os.Exit(1)
+	}
+	return enctypes
+}
+
+func readMaxLifetime(principal string) int64 {
+	fmt.Print("Max ticket lifetime in minutes for " + principal + " (OPTIONAL, if not provided the realm maximum is used): ")
+	stdin.Scan()
+	maxLifetime, err := dto.ParseMaxLifetime(stdin.Text())
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		os.Exit(1)
+	}
+	return maxLifetime
 }
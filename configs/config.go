@@ -1,15 +1,108 @@
 package config
 
-const SymmKeyDim int = 128
-const Lifetime int64 = 30 * 60 * 1000
-const AuthenticatorFreshnessTime = 60 * 1000
+// Default configuration, every value can be changed with a configuration file (see kerberos.conf and Load)
 
-const AsDbPath string = "./data/as.db"
-const TgsDbPath string = "./data/"
-const ClientDbPath string = "./data/client.db"
-const ServiceKeyPath string = "./data/"
+var SymmKeyDim int = 128
 
-const AsPort int = 8888
-const TgsPort int = 8889
+// string-to-key of the new client keys: algorithm ("pbkdf2-sha256", "argon2id" or "scrypt") with its costs and salt
+// type, "normal" (realm and client ID, as in Kerberos) or "random" (stored with the key in the AS db).
+// The keys already stored keep their parameters until their password is changed
+var StringToKey string = "pbkdf2-sha256"
+var StringToKeyIterations int = 100000
+var SaltType string = "normal"
 
-var TgsList = []string{"tgs1", "tgs2"}
+// argon2id time cost, memory (KiB) and threads, scrypt cost N (a power of 2) and parallelism p
+var Argon2Time int = 3
+var Argon2Memory int = 64 * 1024
+var Argon2Threads int = 4
+var ScryptN int = 32768
+var ScryptP int = 1
+
+var AsDbPath string = "./data/as.db"
+var TgsDbPath string = "./data/"
+var ClientDbPath string = "./data/client.db"
+var ForwardedTicketsPath string = "./data/"
+
+// credential cache of the client, overridden by SIMPLE_KRB5CCNAME. Empty is the SQLite db ClientDbPath
+var CCacheName string = ""
+var ServiceKeyPath string = "./data/"
+var ReplayCachePath string = "./data/"
+
+// the client waits RequestTimeout ms for a reply, then it retransmits the request up to RequestRetries
+// times doubling the timeout, before moving on to the next KDC
+var RequestTimeout int64 = 3000
+var RequestRetries int = 2
+
+// a request rejected for clock skew is retried once with the time of the server, if it differs from the local
+// clock by at most MaxClockAdjustment ms (0 never retries)
+var MaxClockAdjustment int64 = 10 * 60 * 1000
+
+// ordered lists of the addresses used by the clients to reach the KDCs of the realm
+var AsAddresses = []string{"127.0.0.1"}
+var TgsAddresses = map[string][]string{"tgs1": {"127.0.0.2"}, "tgs2": {"127.0.0.3"}}
+
+var Realm string = "SIMPLE.KERBEROS"
+var MaxReferrals int = 5
+
+// addresses of the TGSs of the trusted realms, by qualified TGS ID (tgsId@REALM, as in the referral tickets)
+var RealmTgs = map[string][]string{}
+
+// Settings are the values that the KDC can change on SIGHUP while its servers are running. The settings in use
+// are read with Current and never modified, a reload publishes new settings as a whole
+type Settings struct {
+	Lifetime                   int64
+	MaxLifetime                int64
+	MaxRenewableLifetime       int64
+	AuthenticatorFreshnessTime int64
+
+	// max time (ms) between a request and the start time of the postdated ticket it asks
+	MaxPostdate int64
+
+	// max difference allowed between the clocks of clients and servers, in both directions
+	MaxClockSkew int64
+
+	// enctypes allowed for the messages sent and accepted, the strongest one shared with the peer is used
+	PermittedEnctypes []string
+
+	// max size of a UDP datagram, bigger requests and replies go over TCP
+	MaxMessageSize    int
+	MaxTCPMessageSize int
+
+	// TCP connections are closed by the servers when no request arrives for TCPIdleTimeout ms, every server keeps
+	// at most MaxTCPConnections open
+	TCPIdleTimeout    int64
+	MaxTCPConnections int
+
+	// requests handled concurrently by every server (AS, each TGS, services) for each transport
+	ServerWorkers      int
+	PersistReplayCache bool
+
+	AsPort  int
+	TgsPort int
+
+	// TGSs started by the KDC, with the addresses where the KDC servers listen
+	TgsList            []string
+	AsListenAddress    string
+	TgsListenAddresses map[string]string
+}
+
+var defaultSettings = Settings{
+	Lifetime:                   30 * 60 * 1000,
+	MaxLifetime:                24 * 60 * 60 * 1000,
+	MaxRenewableLifetime:       24 * 60 * 60 * 1000,
+	AuthenticatorFreshnessTime: 60 * 1000,
+	MaxPostdate:                7 * 24 * 60 * 60 * 1000,
+	MaxClockSkew:               5 * 60 * 1000,
+	PermittedEnctypes:          []string{"aes-gcm", "aes-cbc-hmac-sha256"},
+	MaxMessageSize:             4096,
+	MaxTCPMessageSize:          1024 * 1024,
+	TCPIdleTimeout:             30 * 1000,
+	MaxTCPConnections:          64,
+	ServerWorkers:              8,
+	PersistReplayCache:         true,
+	AsPort:                     8888,
+	TgsPort:                    8889,
+	TgsList:                    []string{"tgs1", "tgs2"},
+	AsListenAddress:            "127.0.0.1",
+	TgsListenAddresses:         map[string]string{"tgs1": "127.0.0.2", "tgs2": "127.0.0.3"},
+}
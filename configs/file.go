@@ -0,0 +1,597 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The configuration file has the same syntax of krb5.conf: sections in square brackets with "key = value" lines,
+// realms in the [realms] section are stanzas in braces, lines starting with # or ; are comments.
+// See kerberos.conf for all the options
+
+// Path is the configuration file loaded, empty if the defaults are used
+var Path string
+
+// active are the settings in use, published as a whole by Load and Reload
+var active atomic.Pointer[Settings]
+
+// defaults is the configuration compiled in config.go, the base of every reload
+var defaults = current()
+
+type entry struct {
+	section string
+	realm   string
+	key     string
+	value   string
+	line    int
+}
+
+// LoadFromArgs loads the configuration file given with --config path (or --config=path) in args, if any,
+// and returns the other args
+func LoadFromArgs(args []string) ([]string, error) {
+	var rest []string
+	path := ""
+	for i := 0; i < len(args); i++ {
+		if value, found := strings.CutPrefix(args[i], "--config="); found {
+			path = value
+		} else if args[i] == "--config" {
+			if i+1 >= len(args) {
+				return nil, errors.New("config: --config needs the path of the configuration file")
+			}
+			path = args[i+1]
+			i++
+		} else {
+			rest = append(rest, args[i])
+		}
+	}
+
+	if path == "" {
+		return rest, nil
+	}
+	return rest, Load(path)
+}
+
+// Load reads the configuration file at path, replacing the defaults with the values found, and validates the result
+func Load(path string) error {
+	s, err := read(path, current())
+	if err != nil {
+		return err
+	}
+	s.path = path
+	s.restore()
+	return nil
+}
+
+// Reload reads again the configuration file: the values missing from the file go back to the defaults.
+// The new configuration is built and validated apart and only its Settings are published, at once, so the running
+// servers see either the old or the new ones. The realm, the key size and the db paths are used by the running
+// servers, so they can't be changed by a reload; the other values are used only by clients and commands at start.
+// If the file is not valid the current configuration is kept and the error is returned
+func Reload() error {
+	if Path == "" {
+		return errors.New("config: no configuration file to reload, the KDC must be started with --config")
+	}
+
+	previous := current()
+	s, err := read(Path, defaults)
+	if err != nil {
+		return err
+	}
+	if s.realm != previous.realm || s.asDbPath != previous.asDbPath || s.tgsDbPath != previous.tgsDbPath ||
+		s.serviceKeyPath != previous.serviceKeyPath || s.replayCachePath != previous.replayCachePath || s.symmKeyDim != previous.symmKeyDim {
+		return fmt.Errorf("config: %s: default_realm, symmetric_key_bits and the db paths can't be changed without restarting", Path)
+	}
+
+	active.Store(s.Settings.clone())
+	return nil
+}
+
+// Current returns the settings in use, which must not be modified
+func Current() *Settings {
+	if s := active.Load(); s != nil {
+		return s
+	}
+	return &defaultSettings
+}
+
+// Update publishes a copy of the settings in use changed by edit, for commands and tests setting values by hand
+func Update(edit func(s *Settings)) {
+	s := Current().clone()
+	edit(s)
+	active.Store(s)
+}
+
+// read returns base with the values of the configuration file at path, validated
+func read(path string, base settings) (settings, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return settings{}, fmt.Errorf("config: can't open configuration file: %w", err)
+	}
+	defer file.Close()
+
+	entries, err := parse(file, path)
+	if err != nil {
+		return settings{}, err
+	}
+
+	s := base.clone()
+	err = s.apply(entries, path)
+	if err != nil {
+		return settings{}, err
+	}
+
+	err = s.validate()
+	if err != nil {
+		return settings{}, fmt.Errorf("config: invalid configuration in %s:\n%w", path, err)
+	}
+	return s, nil
+}
+
+func parse(file *os.File, path string) ([]entry, error) {
+	var entries []entry
+	section := ""
+	realm := ""
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if realm != "" {
+				return nil, fmt.Errorf("config: %s:%d: missing } for realm %s", path, n, realm)
+			}
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("config: %s:%d: malformed section header %q", path, n, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		if line == "}" {
+			if realm == "" {
+				return nil, fmt.Errorf("config: %s:%d: unexpected }", path, n)
+			}
+			realm = ""
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("config: %s:%d: expected key = value, got %q", path, n, line)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if section == "" {
+			return nil, fmt.Errorf("config: %s:%d: %s is outside of any section", path, n, key)
+		}
+
+		if value == "{" {
+			if section != "realms" || realm != "" {
+				return nil, fmt.Errorf("config: %s:%d: stanzas are allowed only for realms in [realms]", path, n)
+			}
+			realm = key
+			continue
+		}
+
+		entries = append(entries, entry{section: section, realm: realm, key: key, value: value, line: n})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("config: can't read %s: %w", path, err)
+	}
+	if realm != "" {
+		return nil, fmt.Errorf("config: %s: missing } for realm %s", path, realm)
+	}
+	return entries, nil
+}
+
+func (s *settings) apply(entries []entry, path string) error {
+
+	//REALMS ARE APPLIED AFTER default_realm IS KNOWN
+	var realmEntries []entry
+	var kdcTgsSeen, asSeen bool
+	tgsSeen := map[string]bool{}
+
+	for _, e := range entries {
+		var err error
+		switch e.section {
+		case "libdefaults":
+			err = s.applyLibDefaults(e)
+		case "kdc":
+			if e.key == "tgs" && !kdcTgsSeen {
+				s.TgsList = nil
+				s.TgsListenAddresses = map[string]string{}
+				kdcTgsSeen = true
+			}
+			err = s.applyKdc(e)
+		case "dbdefaults":
+			err = s.applyDbDefaults(e)
+		case "realms":
+			realmEntries = append(realmEntries, e)
+		default:
+			err = fmt.Errorf("unknown section [%s]", e.section)
+		}
+		if err != nil {
+			return fmt.Errorf("config: %s:%d: %w", path, e.line, err)
+		}
+	}
+
+	for _, e := range realmEntries {
+		local := e.realm == s.realm
+		switch {
+		case e.key == "as" && local:
+			if !asSeen {
+				s.asAddresses = nil
+				asSeen = true
+			}
+			s.asAddresses = append(s.asAddresses, e.value)
+		case e.key == "tgs":
+			tgsId, address, found := strings.Cut(e.value, " ")
+			if !found {
+				return fmt.Errorf("config: %s:%d: tgs must be \"tgsId address\"", path, e.line)
+			}
+			address = strings.TrimSpace(address)
+			if local {
+				if !tgsSeen[tgsId] {
+					s.tgsAddresses[tgsId] = nil
+					tgsSeen[tgsId] = true
+				}
+				s.tgsAddresses[tgsId] = append(s.tgsAddresses[tgsId], address)
+			} else {
+				qualifiedId := tgsId + "@" + e.realm
+				s.realmTgs[qualifiedId] = append(s.realmTgs[qualifiedId], address)
+			}
+		case e.key == "as":
+			return fmt.Errorf("config: %s:%d: as addresses are used only for the default realm %s", path, e.line, s.realm)
+		default:
+			return fmt.Errorf("config: %s:%d: unknown option %s in realm %s", path, e.line, e.key, e.realm)
+		}
+	}
+
+	return nil
+}
+
+func (s *settings) applyLibDefaults(e entry) error {
+	var err error
+	switch e.key {
+	case "default_realm":
+		s.realm = e.value
+	case "ticket_lifetime":
+		s.Lifetime, err = parseDuration(e.value)
+	case "max_life":
+		s.MaxLifetime, err = parseDuration(e.value)
+	case "max_renewable_life":
+		s.MaxRenewableLifetime, err = parseDuration(e.value)
+	case "authenticator_freshness":
+		s.AuthenticatorFreshnessTime, err = parseDuration(e.value)
+	case "max_postdate":
+		s.MaxPostdate, err = parseDuration(e.value)
+	case "clockskew":
+		s.MaxClockSkew, err = parseDuration(e.value)
+	case "permitted_enctypes":
+		s.PermittedEnctypes = strings.FieldsFunc(e.value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	case "string_to_key":
+		s.stringToKey = e.value
+	case "argon2_time":
+		s.argon2Time, err = strconv.Atoi(e.value)
+	case "argon2_memory":
+		s.argon2Memory, err = strconv.Atoi(e.value)
+	case "argon2_threads":
+		s.argon2Threads, err = strconv.Atoi(e.value)
+	case "scrypt_n":
+		s.scryptN, err = strconv.Atoi(e.value)
+	case "scrypt_p":
+		s.scryptP, err = strconv.Atoi(e.value)
+	case "pbkdf2_iterations":
+		s.pbkdf2Iterations, err = strconv.Atoi(e.value)
+	case "salt_type":
+		s.saltType = e.value
+	case "symmetric_key_bits":
+		s.symmKeyDim, err = strconv.Atoi(e.value)
+	case "default_ccache_name":
+		s.ccacheName = e.value
+	case "max_referrals":
+		s.maxReferrals, err = strconv.Atoi(e.value)
+	case "request_timeout":
+		s.requestTimeout, err = parseDuration(e.value)
+	case "request_retries":
+		s.requestRetries, err = strconv.Atoi(e.value)
+	case "max_clock_adjustment":
+		s.maxClockAdjustment, err = parseDuration(e.value)
+	case "as_port":
+		s.AsPort, err = strconv.Atoi(e.value)
+	case "tgs_port":
+		s.TgsPort, err = strconv.Atoi(e.value)
+	case "udp_max_message_size":
+		s.MaxMessageSize, err = strconv.Atoi(e.value)
+	case "tcp_max_message_size":
+		s.MaxTCPMessageSize, err = strconv.Atoi(e.value)
+	case "tcp_idle_timeout":
+		s.TCPIdleTimeout, err = parseDuration(e.value)
+	case "tcp_max_connections":
+		s.MaxTCPConnections, err = strconv.Atoi(e.value)
+	default:
+		return fmt.Errorf("unknown option %s in [libdefaults]", e.key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s", e.value, e.key)
+	}
+	return nil
+}
+
+func (s *settings) applyKdc(e entry) error {
+	var err error
+	switch e.key {
+	case "as_listen":
+		s.AsListenAddress = e.value
+	case "tgs":
+		tgsId, address, found := strings.Cut(e.value, " ")
+		if !found {
+			return errors.New("tgs must be \"tgsId listen_address\"")
+		}
+		if _, exists := s.TgsListenAddresses[tgsId]; exists {
+			return fmt.Errorf("tgs %s listed twice", tgsId)
+		}
+		s.TgsList = append(s.TgsList, tgsId)
+		s.TgsListenAddresses[tgsId] = strings.TrimSpace(address)
+	case "workers":
+		s.ServerWorkers, err = strconv.Atoi(e.value)
+	case "persist_replay_cache":
+		s.PersistReplayCache, err = strconv.ParseBool(e.value)
+	default:
+		return fmt.Errorf("unknown option %s in [kdc]", e.key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s", e.value, e.key)
+	}
+	return nil
+}
+
+func (s *settings) applyDbDefaults(e entry) error {
+	switch e.key {
+	case "as_db":
+		s.asDbPath = e.value
+	case "tgs_db_dir":
+		s.tgsDbPath = dirPath(e.value)
+	case "client_db":
+		s.clientDbPath = e.value
+	case "forwarded_dir":
+		s.forwardedPath = dirPath(e.value)
+	case "service_key_dir":
+		s.serviceKeyPath = dirPath(e.value)
+	case "replay_cache_dir":
+		s.replayCachePath = dirPath(e.value)
+	default:
+		return fmt.Errorf("unknown option %s in [dbdefaults]", e.key)
+	}
+	return nil
+}
+
+// knownEnctypes and knownStringToKeys are the names of the enctypes and of the string-to-key algorithms
+// implemented, registered by the security package (which imports this one)
+var knownEnctypes, knownStringToKeys []string
+
+// RegisterEnctype adds name to the enctypes accepted in permitted_enctypes
+func RegisterEnctype(name string) {
+	knownEnctypes = append(knownEnctypes, name)
+}
+
+// RegisterStringToKey adds name to the algorithms accepted in string_to_key
+func RegisterStringToKey(name string) {
+	knownStringToKeys = append(knownStringToKeys, name)
+}
+
+// settings is a copy of the whole configuration
+type settings struct {
+	Settings
+	path                                                      string
+	symmKeyDim, requestRetries, maxReferrals                  int
+	pbkdf2Iterations, argon2Time, argon2Memory, argon2Threads int
+	scryptN, scryptP                                          int
+	requestTimeout, maxClockAdjustment                        int64
+	asDbPath, tgsDbPath, clientDbPath, forwardedPath          string
+	serviceKeyPath, replayCachePath, realm                    string
+	saltType, stringToKey, ccacheName                         string
+	asAddresses                                               []string
+	tgsAddresses, realmTgs                                    map[string][]string
+}
+
+func current() settings {
+	s := settings{
+		Settings:           *Current(),
+		path:               Path,
+		symmKeyDim:         SymmKeyDim,
+		requestRetries:     RequestRetries,
+		maxReferrals:       MaxReferrals,
+		pbkdf2Iterations:   StringToKeyIterations,
+		argon2Time:         Argon2Time,
+		argon2Memory:       Argon2Memory,
+		argon2Threads:      Argon2Threads,
+		scryptN:            ScryptN,
+		scryptP:            ScryptP,
+		requestTimeout:     RequestTimeout,
+		maxClockAdjustment: MaxClockAdjustment,
+		asDbPath:           AsDbPath,
+		tgsDbPath:          TgsDbPath,
+		clientDbPath:       ClientDbPath,
+		forwardedPath:      ForwardedTicketsPath,
+		serviceKeyPath:     ServiceKeyPath,
+		replayCachePath:    ReplayCachePath,
+		realm:              Realm,
+		saltType:           SaltType,
+		stringToKey:        StringToKey,
+		ccacheName:         CCacheName,
+		asAddresses:        AsAddresses,
+		tgsAddresses:       TgsAddresses,
+		realmTgs:           RealmTgs,
+	}
+	return s.clone()
+}
+
+// clone returns a copy of s, with its own maps and lists
+func (s settings) clone() settings {
+	s.Settings = *s.Settings.clone()
+	s.asAddresses = slices.Clone(s.asAddresses)
+	s.tgsAddresses = cloneAddresses(s.tgsAddresses)
+	s.realmTgs = cloneAddresses(s.realmTgs)
+	return s
+}
+
+func (s *Settings) clone() *Settings {
+	c := *s
+	c.PermittedEnctypes = slices.Clone(s.PermittedEnctypes)
+	c.TgsList = slices.Clone(s.TgsList)
+	c.TgsListenAddresses = maps.Clone(s.TgsListenAddresses)
+	return &c
+}
+
+// restore sets the configuration to s and publishes its Settings. It changes the package variables, so it is used
+// only while loading the configuration at start, before any server runs
+func (s settings) restore() {
+	s = s.clone()
+	Path = s.path
+	SymmKeyDim = s.symmKeyDim
+	RequestRetries = s.requestRetries
+	MaxReferrals = s.maxReferrals
+	StringToKeyIterations = s.pbkdf2Iterations
+	Argon2Time = s.argon2Time
+	Argon2Memory = s.argon2Memory
+	Argon2Threads = s.argon2Threads
+	ScryptN = s.scryptN
+	ScryptP = s.scryptP
+	RequestTimeout = s.requestTimeout
+	MaxClockAdjustment = s.maxClockAdjustment
+	AsDbPath = s.asDbPath
+	TgsDbPath = s.tgsDbPath
+	ClientDbPath = s.clientDbPath
+	ForwardedTicketsPath = s.forwardedPath
+	ServiceKeyPath = s.serviceKeyPath
+	ReplayCachePath = s.replayCachePath
+	Realm = s.realm
+	SaltType = s.saltType
+	StringToKey = s.stringToKey
+	CCacheName = s.ccacheName
+	AsAddresses = s.asAddresses
+	TgsAddresses = s.tgsAddresses
+	RealmTgs = s.realmTgs
+	active.Store(&s.Settings)
+}
+
+func cloneAddresses(addresses map[string][]string) map[string][]string {
+	clone := make(map[string][]string, len(addresses))
+	for id, ips := range addresses {
+		clone[id] = slices.Clone(ips)
+	}
+	return clone
+}
+
+// validate checks the configuration s, returning all the problems found
+func (s *settings) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(s.realm != "" && !strings.ContainsAny(s.realm, "@ \t"), "default_realm %q must be a non-empty name without @ or spaces", s.realm)
+
+	check(s.Lifetime > 0, "ticket_lifetime must be positive")
+	check(s.MaxLifetime > 0, "max_life must be positive")
+	check(s.Lifetime <= s.MaxLifetime, "ticket_lifetime can't be longer than max_life")
+	check(s.MaxRenewableLifetime > 0, "max_renewable_life must be positive")
+	check(s.AuthenticatorFreshnessTime > 0, "authenticator_freshness must be positive")
+	check(s.MaxPostdate > 0, "max_postdate must be positive")
+	check(s.MaxClockSkew >= 0, "clockskew can't be negative")
+	check(len(s.PermittedEnctypes) > 0, "permitted_enctypes can't be empty")
+	for _, enctype := range s.PermittedEnctypes {
+		check(slices.Contains(knownEnctypes, enctype), "unknown enctype %q in permitted_enctypes, known enctypes: %s", enctype, strings.Join(knownEnctypes, " "))
+	}
+	check(slices.Contains(knownStringToKeys, s.stringToKey), "unknown string_to_key %q, known algorithms: %s", s.stringToKey, strings.Join(knownStringToKeys, " "))
+	check(s.argon2Time > 0, "argon2_time must be positive")
+	check(s.argon2Threads > 0 && s.argon2Threads < 256, "argon2_threads must be between 1 and 255")
+	check(s.argon2Memory >= 8*s.argon2Threads, "argon2_memory must be at least 8 KiB for every thread")
+	check(s.scryptN > 1 && s.scryptN&(s.scryptN-1) == 0, "scrypt_n must be a power of 2 greater than 1, not %d", s.scryptN)
+	check(s.scryptP > 0, "scrypt_p must be positive")
+	check(s.pbkdf2Iterations >= 1000, "pbkdf2_iterations must be at least 1000, not %d", s.pbkdf2Iterations)
+	check(s.saltType == "normal" || s.saltType == "random", "salt_type must be normal or random, not %q", s.saltType)
+	check(s.symmKeyDim == 128 || s.symmKeyDim == 192 || s.symmKeyDim == 256, "symmetric_key_bits must be 128, 192 or 256, not %d", s.symmKeyDim)
+	check(s.maxReferrals >= 0, "max_referrals can't be negative")
+	check(s.requestTimeout > 0, "request_timeout must be positive")
+	check(s.TCPIdleTimeout > 0, "tcp_idle_timeout must be positive")
+	check(s.MaxTCPConnections > 0, "tcp_max_connections must be positive")
+	check(s.requestRetries >= 0, "request_retries can't be negative")
+	check(s.maxClockAdjustment >= 0, "max_clock_adjustment can't be negative")
+	check(s.AsPort > 0 && s.AsPort < 65536, "as_port %d is not a valid port", s.AsPort)
+	check(s.TgsPort > 0 && s.TgsPort < 65536, "tgs_port %d is not a valid port", s.TgsPort)
+	check(s.MaxMessageSize >= 512 && s.MaxMessageSize <= 65507, "udp_max_message_size must be between 512 and 65507")
+	check(s.MaxTCPMessageSize >= s.MaxMessageSize, "tcp_max_message_size can't be smaller than udp_max_message_size")
+	check(s.ServerWorkers > 0, "workers must be positive")
+
+	check(validIp(s.AsListenAddress), "as_listen %q is not a valid ip address", s.AsListenAddress)
+	check(len(s.TgsList) > 0, "at least one tgs must be listed in [kdc]")
+	for _, tgsId := range s.TgsList {
+		check(tgsId != "" && !strings.Contains(tgsId, "@"), "tgs ID %q must be a non-empty name without @", tgsId)
+		check(validIp(s.TgsListenAddresses[tgsId]), "listen address %q of tgs %s is not a valid ip address", s.TgsListenAddresses[tgsId], tgsId)
+	}
+
+	for _, address := range s.asAddresses {
+		check(validIp(address), "as address %q of realm %s is not a valid ip address", address, s.realm)
+	}
+	for tgsId, addresses := range s.tgsAddresses {
+		for _, address := range addresses {
+			check(validIp(address), "address %q of tgs %s is not a valid ip address", address, tgsId)
+		}
+	}
+	for tgsId, addresses := range s.realmTgs {
+		for _, address := range addresses {
+			check(validIp(address), "address %q of tgs %s is not a valid ip address", address, tgsId)
+		}
+	}
+
+	if ccType, _, found := strings.Cut(s.ccacheName, ":"); found {
+		check(ccType == "FILE" || ccType == "SQLITE", "default_ccache_name %q must be FILE:path, SQLITE:path or a path", s.ccacheName)
+	}
+
+	for name, path := range map[string]string{"as_db": s.asDbPath, "tgs_db_dir": s.tgsDbPath, "client_db": s.clientDbPath,
+		"forwarded_dir": s.forwardedPath, "service_key_dir": s.serviceKeyPath, "replay_cache_dir": s.replayCachePath} {
+		check(path != "" && path != "/", "%s must be a path", name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// parseDuration returns in milliseconds a duration written as a go duration (10h, 30m, 1m30s) or in seconds
+func parseDuration(value string) (int64, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return seconds * 1000, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	return d.Milliseconds(), nil
+}
+
+func dirPath(value string) string {
+	if value != "" && !strings.HasSuffix(value, "/") {
+		return value + "/"
+	}
+	return value
+}
+
+func validIp(address string) bool {
+	return net.ParseIP(address) != nil
+}
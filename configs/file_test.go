@@ -0,0 +1,184 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// the names are registered by the security package, which is not imported by these tests
+func init() {
+	for _, enctype := range []string{"aes-gcm", "aes-cbc-hmac-sha256"} {
+		RegisterEnctype(enctype)
+	}
+	for _, algorithm := range []string{"pbkdf2-sha256", "argon2id", "scrypt"} {
+		RegisterStringToKey(algorithm)
+	}
+}
+
+// writeConfig writes a configuration file with content in the temporary directory of the test
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kerberos.conf")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testConfig = `
+# comment
+[libdefaults]
+	default_realm = TEST.REALM
+	ticket_lifetime = 30m
+	max_life = 3600
+	permitted_enctypes = aes-gcm
+	string_to_key = scrypt
+	symmetric_key_bits = 128
+
+[kdc]
+	as_listen = 10.0.0.1
+	tgs = tgsA 10.0.0.2
+	workers = 2
+
+[dbdefaults]
+	as_db = ./test/as.db
+	tgs_db_dir = ./test
+
+[realms]
+	TEST.REALM = {
+		as = 10.0.0.1
+		tgs = tgsA 10.0.0.2
+		tgs = tgsA 10.0.0.3
+	}
+	OTHER.REALM = {
+		tgs = tgsB 10.1.0.2
+	}
+`
+
+func TestReadConfig(t *testing.T) {
+	s, err := read(writeConfig(t, testConfig), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.realm != "TEST.REALM" || s.symmKeyDim != 128 || s.stringToKey != "scrypt" {
+		t.Errorf("got realm %s, key bits %d, string-to-key %s", s.realm, s.symmKeyDim, s.stringToKey)
+	}
+	if s.Lifetime != 30*60*1000 || s.MaxLifetime != 3600*1000 {
+		t.Errorf("got ticket_lifetime %d and max_life %d ms, want 30m and 3600s", s.Lifetime, s.MaxLifetime)
+	}
+	if !slices.Equal(s.PermittedEnctypes, []string{"aes-gcm"}) || s.ServerWorkers != 2 {
+		t.Errorf("got permitted_enctypes %v and workers %d", s.PermittedEnctypes, s.ServerWorkers)
+	}
+	if s.asDbPath != "./test/as.db" || s.tgsDbPath != "./test/" {
+		t.Errorf("got as_db %s and tgs_db_dir %s", s.asDbPath, s.tgsDbPath)
+	}
+
+	//THE TGSS OF [kdc] REPLACE THE DEFAULT ONES, THE ADDRESSES OF A TGS OF THE DEFAULT REALM REPLACE ITS DEFAULT ONES
+	if !slices.Equal(s.TgsList, []string{"tgsA"}) || s.TgsListenAddresses["tgsA"] != "10.0.0.2" || s.AsListenAddress != "10.0.0.1" {
+		t.Errorf("got tgs %v listening on %v, as on %s", s.TgsList, s.TgsListenAddresses, s.AsListenAddress)
+	}
+	if !slices.Equal(s.asAddresses, []string{"10.0.0.1"}) || !slices.Equal(s.tgsAddresses["tgsA"], []string{"10.0.0.2", "10.0.0.3"}) {
+		t.Errorf("got as addresses %v and tgs addresses %v", s.asAddresses, s.tgsAddresses)
+	}
+	if len(s.realmTgs) != 1 || !slices.Equal(s.realmTgs["tgsB@OTHER.REALM"], []string{"10.1.0.2"}) {
+		t.Errorf("got tgs of the other realms %v", s.realmTgs)
+	}
+
+	//THE VALUES MISSING FROM THE FILE ARE THE ONES OF THE BASE
+	if s.MaxRenewableLifetime != defaults.MaxRenewableLifetime || s.clientDbPath != defaults.clientDbPath {
+		t.Errorf("got max_renewable_life %d and client_db %s, want the defaults", s.MaxRenewableLifetime, s.clientDbPath)
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"missing }", "[realms]\n\tTEST.REALM = {\n\t\ttgs = tgs1 10.0.0.2\n", "missing } for realm TEST.REALM"},
+		{"unexpected }", "[realms]\n}\n", ":2: unexpected }"},
+		{"unknown section", "[appdefaults]\n\tforwardable = true\n", ":2: unknown section [appdefaults]"},
+		{"outside of any section", "default_realm = TEST.REALM\n", ":1: default_realm is outside of any section"},
+		{"malformed line", "[libdefaults]\n\tdefault_realm TEST.REALM\n", ":2: expected key = value"},
+		{"unknown option", "[libdefaults]\n\tticket_life = 1h\n", ":2: unknown option ticket_life in [libdefaults]"},
+		{"invalid duration", "[libdefaults]\n\tmax_life = one day\n", `invalid value "one day" for max_life`},
+		{"tgs listed twice", "[kdc]\n\ttgs = tgs1 10.0.0.2\n\ttgs = tgs1 10.0.0.3\n", ":3: tgs tgs1 listed twice"},
+		{"as of another realm", "[realms]\n\tOTHER.REALM = {\n\t\tas = 10.0.0.1\n\t}\n", "as addresses are used only for the default realm"},
+		{"lifetime over max_life", "[libdefaults]\n\tticket_lifetime = 2h\n\tmax_life = 1h\n", "ticket_lifetime can't be longer than max_life"},
+		{"key size", "[libdefaults]\n\tsymmetric_key_bits = 100\n", "symmetric_key_bits must be 128, 192 or 256, not 100"},
+		{"unknown enctype", "[libdefaults]\n\tpermitted_enctypes = aes-gcm des\n", `unknown enctype "des"`},
+		{"unknown string-to-key", "[libdefaults]\n\tstring_to_key = md5\n", `unknown string_to_key "md5"`},
+		{"invalid ip", "[kdc]\n\tas_listen = localhost\n", `as_listen "localhost" is not a valid ip address`},
+		{"invalid realm address", "[realms]\n\tSIMPLE.KERBEROS = {\n\t\ttgs = tgs1 10.0.0\n\t}\n", `address "10.0.0" of tgs tgs1`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := read(writeConfig(t, test.content), defaults)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want an error with %q", err, test.want)
+			}
+		})
+	}
+
+	//ALL THE PROBLEMS ARE REPORTED AT ONCE
+	_, err := read(writeConfig(t, "[libdefaults]\n\tsymmetric_key_bits = 100\n\tscrypt_n = 1000\n"), defaults)
+	if err == nil || !strings.Contains(err.Error(), "symmetric_key_bits") || !strings.Contains(err.Error(), "scrypt_n") {
+		t.Errorf("got %v, want both the key size and scrypt_n reported", err)
+	}
+}
+
+func TestReloadRestartOnlyChanges(t *testing.T) {
+	prev := current()
+	t.Cleanup(func() { prev.restore() })
+
+	const base = "[libdefaults]\n\tdefault_realm = TEST.REALM\n\tticket_lifetime = 10m\n\tsymmetric_key_bits = 256\n" +
+		"[dbdefaults]\n\tas_db = ./test/as.db\n\ttgs_db_dir = ./test/\n"
+	path := writeConfig(t, base)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"realm", strings.Replace(base, "TEST.REALM", "OTHER.REALM", 1)},
+		{"key size", strings.Replace(base, "256", "128", 1)},
+		{"as db", strings.Replace(base, "./test/as.db", "./other/as.db", 1)},
+		{"tgs db", strings.Replace(base, "tgs_db_dir = ./test/", "tgs_db_dir = ./other/", 1)},
+		{"service keys", base + "\tservice_key_dir = ./other/\n"},
+		{"replay cache", base + "\treplay_cache_dir = ./other/\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := os.WriteFile(path, []byte(strings.Replace(test.content, "10m", "20m", 1)), 0600); err != nil {
+				t.Fatal(err)
+			}
+			err := Reload()
+			if err == nil || !strings.Contains(err.Error(), "can't be changed without restarting") {
+				t.Fatalf("got %v, want the change rejected", err)
+			}
+
+			//NOTHING OF THE REJECTED FILE IS USED
+			if Current().Lifetime != 10*60*1000 || Realm != "TEST.REALM" || SymmKeyDim != 256 || AsDbPath != "./test/as.db" {
+				t.Errorf("got lifetime %d, realm %s, key bits %d and as_db %s after a rejected reload", Current().Lifetime, Realm, SymmKeyDim, AsDbPath)
+			}
+		})
+	}
+
+	//THE OTHER VALUES ARE CHANGED BY A RELOAD
+	if err := os.WriteFile(path, []byte(strings.Replace(base, "10m", "20m", 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if Current().Lifetime != 20*60*1000 {
+		t.Errorf("got lifetime %d after the reload, want 20m", Current().Lifetime)
+	}
+}
@@ -2,9 +2,14 @@ module simple_kerberos
 
 go 1.24.5
 
+require (
+	github.com/mutecomm/go-sqlcipher v0.0.0-20190227152316-55dbde17881f
+	golang.org/x/crypto v0.40.0
+)
+
 require (
 	github.com/mattn/go-sqlite3 v1.14.28 // indirect
-	github.com/mutecomm/go-sqlcipher v0.0.0-20190227152316-55dbde17881f // indirect
 	github.com/xeodou/go-sqlcipher v0.0.0-20200727080346-d681773ef093 // indirect
-	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e // indirect
+	golang.org/x/net v0.41.0 // indirect
+	golang.org/x/sys v0.34.0 // indirect
 )
@@ -3,16 +3,17 @@ package dao
 import (
 	"database/sql"
 	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/security"
 )
 
-func InsertClient(clientId string, clientKey []byte, db *sql.DB) error {
-	query := `INSERT INTO clients (clientId, key) VALUES ($1, $2)`
-	_, err := db.Exec(query, clientId, clientKey)
+func InsertClient(clientId string, clientKey []byte, params security.StringToKeyParams, requirePreAuth bool, maxLifetime int64, db *sql.DB) error {
+	query := `INSERT INTO clients (clientId, key, algorithm, salt, iterations, memory, parallelism, requirePreAuth, maxLifetime) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := db.Exec(query, clientId, clientKey, params.Algorithm, params.Salt, params.Iterations, params.Memory, params.Parallelism, requirePreAuth, maxLifetime)
 	return err
 }
 
 func GetAllClients(db *sql.DB) ([]dto.Client, error) {
-	query := "SELECT id, clientId, key FROM clients"
+	query := "SELECT id, clientId, key, algorithm, salt, iterations, memory, parallelism, requirePreAuth, maxLifetime FROM clients"
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
@@ -22,7 +23,7 @@ func GetAllClients(db *sql.DB) ([]dto.Client, error) {
 	var clients []dto.Client
 	for rows.Next() {
 		var c dto.Client
-		err := rows.Scan(&c.DbId, &c.ClientId, &c.Key)
+		err := rows.Scan(&c.DbId, &c.ClientId, &c.Key, &c.StringToKey.Algorithm, &c.StringToKey.Salt, &c.StringToKey.Iterations, &c.StringToKey.Memory, &c.StringToKey.Parallelism, &c.RequirePreAuth, &c.MaxLifetime)
 		if err != nil {
 			return nil, err
 		}
@@ -37,26 +38,51 @@ func GetAllClients(db *sql.DB) ([]dto.Client, error) {
 }
 
 func GetClientByClientId(clientId string, db *sql.DB) (dto.Client, error) {
-	query := "SELECT id, clientId, key FROM clients WHERE clientId = $1"
+	query := "SELECT id, clientId, key, algorithm, salt, iterations, memory, parallelism, requirePreAuth, maxLifetime FROM clients WHERE clientId = $1"
 	var c dto.Client
-	err := db.QueryRow(query, clientId).Scan(&c.DbId, &c.ClientId, &c.Key)
+	err := db.QueryRow(query, clientId).Scan(&c.DbId, &c.ClientId, &c.Key, &c.StringToKey.Algorithm, &c.StringToKey.Salt, &c.StringToKey.Iterations, &c.StringToKey.Memory, &c.StringToKey.Parallelism, &c.RequirePreAuth, &c.MaxLifetime)
 	return c, err
 }
 
+func UpdateClientPreAuth(clientId string, requirePreAuth bool, db *sql.DB) error {
+	query := `UPDATE clients SET requirePreAuth = $1 WHERE clientId = $2`
+	_, err := db.Exec(query, requirePreAuth, clientId)
+	return err
+}
+
+func UpdateClientKey(clientId string, clientKey []byte, params security.StringToKeyParams, db *sql.DB) error {
+	query := `UPDATE clients SET key = $1, algorithm = $2, salt = $3, iterations = $4, memory = $5, parallelism = $6 WHERE clientId = $7`
+	_, err := db.Exec(query, clientKey, params.Algorithm, params.Salt, params.Iterations, params.Memory, params.Parallelism, clientId)
+	return err
+}
+
+func UpdateClientMaxLifetime(clientId string, maxLifetime int64, db *sql.DB) error {
+	query := `UPDATE clients SET maxLifetime = $1 WHERE clientId = $2`
+	_, err := db.Exec(query, maxLifetime, clientId)
+	return err
+}
+
 func DeleteClientByClientId(clientId string, db *sql.DB) error {
 	query := "DELETE FROM clients WHERE clientId = $1"
 	_, err := db.Exec(query, clientId)
 	return err
 }
 
-func InsertTGS(tgsId string, tgsKey []byte, db *sql.DB) error {
-	query := `INSERT INTO tgservers (tgsId, key) VALUES ($1, $2)`
-	_, err := db.Exec(query, tgsId, tgsKey)
+func ClientExists(clientID string, db *sql.DB) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM clients WHERE clientId = ? LIMIT 1)`
+	err := db.QueryRow(query, clientID).Scan(&exists)
+	return exists, err
+}
+
+func InsertTGS(tgsId string, tgsKey []byte, kvno int, db *sql.DB) error {
+	query := `INSERT INTO tgservers (tgsId, key, kvno) VALUES ($1, $2, $3)`
+	_, err := db.Exec(query, tgsId, tgsKey, kvno)
 	return err
 }
 
 func GetAllTGS(db *sql.DB) ([]dto.TGS, error) {
-	query := "SELECT id, tgsId, key FROM tgservers"
+	query := "SELECT id, tgsId, key, kvno FROM tgservers"
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
@@ -66,7 +92,7 @@ func GetAllTGS(db *sql.DB) ([]dto.TGS, error) {
 	var tgs []dto.TGS
 	for rows.Next() {
 		var t dto.TGS
-		err := rows.Scan(&t.DbId, &t.TgsId, &t.Key)
+		err := rows.Scan(&t.DbId, &t.TgsId, &t.Key, &t.Kvno)
 		if err != nil {
 			return nil, err
 		}
@@ -81,9 +107,9 @@ func GetAllTGS(db *sql.DB) ([]dto.TGS, error) {
 }
 
 func GetTGSByTgsId(tgsId string, db *sql.DB) (dto.TGS, error) {
-	query := "SELECT id, tgsId, key FROM tgservers WHERE tgsId = $1"
+	query := "SELECT id, tgsId, key, kvno FROM tgservers WHERE tgsId = $1"
 	var t dto.TGS
-	err := db.QueryRow(query, tgsId).Scan(&t.DbId, &t.TgsId, &t.Key)
+	err := db.QueryRow(query, tgsId).Scan(&t.DbId, &t.TgsId, &t.Key, &t.Kvno)
 	return t, err
 
 }
@@ -101,8 +127,9 @@ func TgsExists(tgsID string, db *sql.DB) (bool, error) {
 	return exists, err
 }
 
-func UpdateTgsKey(tgsID string, newKey []byte, db *sql.DB) error {
-	query := `UPDATE tgservers SET key = ? WHERE tgsId = ?`
-	_, err := db.Exec(query, newKey, tgsID)
+// UpdateTgsKey sets the key of tgsID and its version, the tickets for the TGS are encrypted with the new key
+func UpdateTgsKey(tgsID string, newKey []byte, kvno int, db *sql.DB) error {
+	query := `UPDATE tgservers SET key = ?, kvno = ? WHERE tgsId = ?`
+	_, err := db.Exec(query, newKey, kvno, tgsID)
 	return err
 }
@@ -5,30 +5,32 @@ import (
 	"simple_kerberos/internal/dto"
 )
 
+// tickets with an AEAD enctype have an empty mac, which the driver binds as NULL: it is stored as an empty blob
+
 // INSERT
 func InsertTGSTicket(clientId string, data dto.TicketData, db *sql.DB) error {
-	query := `INSERT INTO tgsTickets (clientId, tgsId, ticket, ticketMac, key, lifetime, issueTime) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err := db.Exec(query, clientId, data.TargetId, data.EncryptedTicket, data.EncTicketMac, data.Key, data.Lifetime, data.Timestamp)
+	query := `INSERT INTO tgsTickets (clientId, tgsId, ticket, ticketMac, key, lifetime, issueTime, renewTill, flags, enctype, kvno) VALUES ($1, $2, $3, COALESCE($4, X''), $5, $6, $7, $8, $9, $10, $11)`
+	_, err := db.Exec(query, clientId, data.TargetId, data.EncryptedTicket, data.EncTicketMac, data.Key, data.Lifetime, data.Timestamp, data.RenewTill, data.Flags, data.Enctype, data.Kvno)
 	return err
 }
 
 func InsertServiceTicket(clientId string, data dto.TicketData, db *sql.DB) error {
-	query := `INSERT INTO serviceTickets (clientId, serviceId, ticket, ticketMac, key, lifetime, issueTime) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err := db.Exec(query, clientId, data.TargetId, data.EncryptedTicket, data.EncTicketMac, data.Key, data.Lifetime, data.Timestamp)
+	query := `INSERT INTO serviceTickets (clientId, serviceId, ticket, ticketMac, key, lifetime, issueTime, renewTill, flags, enctype, kvno) VALUES ($1, $2, $3, COALESCE($4, X''), $5, $6, $7, $8, $9, $10, $11)`
+	_, err := db.Exec(query, clientId, data.TargetId, data.EncryptedTicket, data.EncTicketMac, data.Key, data.Lifetime, data.Timestamp, data.RenewTill, data.Flags, data.Enctype, data.Kvno)
 	return err
 }
 
 //UPDATE
 
 func UpdateTGSTicket(clientId string, data dto.TicketData, db *sql.DB) error {
-	query := `UPDATE tgsTickets SET ticket = $1, ticketMac = $2, lifetime = $3, issueTime = $4, key=$5 WHERE clientId = $6`
-	_, err := db.Exec(query, data.EncryptedTicket, data.EncTicketMac, data.Lifetime, data.Timestamp, data.Key, clientId)
+	query := `UPDATE tgsTickets SET ticket = $1, ticketMac = COALESCE($2, X''), lifetime = $3, issueTime = $4, key=$5, renewTill = $6, flags = $7, enctype = $8, kvno = $9 WHERE clientId = $10 AND tgsId = $11`
+	_, err := db.Exec(query, data.EncryptedTicket, data.EncTicketMac, data.Lifetime, data.Timestamp, data.Key, data.RenewTill, data.Flags, data.Enctype, data.Kvno, clientId, data.TargetId)
 	return err
 }
 
 func UpdateServiceTicket(clientId string, data dto.TicketData, db *sql.DB) error {
-	query := `UPDATE serviceTickets SET ticket = $1, ticketMac = $2, lifetime = $3, issueTime = $4, key=$5 WHERE clientId = $6`
-	_, err := db.Exec(query, data.EncryptedTicket, data.EncTicketMac, data.Lifetime, data.Timestamp, data.Key, clientId)
+	query := `UPDATE serviceTickets SET ticket = $1, ticketMac = COALESCE($2, X''), lifetime = $3, issueTime = $4, key=$5, renewTill = $6, flags = $7, enctype = $8, kvno = $9 WHERE clientId = $10 AND serviceId = $11`
+	_, err := db.Exec(query, data.EncryptedTicket, data.EncTicketMac, data.Lifetime, data.Timestamp, data.Key, data.RenewTill, data.Flags, data.Enctype, data.Kvno, clientId, data.TargetId)
 	return err
 }
 
@@ -63,14 +65,48 @@ func DeleteServiceTicket(clientId, serviceId string, db *sql.DB) error {
 // SELECT
 func GetTGSTicket(clientId, tgsId string, db *sql.DB) (dto.TicketData, error) {
 	var td dto.TicketData
-	query := `SELECT key, tgsId, issueTime, lifetime, ticket, ticketMac FROM tgsTickets WHERE clientId = $1 AND tgsId = $2`
-	err := db.QueryRow(query, clientId, tgsId).Scan(&td.Key, &td.TargetId, &td.Timestamp, &td.Lifetime, &td.EncryptedTicket, &td.EncTicketMac)
+	query := `SELECT key, tgsId, issueTime, lifetime, renewTill, flags, enctype, kvno, ticket, ticketMac FROM tgsTickets WHERE clientId = $1 AND tgsId = $2`
+	err := db.QueryRow(query, clientId, tgsId).Scan(&td.Key, &td.TargetId, &td.Timestamp, &td.Lifetime, &td.RenewTill, &td.Flags, &td.Enctype, &td.Kvno, &td.EncryptedTicket, &td.EncTicketMac)
 	return td, err
 }
 
 func GetServiceTicket(clientId, serviceId string, db *sql.DB) (dto.TicketData, error) {
 	var td dto.TicketData
-	query := `SELECT key, serviceId, issueTime, lifetime, ticket, ticketMac FROM serviceTickets WHERE clientId = $1 AND serviceId = $2`
-	err := db.QueryRow(query, clientId, serviceId).Scan(&td.Key, &td.TargetId, &td.Timestamp, &td.Lifetime, &td.EncryptedTicket, &td.EncTicketMac)
+	query := `SELECT key, serviceId, issueTime, lifetime, renewTill, flags, enctype, kvno, ticket, ticketMac FROM serviceTickets WHERE clientId = $1 AND serviceId = $2`
+	err := db.QueryRow(query, clientId, serviceId).Scan(&td.Key, &td.TargetId, &td.Timestamp, &td.Lifetime, &td.RenewTill, &td.Flags, &td.Enctype, &td.Kvno, &td.EncryptedTicket, &td.EncTicketMac)
 	return td, err
 }
+
+func GetAllTGSTickets(clientId string, db *sql.DB) ([]dto.TicketData, error) {
+	query := `SELECT key, tgsId, issueTime, lifetime, renewTill, flags, enctype, kvno, ticket, ticketMac FROM tgsTickets WHERE clientId = $1`
+	return getTickets(query, clientId, db)
+}
+
+func GetAllServiceTickets(clientId string, db *sql.DB) ([]dto.TicketData, error) {
+	query := `SELECT key, serviceId, issueTime, lifetime, renewTill, flags, enctype, kvno, ticket, ticketMac FROM serviceTickets WHERE clientId = $1`
+	return getTickets(query, clientId, db)
+}
+
+func getTickets(query string, clientId string, db *sql.DB) ([]dto.TicketData, error) {
+	rows, err := db.Query(query, clientId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tickets []dto.TicketData
+	for rows.Next() {
+		var td dto.TicketData
+		err := rows.Scan(&td.Key, &td.TargetId, &td.Timestamp, &td.Lifetime, &td.RenewTill, &td.Flags, &td.Enctype, &td.Kvno, &td.EncryptedTicket, &td.EncTicketMac)
+		if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, td)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tickets, nil
+}
@@ -5,11 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 
 	//_ "github.com/mattn/go-sqlite3"
 	_ "github.com/mutecomm/go-sqlcipher"
 )
 
+var initMu sync.Mutex
+var initialized = map[string]bool{}
+
 func InitNewEncryptedASDbIfNotExists(path string, pwd string) error {
 	_, err := os.Stat(path)
 	if errors.Is(err, os.ErrNotExist) {
@@ -34,13 +38,21 @@ func InitNewEncryptedASDb(path string, pwd string) error {
         CREATE TABLE IF NOT EXISTS clients (
             id 			INTEGER PRIMARY KEY AUTOINCREMENT,
             clientId 	TEXT NOT NULL UNIQUE,
-			key 		BLOB NOT NULL
+			key 		BLOB NOT NULL,
+			requirePreAuth	INTEGER NOT NULL DEFAULT 0,
+			maxLifetime	BIGINT NOT NULL DEFAULT 0,
+			salt		BLOB NOT NULL DEFAULT X'73616c74',
+			iterations	INTEGER NOT NULL DEFAULT 4096,
+			algorithm	TEXT NOT NULL DEFAULT 'pbkdf2-sha256',
+			memory		INTEGER NOT NULL DEFAULT 0,
+			parallelism	INTEGER NOT NULL DEFAULT 0
         );
 
 		CREATE TABLE IF NOT EXISTS tgservers (
             id 			INTEGER PRIMARY KEY AUTOINCREMENT,
             tgsId	 	TEXT NOT NULL UNIQUE,
-			key 		BLOB NOT NULL
+			key 		BLOB NOT NULL,
+			kvno		INTEGER NOT NULL DEFAULT 1
         );
     `)
 	if err != nil {
@@ -73,13 +85,18 @@ func InitNewEncryptedTGSDb(path string, pwd string) error {
 		CREATE TABLE IF NOT EXISTS services (
             id 			INTEGER PRIMARY KEY AUTOINCREMENT,
             serviceId	TEXT NOT NULL UNIQUE,
-			key 		BLOB NOT NULL
+			key 		BLOB NOT NULL,
+			maxLifetime	BIGINT NOT NULL DEFAULT 0,
+			delegationTargets	TEXT NOT NULL DEFAULT '',
+			enctypes	TEXT NOT NULL DEFAULT 'aes-cbc-hmac-sha256',
+			kvno		INTEGER NOT NULL DEFAULT 1
         );
 
 		CREATE TABLE IF NOT EXISTS config (
 			id			INTEGER PRIMARY KEY AUTOINCREMENT,
 			tgsId		TEXT NOT NULL UNIQUE,
-			asKey 		BLOB NOT NULL
+			asKey 		BLOB NOT NULL,
+			kvno		INTEGER NOT NULL DEFAULT 1
 		);
     `)
 	if err != nil {
@@ -87,6 +104,18 @@ func InitNewEncryptedTGSDb(path string, pwd string) error {
 		return err
 	}
 
+	err = createRealmsTable(db)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	err = createPreviousKeysTable(db)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
 	return nil
 }
 
@@ -120,6 +149,10 @@ func InitNewClientDb(path string) error {
 			key 		BLOB NOT NULL,
 			lifetime	BIGINT,
 			issueTime	BIGINT,
+			renewTill	BIGINT NOT NULL DEFAULT 0,
+			flags		INTEGER NOT NULL DEFAULT 0,
+			enctype		INTEGER NOT NULL DEFAULT 1,
+			kvno		INTEGER NOT NULL DEFAULT 0,
 			UNIQUE(clientId, tgsId)	
         );
 
@@ -132,6 +165,10 @@ func InitNewClientDb(path string) error {
 			key 		BLOB NOT NULL,
 			lifetime	BIGINT,
 			issueTime	BIGINT,
+			renewTill	BIGINT NOT NULL DEFAULT 0,
+			flags		INTEGER NOT NULL DEFAULT 0,
+			enctype		INTEGER NOT NULL DEFAULT 1,
+			kvno		INTEGER NOT NULL DEFAULT 0,
 			UNIQUE(clientId, serviceId)
         );
     `)
@@ -144,30 +181,182 @@ func InitNewClientDb(path string) error {
 
 func OpenEncryptedASDb(path string, pwd string) (*sql.DB, error) {
 
-	//INIT DBs IF NOT EXIST
-	err := InitNewEncryptedASDbIfNotExists(path, pwd)
+	db, err := sql.Open("sqlite3", "file:"+path+"?_pragma_key="+pwd+"&_pragma_cipher_page_size=4096")
 	if err != nil {
 		return nil, err
 	}
 
-	db, err := sql.Open("sqlite3", "file:"+path+"?_pragma_key="+pwd+"&_pragma_cipher_page_size=4096")
+	//INIT DBs IF NOT EXIST AND UPGRADE DBs CREATED BY OLDER VERSIONS
+	err = initOnce(path, func() error {
+		err := InitNewEncryptedASDbIfNotExists(path, pwd)
+		if err != nil {
+			return err
+		}
+		return migrateASDb(db)
+	})
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
 
+func migrateASDb(db *sql.DB) error {
+	err := addColumnIfNotExists("clients", "requirePreAuth", "INTEGER NOT NULL DEFAULT 0", db)
+	if err != nil {
+		return err
+	}
+	err = addColumnIfNotExists("clients", "maxLifetime", "BIGINT NOT NULL DEFAULT 0", db)
+	if err != nil {
+		return err
+	}
+
+	//KEYS STORED BEFORE PER-CLIENT SALTS WERE INTRODUCED ARE DERIVED WITH SALT "salt" AND 4096 ITERATIONS
+	err = addColumnIfNotExists("clients", "salt", "BLOB NOT NULL DEFAULT X'73616c74'", db)
+	if err != nil {
+		return err
+	}
+	err = addColumnIfNotExists("clients", "iterations", "INTEGER NOT NULL DEFAULT 4096", db)
+	if err != nil {
+		return err
+	}
+
+	//AND WITH PBKDF2, THE ONLY STRING-TO-KEY BEFORE ALGORITHMS WERE STORED
+	err = addColumnIfNotExists("clients", "algorithm", "TEXT NOT NULL DEFAULT 'pbkdf2-sha256'", db)
+	if err != nil {
+		return err
+	}
+	err = addColumnIfNotExists("clients", "memory", "INTEGER NOT NULL DEFAULT 0", db)
+	if err != nil {
+		return err
+	}
+	err = addColumnIfNotExists("clients", "parallelism", "INTEGER NOT NULL DEFAULT 0", db)
+	if err != nil {
+		return err
+	}
+
+	//TGS KEYS STORED BEFORE KEY VERSIONS WERE INTRODUCED ARE THE FIRST VERSION
+	return addColumnIfNotExists("tgservers", "kvno", "INTEGER NOT NULL DEFAULT 1", db)
+}
+
+func createRealmsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS realms (
+            id 			INTEGER PRIMARY KEY AUTOINCREMENT,
+            realm		TEXT NOT NULL UNIQUE,
+			tgsId		TEXT NOT NULL,
+			key 		BLOB NOT NULL,
+			enctypes	TEXT NOT NULL DEFAULT 'aes-cbc-hmac-sha256',
+			kvno		INTEGER NOT NULL DEFAULT 1
+        );
+    `)
+	return err
+}
+
+// previousKeys are the keys replaced by a newer version (of the TGS, of a service or of a trusted realm),
+// still valid until expires for the tickets issued before the rotation
+func createPreviousKeysTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS previousKeys (
+            id 			INTEGER PRIMARY KEY AUTOINCREMENT,
+            kind		TEXT NOT NULL,
+			principal	TEXT NOT NULL,
+			kvno		INTEGER NOT NULL,
+			key 		BLOB NOT NULL,
+			expires		BIGINT NOT NULL,
+			UNIQUE(kind, principal, kvno)
+        );
+    `)
+	return err
+}
+
+func migrateTGSDb(db *sql.DB) error {
+	err := createRealmsTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfNotExists("services", "maxLifetime", "BIGINT NOT NULL DEFAULT 0", db)
+	if err != nil {
+		return err
+	}
+	err = addColumnIfNotExists("services", "delegationTargets", "TEXT NOT NULL DEFAULT ''", db)
+	if err != nil {
+		return err
+	}
+
+	//KEYS STORED BEFORE ENCTYPES WERE INTRODUCED ARE USED ONLY WITH AES-CBC+HMAC
+	err = addColumnIfNotExists("services", "enctypes", "TEXT NOT NULL DEFAULT 'aes-cbc-hmac-sha256'", db)
+	if err != nil {
+		return err
+	}
+	err = addColumnIfNotExists("realms", "enctypes", "TEXT NOT NULL DEFAULT 'aes-cbc-hmac-sha256'", db)
+	if err != nil {
+		return err
+	}
+
+	//KEYS STORED BEFORE KEY VERSIONS WERE INTRODUCED ARE THE FIRST VERSION
+	for _, table := range []string{"services", "config", "realms"} {
+		err = addColumnIfNotExists(table, "kvno", "INTEGER NOT NULL DEFAULT 1", db)
+		if err != nil {
+			return err
+		}
+	}
+	return createPreviousKeysTable(db)
+}
+
+// initOnce runs init (creation and migration of the db at path) only the first time the db is opened by this
+// process, so that request handlers opening the same db concurrently don't race on it
+func initOnce(path string, init func() error) error {
+	initMu.Lock()
+	defer initMu.Unlock()
+
+	if initialized[path] {
+		return nil
+	}
+
+	err := init()
+	if err != nil {
+		return err
+	}
+	initialized[path] = true
+	return nil
+}
+
+// addColumnIfNotExists lets dbs created before a column was introduced keep working
+func addColumnIfNotExists(table string, column string, definition string, db *sql.DB) error {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM pragma_table_info($1) WHERE name = $2)`
+	err := db.QueryRow(query, table, column).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
 func OpenEncryptedTGSDb(path string, pwd string) (*sql.DB, error) {
 
-	//INIT DBs IF NOT EXIST
-	err := InitNewEncryptedTGSDbIfNotExists(path, pwd)
+	db, err := sql.Open("sqlite3", "file:"+path+"?_pragma_key="+pwd+"&_pragma_cipher_page_size=4096")
 	if err != nil {
 		return nil, err
 	}
 
-	db, err := sql.Open("sqlite3", "file:"+path+"?_pragma_key="+pwd+"&_pragma_cipher_page_size=4096")
+	//INIT DBs IF NOT EXIST AND UPGRADE DBs CREATED BY OLDER VERSIONS
+	err = initOnce(path, func() error {
+		err := InitNewEncryptedTGSDbIfNotExists(path, pwd)
+		if err != nil {
+			return err
+		}
+		return migrateTGSDb(db)
+	})
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -176,8 +365,89 @@ func OpenEncryptedTGSDb(path string, pwd string) (*sql.DB, error) {
 
 func OpenDb(path string) (*sql.DB, error) {
 
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	//INIT DBs IF NOT EXIST AND UPGRADE DBs CREATED BY OLDER VERSIONS
+	err = initOnce(path, func() error {
+		err := InitNewClientDbIfNotExists(path)
+		if err != nil {
+			return err
+		}
+		return migrateClientDb(db)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func migrateClientDb(db *sql.DB) error {
+	for _, table := range []string{"tgsTickets", "serviceTickets"} {
+		err := addColumnIfNotExists(table, "renewTill", "BIGINT NOT NULL DEFAULT 0", db)
+		if err != nil {
+			return err
+		}
+		err = addColumnIfNotExists(table, "flags", "INTEGER NOT NULL DEFAULT 0", db)
+		if err != nil {
+			return err
+		}
+		err = addColumnIfNotExists(table, "enctype", "INTEGER NOT NULL DEFAULT 1", db)
+		if err != nil {
+			return err
+		}
+		err = addColumnIfNotExists(table, "kvno", "INTEGER NOT NULL DEFAULT 0", db)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func InitNewReplayCacheDbIfNotExists(path string) error {
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		err := InitNewReplayCacheDb(path)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func InitNewReplayCacheDb(path string) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS replayCache (
+            id 			INTEGER PRIMARY KEY AUTOINCREMENT,
+            clientId 	TEXT NOT NULL,
+			timestamp	BIGINT NOT NULL,
+			authHash	BLOB NOT NULL,
+			UNIQUE(clientId, timestamp, authHash)
+        );
+    `)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func OpenReplayCacheDb(path string) (*sql.DB, error) {
+
 	//INIT DBs IF NOT EXIST
-	err := InitNewClientDbIfNotExists(path)
+	err := InitNewReplayCacheDbIfNotExists(path)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,43 @@
+package dao
+
+import (
+	"database/sql"
+	"simple_kerberos/internal/dto"
+)
+
+func InsertReplayEntry(entry dto.ReplayEntry, db *sql.DB) error {
+	query := `INSERT OR IGNORE INTO replayCache (clientId, timestamp, authHash) VALUES ($1, $2, $3)`
+	_, err := db.Exec(query, entry.ClientId, entry.Timestamp, entry.AuthHash)
+	return err
+}
+
+func GetAllReplayEntries(db *sql.DB) ([]dto.ReplayEntry, error) {
+	query := "SELECT clientId, timestamp, authHash FROM replayCache ORDER BY timestamp"
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []dto.ReplayEntry
+	for rows.Next() {
+		var e dto.ReplayEntry
+		err := rows.Scan(&e.ClientId, &e.Timestamp, &e.AuthHash)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func DeleteReplayEntriesOlderThan(timestamp int64, db *sql.DB) error {
+	query := `DELETE FROM replayCache WHERE timestamp < $1`
+	_, err := db.Exec(query, timestamp)
+	return err
+}
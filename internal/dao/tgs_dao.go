@@ -3,16 +3,18 @@ package dao
 import (
 	"database/sql"
 	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/security"
+	"strings"
 )
 
-func InsertService(serviceId string, serviceKey []byte, db *sql.DB) error {
-	query := `INSERT INTO services (serviceId, key) VALUES ($1, $2)`
-	_, err := db.Exec(query, serviceId, serviceKey)
+func InsertService(serviceId string, serviceKey []byte, maxLifetime int64, enctypes []security.Enctype, db *sql.DB) error {
+	query := `INSERT INTO services (serviceId, key, maxLifetime, enctypes) VALUES ($1, $2, $3, $4)`
+	_, err := db.Exec(query, serviceId, serviceKey, maxLifetime, security.FormatEnctypes(enctypes))
 	return err
 }
 
 func GetAllServices(db *sql.DB) ([]dto.Service, error) {
-	query := "SELECT id, serviceId, key FROM services"
+	query := "SELECT id, serviceId, key, kvno, maxLifetime, delegationTargets, enctypes FROM services"
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
@@ -22,7 +24,13 @@ func GetAllServices(db *sql.DB) ([]dto.Service, error) {
 	var services []dto.Service
 	for rows.Next() {
 		var s dto.Service
-		err := rows.Scan(&s.DbId, &s.ServiceId, &s.Key)
+		var targets, enctypes string
+		err := rows.Scan(&s.DbId, &s.ServiceId, &s.Key, &s.Kvno, &s.MaxLifetime, &targets, &enctypes)
+		if err != nil {
+			return nil, err
+		}
+		s.DelegationTargets = splitList(targets)
+		s.Enctypes, err = security.ParseEnctypes(enctypes)
 		if err != nil {
 			return nil, err
 		}
@@ -37,12 +45,38 @@ func GetAllServices(db *sql.DB) ([]dto.Service, error) {
 }
 
 func GetServiceByServiceId(serviceId string, db *sql.DB) (dto.Service, error) {
-	query := "SELECT id, serviceId, key FROM services WHERE serviceId = $1"
+	query := "SELECT id, serviceId, key, kvno, maxLifetime, delegationTargets, enctypes FROM services WHERE serviceId = $1"
 	var s dto.Service
-	err := db.QueryRow(query, serviceId).Scan(&s.DbId, &s.ServiceId, &s.Key)
+	var targets, enctypes string
+	err := db.QueryRow(query, serviceId).Scan(&s.DbId, &s.ServiceId, &s.Key, &s.Kvno, &s.MaxLifetime, &targets, &enctypes)
+	if err != nil {
+		return s, err
+	}
+	s.DelegationTargets = splitList(targets)
+	s.Enctypes, err = security.ParseEnctypes(enctypes)
 	return s, err
 }
 
+// UpdateServiceEnctypes sets the enctypes supported by serviceId with its key
+func UpdateServiceEnctypes(serviceId string, enctypes []security.Enctype, db *sql.DB) error {
+	query := `UPDATE services SET enctypes = $1 WHERE serviceId = $2`
+	_, err := db.Exec(query, security.FormatEnctypes(enctypes), serviceId)
+	return err
+}
+
+// UpdateServiceDelegationTargets sets the services to which serviceId can get tickets on behalf of its clients
+func UpdateServiceDelegationTargets(serviceId string, targets []string, db *sql.DB) error {
+	query := `UPDATE services SET delegationTargets = $1 WHERE serviceId = $2`
+	_, err := db.Exec(query, strings.Join(targets, ","), serviceId)
+	return err
+}
+
+func UpdateServiceMaxLifetime(serviceId string, maxLifetime int64, db *sql.DB) error {
+	query := `UPDATE services SET maxLifetime = $1 WHERE serviceId = $2`
+	_, err := db.Exec(query, maxLifetime, serviceId)
+	return err
+}
+
 func DeleteServiceByServiceId(serviceId string, db *sql.DB) error {
 	query := "DELETE FROM services WHERE serviceId = $1"
 	_, err := db.Exec(query, serviceId)
@@ -61,11 +95,12 @@ func UpdateTgsConfig(tgsId string, asKey []byte, db *sql.DB) error {
 	return err
 }
 
-func GetTgsConfig(db *sql.DB) (string, []byte, error) {
+// GetTgsConfig returns the ID of the TGS and the current version of its key, shared with the AS
+func GetTgsConfig(db *sql.DB) (string, dto.VersionedKey, error) {
 	var tgsId string
-	var asKey []byte
-	query := `SELECT tgsId, asKey FROM config LIMIT 1`
-	err := db.QueryRow(query).Scan(&tgsId, &asKey)
+	var asKey dto.VersionedKey
+	query := `SELECT tgsId, asKey, kvno FROM config LIMIT 1`
+	err := db.QueryRow(query).Scan(&tgsId, &asKey.Key, &asKey.Kvno)
 	return tgsId, asKey, err
 }
 
@@ -82,3 +117,178 @@ func ServiceExists(serviceID string, db *sql.DB) (bool, error) {
 	err := db.QueryRow(query, serviceID).Scan(&exists)
 	return exists, err
 }
+
+// lists are stored as comma separated values
+func splitList(list string) []string {
+	var values []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func InsertRealm(realm string, tgsId string, key []byte, enctypes []security.Enctype, db *sql.DB) error {
+	query := `INSERT INTO realms (realm, tgsId, key, enctypes) VALUES ($1, $2, $3, $4)`
+	_, err := db.Exec(query, realm, tgsId, key, security.FormatEnctypes(enctypes))
+	return err
+}
+
+func GetAllRealms(db *sql.DB) ([]dto.Realm, error) {
+	query := "SELECT id, realm, tgsId, key, kvno, enctypes FROM realms"
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var realms []dto.Realm
+	for rows.Next() {
+		var r dto.Realm
+		var enctypes string
+		err := rows.Scan(&r.DbId, &r.Realm, &r.TgsId, &r.Key, &r.Kvno, &enctypes)
+		if err != nil {
+			return nil, err
+		}
+		r.Enctypes, err = security.ParseEnctypes(enctypes)
+		if err != nil {
+			return nil, err
+		}
+		realms = append(realms, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return realms, nil
+}
+
+func GetRealm(realm string, db *sql.DB) (dto.Realm, error) {
+	query := "SELECT id, realm, tgsId, key, kvno, enctypes FROM realms WHERE realm = $1"
+	var r dto.Realm
+	var enctypes string
+	err := db.QueryRow(query, realm).Scan(&r.DbId, &r.Realm, &r.TgsId, &r.Key, &r.Kvno, &enctypes)
+	if err != nil {
+		return r, err
+	}
+	r.Enctypes, err = security.ParseEnctypes(enctypes)
+	return r, err
+}
+
+// UpdateRealmEnctypes sets the enctypes supported with the inter-realm key by the TGS of realm
+func UpdateRealmEnctypes(realm string, enctypes []security.Enctype, db *sql.DB) error {
+	query := `UPDATE realms SET enctypes = $1 WHERE realm = $2`
+	_, err := db.Exec(query, security.FormatEnctypes(enctypes), realm)
+	return err
+}
+
+func RealmExists(realm string, db *sql.DB) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM realms WHERE realm = ? LIMIT 1)`
+	err := db.QueryRow(query, realm).Scan(&exists)
+	return exists, err
+}
+
+func DeleteRealm(realm string, db *sql.DB) error {
+	query := "DELETE FROM realms WHERE realm = $1"
+	_, err := db.Exec(query, realm)
+	return err
+}
+
+// kinds of keys kept in previousKeys after a rotation
+const (
+	KeyKindTGS     = "tgs"
+	KeyKindService = "service"
+	KeyKindRealm   = "realm"
+)
+
+// GetKeySet returns current, the key of principal in use, followed by its previous versions
+func GetKeySet(kind string, principal string, current dto.VersionedKey, db *sql.DB) (dto.KeySet, error) {
+	query := "SELECT kvno, key, expires FROM previousKeys WHERE kind = $1 AND principal = $2 ORDER BY kvno DESC"
+	rows, err := db.Query(query, kind, principal)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := dto.KeySet{current}
+	for rows.Next() {
+		var k dto.VersionedKey
+		err := rows.Scan(&k.Kvno, &k.Key, &k.Expires)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// RotateTgsKey replaces the key of the TGS with newKey, the previous one stays valid until expires (ms).
+// It returns the version of the new key
+func RotateTgsKey(tgsId string, newKey []byte, expires int64, db *sql.DB) (int, error) {
+	return rotateKey("config", "asKey", "tgsId", KeyKindTGS, tgsId, newKey, expires, db)
+}
+
+// RotateServiceKey replaces the key of serviceId with newKey, the previous one stays valid until expires (ms).
+// It returns the version of the new key
+func RotateServiceKey(serviceId string, newKey []byte, expires int64, db *sql.DB) (int, error) {
+	return rotateKey("services", "key", "serviceId", KeyKindService, serviceId, newKey, expires, db)
+}
+
+// RotateRealmKey replaces the inter-realm key shared with realm with newKey, the previous one stays valid
+// until expires (ms). It returns the version of the new key
+func RotateRealmKey(realm string, newKey []byte, expires int64, db *sql.DB) (int, error) {
+	return rotateKey("realms", "key", "realm", KeyKindRealm, realm, newKey, expires, db)
+}
+
+func rotateKey(table string, keyColumn string, idColumn string, kind string, principal string, newKey []byte, expires int64, db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var oldKey []byte
+	var kvno int
+	query := "SELECT " + keyColumn + ", kvno FROM " + table + " WHERE " + idColumn + " = $1"
+	err = tx.QueryRow(query, principal).Scan(&oldKey, &kvno)
+	if err != nil {
+		return 0, err
+	}
+
+	//KEEP THE OLD KEY FOR THE TICKETS ALREADY ISSUED
+	query = `INSERT OR REPLACE INTO previousKeys (kind, principal, kvno, key, expires) VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.Exec(query, kind, principal, kvno, oldKey, expires)
+	if err != nil {
+		return 0, err
+	}
+
+	query = "UPDATE " + table + " SET " + keyColumn + " = $1, kvno = $2 WHERE " + idColumn + " = $3"
+	_, err = tx.Exec(query, newKey, kvno+1, principal)
+	if err != nil {
+		return 0, err
+	}
+
+	return kvno + 1, tx.Commit()
+}
+
+// DeleteExpiredKeys deletes the previous keys no longer valid at timestamp (ms)
+func DeleteExpiredKeys(timestamp int64, db *sql.DB) error {
+	query := `DELETE FROM previousKeys WHERE expires <= $1`
+	_, err := db.Exec(query, timestamp)
+	return err
+}
+
+// DeletePreviousKeys deletes the previous keys of principal, when it is removed
+func DeletePreviousKeys(kind string, principal string, db *sql.DB) error {
+	query := `DELETE FROM previousKeys WHERE kind = $1 AND principal = $2`
+	_, err := db.Exec(query, kind, principal)
+	return err
+}
@@ -0,0 +1,60 @@
+package dto
+
+import "strings"
+
+// TicketFlags is the flags bitfield of a ticket, bits are numbered as in RFC 4120 section 5.3.
+// The same bits are used in AS and TGS requests to ask for the wanted flags
+type TicketFlags uint32
+
+const (
+	FlagForwardable TicketFlags = 1 << 1
+	FlagForwarded   TicketFlags = 1 << 2
+	FlagProxiable   TicketFlags = 1 << 3
+	FlagProxy       TicketFlags = 1 << 4
+	FlagMayPostdate TicketFlags = 1 << 5
+	FlagPostdated   TicketFlags = 1 << 6
+	FlagInvalid     TicketFlags = 1 << 7
+	FlagRenewable   TicketFlags = 1 << 8
+	FlagInitial     TicketFlags = 1 << 9
+	FlagPreAuthent  TicketFlags = 1 << 10
+)
+
+var flagNames = []struct {
+	flag TicketFlags
+	name string
+}{
+	{FlagForwardable, "forwardable"},
+	{FlagForwarded, "forwarded"},
+	{FlagProxiable, "proxiable"},
+	{FlagProxy, "proxy"},
+	{FlagMayPostdate, "may-postdate"},
+	{FlagPostdated, "postdated"},
+	{FlagInvalid, "invalid"},
+	{FlagRenewable, "renewable"},
+	{FlagInitial, "initial"},
+	{FlagPreAuthent, "pre-authent"},
+}
+
+func (f TicketFlags) Has(flag TicketFlags) bool {
+	return f&flag == flag
+}
+
+func (f TicketFlags) String() string {
+	var names []string
+	for _, fn := range flagNames {
+		if f.Has(fn.flag) {
+			names = append(names, fn.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// ParseTicketFlag returns the flag with the given name (as printed by String)
+func ParseTicketFlag(name string) (TicketFlags, bool) {
+	for _, fn := range flagNames {
+		if fn.name == strings.ToLower(strings.TrimSpace(name)) {
+			return fn.flag, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,49 @@
+package dto
+
+// VersionedKey is a key with its version number (kvno). A key replaced by a newer version stays valid until
+// Expires (ms), so that the tickets already issued with it can still be read. Expires is 0 for the current key
+type VersionedKey struct {
+	Kvno    int
+	Key     []byte
+	Expires int64
+}
+
+// KeySet are the versions of the key of a principal: the current one first, then the previous ones
+type KeySet []VersionedKey
+
+// Current returns the key used for the new tickets
+func (ks KeySet) Current() VersionedKey {
+	if len(ks) == 0 {
+		return VersionedKey{}
+	}
+	return ks[0]
+}
+
+// Find returns the key with version kvno if it is still valid at now (ms). Tickets issued before keys had
+// versions name kvno 0 and are encrypted with the first version of the key
+func (ks KeySet) Find(kvno int, now int64) ([]byte, bool) {
+	for _, k := range ks {
+		if k.Kvno == kvno && (k.Expires == 0 || now < k.Expires) {
+			return k.Key, true
+		}
+	}
+	if kvno == 0 {
+		return ks.Find(1, now)
+	}
+	return nil, false
+}
+
+// VersionedKey returns the current key of the TGS
+func (t TGS) VersionedKey() VersionedKey {
+	return VersionedKey{Kvno: t.Kvno, Key: t.Key}
+}
+
+// VersionedKey returns the current inter-realm key
+func (r Realm) VersionedKey() VersionedKey {
+	return VersionedKey{Kvno: r.Kvno, Key: r.Key}
+}
+
+// VersionedKey returns the current key of the service
+func (s Service) VersionedKey() VersionedKey {
+	return VersionedKey{Kvno: s.Kvno, Key: s.Key}
+}
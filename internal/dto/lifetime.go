@@ -0,0 +1,22 @@
+package dto
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ParseMaxLifetime returns in milliseconds the max ticket lifetime of a principal written in minutes. An empty
+// text or 0 means no maximum of its own, so the realm maximum is used
+func ParseMaxLifetime(text string) (int64, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, nil
+	}
+
+	minutes, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || minutes < 0 {
+		return 0, errors.New("max lifetime must be a non-negative integer")
+	}
+	return minutes * 60 * 1000, nil
+}
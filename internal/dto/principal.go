@@ -0,0 +1,31 @@
+package dto
+
+import "strings"
+
+// Principal names can be qualified with their realm (client@REALM), names without realm belong to the local realm
+
+func QualifyPrincipal(name string, realm string) string {
+	if strings.Contains(name, "@") {
+		return name
+	}
+	return name + "@" + realm
+}
+
+// PrincipalId returns the name without the realm
+func PrincipalId(name string) string {
+	id, _, _ := strings.Cut(name, "@")
+	return id
+}
+
+// PrincipalRealm returns the realm of the name, localRealm if it's not qualified
+func PrincipalRealm(name string, localRealm string) string {
+	_, realm, found := strings.Cut(name, "@")
+	if !found {
+		return localRealm
+	}
+	return realm
+}
+
+func SamePrincipal(a string, b string, localRealm string) bool {
+	return QualifyPrincipal(a, localRealm) == QualifyPrincipal(b, localRealm)
+}
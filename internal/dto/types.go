@@ -1,39 +1,81 @@
 package dto
 
+import "simple_kerberos/internal/security"
+
+// StringToKey are the parameters used to derive Key from the password of the client
 type Client struct {
-	DbId     int
-	ClientId string
-	Key      []byte
+	DbId           int
+	ClientId       string
+	Key            []byte
+	StringToKey    security.StringToKeyParams
+	RequirePreAuth bool
+	MaxLifetime    int64
 }
 
+// Kvno is the version of Key, the tickets for the TGS are encrypted with it
 type TGS struct {
 	DbId  int
 	TgsId string
 	Key   []byte
+	Kvno  int
 }
 
+// Realm is a trusted realm: key is the inter-realm key shared with TgsId, the TGS of that realm
+// Enctypes are the enctypes supported with the key by the TGS of the other realm, Kvno is the version of the key
+type Realm struct {
+	DbId     int
+	Realm    string
+	TgsId    string
+	Key      []byte
+	Kvno     int
+	Enctypes []security.Enctype
+}
+
+// Enctypes are the enctypes supported with the key by the service, the tickets for it use the strongest one.
+// Kvno is the version of Key
 type Service struct {
-	DbId      int
-	ServiceId string
-	Key       []byte
+	DbId              int
+	ServiceId         string
+	Key               []byte
+	Kvno              int
+	MaxLifetime       int64
+	DelegationTargets []string
+	Enctypes          []security.Enctype
 }
 
+// Enctype of TicketData and Ticket is the enctype of the ticket, used with the session key too.
+// Kvno is the version of the key of the target EncryptedTicket is encrypted with
 type TicketData struct {
 	Key             []byte
+	Enctype         security.Enctype
+	Kvno            int
 	TargetId        string
 	Timestamp       int64
 	Lifetime        int64
+	RenewTill       int64
+	Flags           TicketFlags
+	IssuerRealm     string
+	Nonce           uint32
 	EncryptedTicket []byte
 	EncTicketMac    []byte
 }
 
 type Ticket struct {
 	Key           []byte
+	Enctype       security.Enctype
 	ClientId      string
 	ClientAddress string
 	TargetId      string
 	Timestamp     int64
 	Lifetime      int64
+	RenewTill     int64
+	Flags         TicketFlags
+	Transited     []string
+}
+
+type PreAuthData struct {
+	ClientId  string
+	Timestamp int64
 }
 
 type Authenticator struct {
@@ -41,3 +83,9 @@ type Authenticator struct {
 	ClientAddress string
 	Timestamp     int64
 }
+
+type ReplayEntry struct {
+	ClientId  string
+	Timestamp int64
+	AuthHash  []byte
+}
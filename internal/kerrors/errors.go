@@ -1,21 +1,64 @@
 package kerrors
 
+import (
+	"simple_kerberos/internal/messages"
+	"simple_kerberos/internal/security"
+)
+
+// Errors are classified with errors.As, or with errors.Is against an empty value of the same type
+// (errors.Is(err, &kerrors.ReplyError{})). A target with a Code matches only the errors with that code.
+// Errors caused by another error keep it in Err, so errors.Is and errors.As reach the cause too
+
+// ReplyError is an error replied by a server, or a reply that can't be accepted. Every error replied by a server
+// is also a ReplyError: errors.Is(err, &ReplyError{}) matches them and errors.As(err, &replyErr) gets their code
 type ReplyError struct {
-	Msg string
+	Msg  string
+	Code messages.ErrorCode
+	Err  error
 }
 
 func (e *ReplyError) Error() string {
-	return e.Msg
+	return withCause(e.Msg, e.Err)
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ReplyError) Is(target error) bool {
+	return isReplyError(target, e.Code)
 }
 
+// PasswordError is returned when the reply can't be read with the key of the client, or the AS refuses its
+// pre-authentication data. StringToKey are the parameters of the key of the client sent by the AS, if any.
+// Code is set only when the error is replied by the AS, then it is a ReplyError too
 type PasswordError struct {
-	Msg string
+	Msg         string
+	Code        messages.ErrorCode
+	Err         error
+	StringToKey *security.StringToKeyParams
 }
 
 func (e *PasswordError) Error() string {
-	return e.Msg
+	return withCause(e.Msg, e.Err)
+}
+
+func (e *PasswordError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PasswordError) Is(target error) bool {
+	if t, ok := target.(*PasswordError); ok {
+		return matchCode(t.Code, e.Code)
+	}
+	return e.Code != messages.ErrNone && isReplyError(target, e.Code)
+}
+
+func (e *PasswordError) As(target any) bool {
+	return e.Code != messages.ErrNone && asReplyError(target, e.Msg, e.Code)
 }
 
+// TokenError is returned when the local ticket needed is missing or can't be used
 type TokenError struct {
 	Msg string
 }
@@ -23,3 +66,251 @@ type TokenError struct {
 func (e *TokenError) Error() string {
 	return e.Msg
 }
+
+func (e *TokenError) Is(target error) bool {
+	_, ok := target.(*TokenError)
+	return ok
+}
+
+// PreAuthError is replied by the AS when the client must pre-authenticate. StringToKey are the parameters of the
+// key of the client sent by the AS, if any
+type PreAuthError struct {
+	Msg         string
+	Code        messages.ErrorCode
+	StringToKey *security.StringToKeyParams
+}
+
+func (e *PreAuthError) Error() string {
+	return e.Msg
+}
+
+func (e *PreAuthError) Is(target error) bool {
+	if t, ok := target.(*PreAuthError); ok {
+		return matchCode(t.Code, e.Code)
+	}
+	return isReplyError(target, e.Code)
+}
+
+func (e *PreAuthError) As(target any) bool {
+	return asReplyError(target, e.Msg, e.Code)
+}
+
+// TimeoutError is returned when a server doesn't answer, not even after the retransmissions
+type TimeoutError struct {
+	Msg string
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return withCause(e.Msg, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	_, ok := target.(*TimeoutError)
+	return ok
+}
+
+// NetworkError is returned when a request can't be sent or its reply can't be recieved
+type NetworkError struct {
+	Msg string
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return withCause(e.Msg, e.Err)
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+func (e *NetworkError) Is(target error) bool {
+	_, ok := target.(*NetworkError)
+	return ok
+}
+
+// PrincipalUnknownError is replied when the client or the server of a request is not registered
+type PrincipalUnknownError struct {
+	Msg  string
+	Code messages.ErrorCode
+}
+
+func (e *PrincipalUnknownError) Error() string {
+	return e.Msg
+}
+
+func (e *PrincipalUnknownError) Is(target error) bool {
+	if t, ok := target.(*PrincipalUnknownError); ok {
+		return matchCode(t.Code, e.Code)
+	}
+	return isReplyError(target, e.Code)
+}
+
+func (e *PrincipalUnknownError) As(target any) bool {
+	return asReplyError(target, e.Msg, e.Code)
+}
+
+// TicketExpiredError is replied when the ticket used is expired, or encrypted with a key version no longer valid:
+// a new one must be asked to the AS (or TGS)
+type TicketExpiredError struct {
+	Msg  string
+	Code messages.ErrorCode
+}
+
+func (e *TicketExpiredError) Error() string {
+	return e.Msg
+}
+
+func (e *TicketExpiredError) Is(target error) bool {
+	if t, ok := target.(*TicketExpiredError); ok {
+		return matchCode(t.Code, e.Code)
+	}
+	return isReplyError(target, e.Code)
+}
+
+func (e *TicketExpiredError) As(target any) bool {
+	return asReplyError(target, e.Msg, e.Code)
+}
+
+// TicketNotYetValidError is replied when the ticket used is postdated or invalid and must be validated
+type TicketNotYetValidError struct {
+	Msg  string
+	Code messages.ErrorCode
+}
+
+func (e *TicketNotYetValidError) Error() string {
+	return e.Msg
+}
+
+func (e *TicketNotYetValidError) Is(target error) bool {
+	if t, ok := target.(*TicketNotYetValidError); ok {
+		return matchCode(t.Code, e.Code)
+	}
+	return isReplyError(target, e.Code)
+}
+
+func (e *TicketNotYetValidError) As(target any) bool {
+	return asReplyError(target, e.Msg, e.Code)
+}
+
+// ReplayError is replied when the authenticator of the request was already used
+type ReplayError struct {
+	Msg  string
+	Code messages.ErrorCode
+}
+
+func (e *ReplayError) Error() string {
+	return e.Msg
+}
+
+func (e *ReplayError) Is(target error) bool {
+	if t, ok := target.(*ReplayError); ok {
+		return matchCode(t.Code, e.Code)
+	}
+	return isReplyError(target, e.Code)
+}
+
+func (e *ReplayError) As(target any) bool {
+	return asReplyError(target, e.Msg, e.Code)
+}
+
+// ClockSkewError is replied when the timestamp of the request is too far from the clock of the server,
+// ServerTime is the time of the server (ms) when the error was replied
+type ClockSkewError struct {
+	Msg        string
+	Code       messages.ErrorCode
+	ServerTime int64
+}
+
+func (e *ClockSkewError) Error() string {
+	return e.Msg
+}
+
+func (e *ClockSkewError) Is(target error) bool {
+	if t, ok := target.(*ClockSkewError); ok {
+		return matchCode(t.Code, e.Code)
+	}
+	return isReplyError(target, e.Code)
+}
+
+func (e *ClockSkewError) As(target any) bool {
+	return asReplyError(target, e.Msg, e.Code)
+}
+
+// IntegrityError is returned when a message, ticket or authenticator has been modified or can't be decrypted,
+// both when the server finds it and when the client checks the reply
+type IntegrityError struct {
+	Msg  string
+	Code messages.ErrorCode
+	Err  error
+}
+
+func (e *IntegrityError) Error() string {
+	return withCause(e.Msg, e.Err)
+}
+
+func (e *IntegrityError) Unwrap() error {
+	return e.Err
+}
+
+func (e *IntegrityError) Is(target error) bool {
+	if t, ok := target.(*IntegrityError); ok {
+		return matchCode(t.Code, e.Code)
+	}
+	return isReplyError(target, e.Code)
+}
+
+func (e *IntegrityError) As(target any) bool {
+	return asReplyError(target, e.Msg, e.Code)
+}
+
+// PolicyError is replied when the request is well formed but refused: options not allowed, end time in the past,
+// delegation not allowed, no trust with the realm
+type PolicyError struct {
+	Msg  string
+	Code messages.ErrorCode
+}
+
+func (e *PolicyError) Error() string {
+	return e.Msg
+}
+
+func (e *PolicyError) Is(target error) bool {
+	if t, ok := target.(*PolicyError); ok {
+		return matchCode(t.Code, e.Code)
+	}
+	return isReplyError(target, e.Code)
+}
+
+func (e *PolicyError) As(target any) bool {
+	return asReplyError(target, e.Msg, e.Code)
+}
+
+func withCause(msg string, err error) string {
+	if err == nil {
+		return msg
+	}
+	return msg + ": " + err.Error()
+}
+
+// matchCode reports whether an error with code matches a target with targetCode, a target without code matches all
+func matchCode(targetCode messages.ErrorCode, code messages.ErrorCode) bool {
+	return targetCode == messages.ErrNone || targetCode == code
+}
+
+func isReplyError(target error, code messages.ErrorCode) bool {
+	t, ok := target.(*ReplyError)
+	return ok && matchCode(t.Code, code)
+}
+
+func asReplyError(target any, msg string, code messages.ErrorCode) bool {
+	t, ok := target.(**ReplyError)
+	if ok {
+		*t = &ReplyError{Msg: msg, Code: code}
+	}
+	return ok
+}
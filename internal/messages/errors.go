@@ -0,0 +1,65 @@
+package messages
+
+// ErrorCode is the reason of an error Reply, the codes and their meaning are the ones of the KRB_ERROR
+// messages of RFC 4120 (section 7.5.9), only the ones used by this implementation are defined
+type ErrorCode int32
+
+const (
+	ErrNone              ErrorCode = 0  // no error
+	ErrClientUnknown     ErrorCode = 6  // client not found in the db
+	ErrServerUnknown     ErrorCode = 7  // server (TGS or service) not found in the db
+	ErrCannotPostdate    ErrorCode = 10 // ticket not eligible for postdating
+	ErrNeverValid        ErrorCode = 11 // requested end time is in the past
+	ErrPolicy            ErrorCode = 12 // request refused by the policy of the server
+	ErrBadOption         ErrorCode = 13 // requested option can't be satisfied
+	ErrEtypeNoSupp       ErrorCode = 14 // no enctype shared by client, server and target, or enctype not permitted
+	ErrPreAuthFailed     ErrorCode = 24 // pre-authentication data not valid
+	ErrPreAuthRequired   ErrorCode = 25 // pre-authentication required
+	ErrPathNotAccepted   ErrorCode = 28 // no trust with the realm
+	ErrBadIntegrity      ErrorCode = 31 // message or ticket can't be decrypted
+	ErrTicketExpired     ErrorCode = 32 // ticket expired
+	ErrTicketNotYetValid ErrorCode = 33 // ticket not yet valid (postdated or invalid)
+	ErrRepeat            ErrorCode = 34 // authenticator already used, replay
+	ErrNotUs             ErrorCode = 35 // ticket issued for another server
+	ErrBadMatch          ErrorCode = 36 // ticket and authenticator don't match
+	ErrSkew              ErrorCode = 37 // clock skew too great
+	ErrBadAddr           ErrorCode = 38 // wrong client address
+	ErrModified          ErrorCode = 41 // mac check failed, message modified
+	ErrBadKeyVer         ErrorCode = 44 // the version of the key of the ticket is not available (anymore)
+	ErrResponseTooBig    ErrorCode = 52 // reply too big for UDP, retry over TCP
+	ErrGeneric           ErrorCode = 60 // generic error, e.g. a db problem of the server
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrNone:              "KDC_ERR_NONE",
+	ErrClientUnknown:     "KDC_ERR_C_PRINCIPAL_UNKNOWN",
+	ErrServerUnknown:     "KDC_ERR_S_PRINCIPAL_UNKNOWN",
+	ErrCannotPostdate:    "KDC_ERR_CANNOT_POSTDATE",
+	ErrNeverValid:        "KDC_ERR_NEVER_VALID",
+	ErrPolicy:            "KDC_ERR_POLICY",
+	ErrBadOption:         "KDC_ERR_BADOPTION",
+	ErrEtypeNoSupp:       "KDC_ERR_ETYPE_NOSUPP",
+	ErrPreAuthFailed:     "KDC_ERR_PREAUTH_FAILED",
+	ErrPreAuthRequired:   "KDC_ERR_PREAUTH_REQUIRED",
+	ErrPathNotAccepted:   "KDC_ERR_PATH_NOT_ACCEPTED",
+	ErrBadIntegrity:      "KRB_AP_ERR_BAD_INTEGRITY",
+	ErrTicketExpired:     "KRB_AP_ERR_TKT_EXPIRED",
+	ErrTicketNotYetValid: "KRB_AP_ERR_TKT_NYV",
+	ErrRepeat:            "KRB_AP_ERR_REPEAT",
+	ErrNotUs:             "KRB_AP_ERR_NOT_US",
+	ErrBadMatch:          "KRB_AP_ERR_BADMATCH",
+	ErrSkew:              "KRB_AP_ERR_SKEW",
+	ErrBadAddr:           "KRB_AP_ERR_BADADDR",
+	ErrModified:          "KRB_AP_ERR_MODIFIED",
+	ErrBadKeyVer:         "KRB_AP_ERR_BADKEYVER",
+	ErrResponseTooBig:    "KRB_ERR_RESPONSE_TOO_BIG",
+	ErrGeneric:           "KRB_ERR_GENERIC",
+}
+
+// String returns the RFC 4120 name of the code
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return "UNKNOWN_ERROR_CODE"
+}
@@ -1,5 +1,10 @@
 package messages
 
+import (
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/security"
+)
+
 /*
 
 C -> ASRequest -> AS
@@ -8,37 +13,95 @@ AS -> E(TicketData) -> Reply -> C
 C -> TGSRequest -> TGS
 TGS -> E(TicketData) -> Reply -> C
 
-C -> ServiceRequest -> V
+C -> ServiceRequest (+ E(forwarded TicketData)) -> V
 V -> E(TS+1) -> Reply -> C
 
 */
 
+// Reply is the reply of every server, when IsError is set ErrorCode tells the reason of the error and Message describes it.
+// Error replies carry the time of the server (ServerTime, ms), so that after a clock skew error the client can correct its clock.
+// Enctype is the enctype of EncryptedData, EncDataMac is empty for AEAD enctypes.
+// StringToKey is set by the AS in its replies and pre-authentication errors: the salt and parameters to derive the key
+// of the client from its password. Kvno is the key version of EncryptedData when it is a ticket (TGS ticket of a
+// user-to-user peer)
 type Reply struct {
 	IsError       bool
+	ErrorCode     ErrorCode
 	Message       string
+	ServerTime    int64
+	Enctype       security.Enctype
+	Kvno          int
 	EncryptedData []byte
 	EncDataMac    []byte
+	StringToKey   *security.StringToKeyParams
 }
 
+// sent by the AS when the client must pre-authenticate and no pre-authentication data was provided
+const PreAuthRequiredMsg = "[AS] ERROR: pre-authentication required"
+
+// ResponseTooBigMsg is the error replied over UDP when the reply doesn't fit in a datagram, the client retries over TCP
+const ResponseTooBigMsg = "ERROR: response too big for UDP, retry over TCP"
+
+// Enctypes are the enctypes supported by the client, from the strongest: the AS uses the strongest one it shares
+// with the client (and with the TGS for the ticket). PreAuthEnctype is the enctype of EncryptedPreAuth
 type ASRequest struct {
-	ClientId  string
-	TGSId     string
-	Timestamp int64
+	ClientId         string
+	TGSId            string
+	Timestamp        int64
+	From             int64
+	Till             int64
+	Nonce            uint32
+	Options          dto.TicketFlags
+	Enctypes         []security.Enctype
+	PreAuthEnctype   security.Enctype
+	EncryptedPreAuth []byte
+	EncPreAuthMac    []byte
 }
 
+// Enctype is the enctype of EncryptedTicket, the authenticator is encrypted with the enctype of the session key
+// (the one of the ticket). Enctypes are the enctypes supported by the client, as in ASRequest.
+// Kvno is the version of the key EncryptedTicket is encrypted with, the same for the evidence and additional tickets
 type TGSRequest struct {
-	ServiceId              string
-	EncryptedTicket        []byte
-	EncTicketMac           []byte
-	EncryptedAuthenticator []byte
-	EncAuthenticatorMac    []byte
+	ServiceId               string
+	Till                    int64
+	Nonce                   uint32
+	Options                 dto.TicketFlags
+	Renew                   bool
+	Validate                bool
+	Address                 string
+	ForUser                 string
+	Enctypes                []security.Enctype
+	EvidenceTicketEnctype   security.Enctype
+	EvidenceTicketKvno      int
+	EvidenceTicket          []byte
+	EvidenceTicketMac       []byte
+	TicketRealm             string
+	AdditionalTicketEnctype security.Enctype
+	AdditionalTicketKvno    int
+	AdditionalTicket        []byte
+	AdditionalTicketMac     []byte
+	Enctype                 security.Enctype
+	Kvno                    int
+	EncryptedTicket         []byte
+	EncTicketMac            []byte
+	EncryptedAuthenticator  []byte
+	EncAuthenticatorMac     []byte
 }
 
+// ServiceRequest with AskTGSTicket set and no ticket asks a user-to-user peer its TGS ticket, which is sent back
+// in the EncryptedData and EncDataMac fields of the Reply (with the TGS ID as Message).
+// Enctype is the enctype of EncryptedTicket, authenticator and forwarded ticket use the enctype of the session key.
+// Kvno is the version of the service key EncryptedTicket is encrypted with
 type ServiceRequest struct {
+	AskTGSTicket           bool
+	Enctype                security.Enctype
+	Kvno                   int
 	EncryptedTicket        []byte
 	EncTicketMac           []byte
 	EncryptedAuthenticator []byte
 	EncAuthenticatorMac    []byte
+	EncryptedCred          []byte
+	EncCredMac             []byte
 }
 
 type ServiceReply struct {
@@ -0,0 +1,42 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Messages over TCP are prefixed by their length as a 4-byte big-endian integer (RFC 4120 section 7.2.2),
+// the high bit is reserved and must be 0
+
+func writeFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var prefix [4]byte
+	_, err := io.ReadFull(r, prefix[:])
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length&0x80000000 != 0 {
+		return nil, errors.New("reserved bit set in tcp length prefix")
+	}
+	if int64(length) > int64(maxSize) {
+		return nil, errors.New("tcp message too big")
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,54 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	for _, msg := range []string{"first", "", "third"} {
+		if err := writeFrame(&buf, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//FRAMES SENT BACK TO BACK ARE READ ONE BY ONE, EVEN IF THEY ARRIVE A BYTE AT A TIME
+	r := iotest.OneByteReader(&buf)
+	for _, want := range []string{"first", "", "third"} {
+		data, err := readFrame(r, 1024)
+		if err != nil || string(data) != want {
+			t.Fatalf("got %q, %v, want %q", data, err, want)
+		}
+	}
+	if _, err := readFrame(r, 1024); err != io.EOF {
+		t.Errorf("got %v after the last frame, want io.EOF", err)
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"short length prefix", []byte{0, 0}, io.ErrUnexpectedEOF},
+		{"short message", []byte{0, 0, 0, 10, 'a', 'b'}, io.ErrUnexpectedEOF},
+		{"oversized message", []byte{0, 0, 4, 1}, nil},
+		{"reserved bit", []byte{0x80, 0, 0, 1, 'a'}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := readFrame(bytes.NewReader(test.frame), 1024)
+			if err == nil {
+				t.Fatalf("got %q, want an error", data)
+			}
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
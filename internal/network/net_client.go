@@ -2,22 +2,29 @@ package network
 
 import (
 	"net"
+	"time"
 )
 
-func SendUDPRequest(localAddr *net.UDPAddr, serverAddr *net.UDPAddr, data []byte, bufferSize int) ([]byte, error) {
+// SendUDPRequest sends data and waits for the reply at most timeout
+func SendUDPRequest(localAddr *net.UDPAddr, serverAddr *net.UDPAddr, data []byte, bufferSize int, timeout time.Duration) ([]byte, error) {
 
 	conn, err := net.DialUDP("udp", localAddr, serverAddr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer conn.Close()
 
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
 	_, err = conn.Write(data)
 	if err != nil {
 		return nil, err
 	}
 
-	buffer := make([]byte, 1024)
+	buffer := make([]byte, bufferSize)
 	len, _, err := conn.ReadFromUDP(buffer)
 	if err != nil {
 		return nil, err
@@ -26,6 +33,29 @@ func SendUDPRequest(localAddr *net.UDPAddr, serverAddr *net.UDPAddr, data []byte
 	return buffer[:len], nil
 }
 
+// SendTCPRequest connects, sends data and waits for the reply, all within timeout
+func SendTCPRequest(localAddr *net.TCPAddr, serverAddr *net.TCPAddr, data []byte, maxSize int, timeout time.Duration) ([]byte, error) {
+
+	dialer := net.Dialer{LocalAddr: localAddr, Timeout: timeout}
+	conn, err := dialer.Dial("tcp", serverAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFrame(conn, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return readFrame(conn, maxSize)
+}
+
 func GetActiveIP(destIp string) (net.IP, error) {
 	conn, err := net.Dial("udp", destIp+":8000") //dummy port 8000
 	if err != nil {
@@ -1,36 +1,180 @@
 package network
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"io"
 	"net"
 	"os"
+	"sync"
+	"time"
 )
 
-func ListenUDP(serverAddr net.UDPAddr, bufferSize int, onRequest func([]byte, *net.UDPAddr) ([]byte, error), onError func(err error)) {
+type udpRequest struct {
+	data       []byte
+	clientAddr *net.UDPAddr
+}
 
-	conn, err := net.ListenUDP("udp", &serverAddr)
+// ListenUDP serves requests with a pool of workers goroutines, so a slow request doesn't block the others.
+// When all the workers are busy new requests wait in a queue as long as the pool.
+// It returns when ctx is done, after the requests already recieved have been answered
+func ListenUDP(ctx context.Context, serverAddr net.UDPAddr, bufferSize int, workers int, onRequest func([]byte, *net.UDPAddr) ([]byte, error), onError func(err error)) error {
 
+	conn, err := net.ListenUDP("udp", &serverAddr)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
 
 	defer conn.Close()
-	buffer := make([]byte, bufferSize)
+
+	//UNBLOCK THE READ WHEN THE SERVER IS STOPPED
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	requests := make(chan udpRequest, workers)
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range requests {
+				responseData, err := onRequest(req.data, req.clientAddr)
+				if err != nil {
+					onError(err)
+					continue
+				}
+				conn.WriteToUDP(responseData, req.clientAddr)
+			}
+		}()
+	}
 
 	for {
+		buffer := make([]byte, bufferSize)
 		len, clientAddr, err := conn.ReadFromUDP(buffer)
 
+		if ctx.Err() != nil {
+			break
+		}
 		if err != nil {
 			onError(err)
 			continue
 		}
 
-		responseData, err := onRequest(buffer[:len], clientAddr)
+		requests <- udpRequest{data: buffer[:len], clientAddr: clientAddr}
+	}
+
+	//DRAIN IN-FLIGHT REQUESTS
+	close(requests)
+	wg.Wait()
+	return nil
+}
+
+// ListenTCP serves length-prefixed requests, every connection is handled on its own goroutine and can carry
+// more than one request. At most maxConns connections are open at the same time, the next ones wait in the backlog
+// of the listener until one is closed. At most workers requests are handled at the same time, a connection waiting
+// for its next request doesn't hold a worker and is closed if no request arrives within idleTimeout.
+// It returns when ctx is done, after the requests in progress have been answered
+func ListenTCP(ctx context.Context, serverAddr net.TCPAddr, maxSize int, workers int, maxConns int, idleTimeout time.Duration, onRequest func([]byte, *net.UDPAddr) ([]byte, error), onError func(err error)) error {
+
+	listener, err := net.ListenTCP("tcp", &serverAddr)
+	if err != nil {
+		return err
+	}
+
+	defer listener.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(workers, 1))
+	conns := make(chan struct{}, max(maxConns, 1))
+	for {
+		//A CONNECTION IS ACCEPTED ONLY WHEN IT CAN BE HANDLED
+		select {
+		case conns <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		conn, err := listener.AcceptTCP()
+
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			break
+		}
 		if err != nil {
+			<-conns
 			onError(err)
 			continue
 		}
-		conn.WriteToUDP(responseData, clientAddr)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-conns }()
+			handleTCPConn(ctx, conn, maxSize, slots, idleTimeout, onRequest, onError)
+		}()
+	}
+
+	//DRAIN IN-FLIGHT REQUESTS
+	wg.Wait()
+	return nil
+}
+
+func handleTCPConn(ctx context.Context, conn *net.TCPConn, maxSize int, slots chan struct{}, idleTimeout time.Duration, onRequest func([]byte, *net.UDPAddr) ([]byte, error), onError func(err error)) {
+	defer conn.Close()
+
+	//CONNECTIONS WAITING FOR A NEW REQUEST ARE CLOSED WHEN THE SERVER IS STOPPED
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	//HANDLERS ONLY LOOK AT THE CLIENT IP, SO THE SAME HANDLERS SERVE BOTH TRANSPORTS
+	tcpAddr := conn.RemoteAddr().(*net.TCPAddr)
+	clientAddr := &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone}
+
+	for {
+		//THE DEADLINE IS SET BEFORE THE LENGTH PREFIX IS READ, SO THE WHOLE FRAME MUST ARRIVE WITHIN idleTimeout
+		//AND A CLIENT SENDING NOTHING OR HALF A FRAME CAN'T HOLD THE CONNECTION. THE CHECK OF CTX AFTER IT KEEPS
+		//THE DEADLINE SET ON STOP
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if ctx.Err() != nil {
+			return
+		}
+
+		data, err := readFrame(conn, maxSize)
+		if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) || ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			onError(err)
+			return
+		}
+
+		//A WORKER IS HELD ONLY WHILE THE REQUEST IS HANDLED
+		slots <- struct{}{}
+		responseData, err := onRequest(data, clientAddr)
+		<-slots
+		if err != nil {
+			onError(err)
+			return
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+		err = writeFrame(conn, responseData)
+		if err != nil {
+			onError(err)
+			return
+		}
 	}
 }
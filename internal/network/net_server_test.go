@@ -0,0 +1,271 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeTCPAddr returns an address of 127.0.0.1 with a port free when it is called
+func freeTCPAddr(t *testing.T) net.TCPAddr {
+	t.Helper()
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return *listener.Addr().(*net.TCPAddr)
+}
+
+// startTCP serves echo requests with ListenTCP until the end of the test
+func startTCP(t *testing.T, maxConns int, idleTimeout time.Duration) net.TCPAddr {
+	t.Helper()
+	serverAddr := freeTCPAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ListenTCP(ctx, serverAddr, 1024, 2, maxConns, idleTimeout, func(data []byte, _ *net.UDPAddr) ([]byte, error) {
+			return data, nil
+		}, func(err error) {})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+
+	//WAIT FOR THE LISTENER
+	for range 100 {
+		conn, err := net.Dial("tcp", serverAddr.String())
+		if err == nil {
+			conn.Close()
+			return serverAddr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server not listening")
+	return serverAddr
+}
+
+func TestListenTCPMaxConnections(t *testing.T) {
+	serverAddr := startTCP(t, 1, 10*time.Second)
+
+	//THE FIRST CONNECTION TAKES THE ONLY SLOT
+	idle, err := net.Dial("tcp", serverAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	if err := writeFrame(idle, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if reply, err := readFrame(idle, 1024); err != nil || !bytes.Equal(reply, []byte("first")) {
+		t.Fatalf("got %q, %v, want the echo of the first request", reply, err)
+	}
+
+	//THE SECOND ONE IS NOT SERVED UNTIL THE FIRST IS CLOSED
+	conn, err := net.Dial("tcp", serverAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeFrame(conn, []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if reply, err := readFrame(conn, 1024); err == nil {
+		t.Fatalf("got %q over a connection beyond the limit", reply)
+	}
+
+	idle.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if reply, err := readFrame(conn, 1024); err != nil || !bytes.Equal(reply, []byte("second")) {
+		t.Fatalf("got %q, %v, want the echo of the second request", reply, err)
+	}
+}
+
+func TestListenTCPIdleTimeout(t *testing.T) {
+	serverAddr := startTCP(t, 4, 100*time.Millisecond)
+
+	tests := []struct {
+		name string
+		sent []byte
+	}{
+		{"nothing", nil},
+		{"half a length prefix", []byte{0, 0}},
+		{"half a frame", []byte{0, 0, 0, 10, 'a'}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", serverAddr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write(test.sent); err != nil {
+				t.Fatal(err)
+			}
+
+			//THE SERVER CLOSES THE CONNECTION, THE READ ENDS BEFORE THE DEADLINE OF THE TEST
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			start := time.Now()
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Fatal("got data, want the connection closed")
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("connection closed after %v, want about the idle timeout", elapsed)
+			}
+		})
+	}
+}
+
+// startUDP serves requests with ListenUDP until the end of the test, the handler echoes the request after
+// waiting the number of ms in its first byte
+func startUDP(t *testing.T, workers int) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := *conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ListenUDP(ctx, serverAddr, 1024, workers, func(data []byte, _ *net.UDPAddr) ([]byte, error) {
+			time.Sleep(time.Duration(data[0]) * time.Millisecond)
+			return data, nil
+		}, func(err error) {})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+
+	//WAIT FOR THE SERVER
+	for range 20 {
+		if _, err := SendUDPRequest(nil, &serverAddr, []byte{0}, 1024, 100*time.Millisecond); err == nil {
+			return &serverAddr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server not listening")
+	return &serverAddr
+}
+
+func TestListenUDPRepliesToSender(t *testing.T) {
+	serverAddr := startUDP(t, 4)
+
+	//THE REQUESTS END IN ANOTHER ORDER THAN THEY ARRIVED, EVERY CLIENT MUST GET ITS OWN REPLY
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := append([]byte{byte(50 - 3*i)}, fmt.Sprintf("client %d", i)...)
+			reply, err := SendUDPRequest(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, serverAddr, request, 1024, 2*time.Second)
+			if err != nil {
+				t.Errorf("client %d: %v", i, err)
+				return
+			}
+			if !bytes.Equal(reply, request) {
+				t.Errorf("client %d got %q, want its own request", i, reply[1:])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestListenShutdown(t *testing.T) {
+	tcpAddr := freeTCPAddr(t)
+	udpAddr := net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port}
+
+	//THE HANDLER WAITS UNTIL THE SERVERS ARE STOPPED, SO THE REQUESTS ARE IN PROGRESS DURING THE SHUTDOWN
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{}, 2)
+	handler := func(data []byte, _ *net.UDPAddr) ([]byte, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return data, nil
+	}
+	udpDone := make(chan error, 1)
+	tcpDone := make(chan error, 1)
+	go func() { udpDone <- ListenUDP(ctx, udpAddr, 1024, 2, handler, func(err error) {}) }()
+	go func() { tcpDone <- ListenTCP(ctx, tcpAddr, 1024, 2, 4, 10*time.Second, handler, func(err error) {}) }()
+
+	var idle net.Conn
+	for range 100 {
+		var err error
+		if idle, err = net.Dial("tcp", tcpAddr.String()); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if idle == nil {
+		t.Fatal("tcp server not listening")
+	}
+	defer idle.Close()
+
+	replies := make(chan error, 2)
+	go func() {
+		//THE REQUEST IS SENT AGAIN WHILE THE UDP SERVER IS NOT LISTENING YET
+		reply, err := SendUDPRequest(nil, &udpAddr, []byte("udp"), 1024, 5*time.Second)
+		for i := 0; i < 100 && errors.Is(err, syscall.ECONNREFUSED); i++ {
+			time.Sleep(10 * time.Millisecond)
+			reply, err = SendUDPRequest(nil, &udpAddr, []byte("udp"), 1024, 5*time.Second)
+		}
+		if err == nil && string(reply) != "udp" {
+			err = fmt.Errorf("got %q over udp", reply)
+		}
+		replies <- err
+	}()
+	go func() {
+		reply, err := SendTCPRequest(nil, &tcpAddr, []byte("tcp"), 1024, 5*time.Second)
+		if err == nil && string(reply) != "tcp" {
+			err = fmt.Errorf("got %q over tcp", reply)
+		}
+		replies <- err
+	}()
+	for range 2 {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("requests not recieved")
+		}
+	}
+
+	//THE SERVERS RETURN ONCE THE REQUESTS IN PROGRESS ARE ANSWERED, IDLE CONNECTIONS ARE CLOSED
+	cancel()
+	for _, done := range []chan error{udpDone, tcpDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("server not stopped")
+		}
+	}
+	for range 2 {
+		if err := <-replies; err != nil {
+			t.Errorf("request in progress not answered: %v", err)
+		}
+	}
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v reading the idle connection, want it closed", err)
+	}
+}
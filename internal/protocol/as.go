@@ -1,38 +1,40 @@
 package protocol
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	config "simple_kerberos/configs"
 	"simple_kerberos/internal/dao"
 	"simple_kerberos/internal/dto"
 	"simple_kerberos/internal/messages"
-	"simple_kerberos/internal/network"
 	"simple_kerberos/internal/security"
 	"time"
 )
 
-func StartAS(serverIp string, adminPwd string) {
+// StartAS serves AS requests until ctx is done, it returns an error if it can't listen on serverIp
+func StartAS(ctx context.Context, serverIp string, adminPwd string) error {
 	serverAddr := net.UDPAddr{
-		Port: config.AsPort,
+		Port: config.Current().AsPort,
 		IP:   net.ParseIP(serverIp),
 	}
 
-	startAS(serverAddr, adminPwd)
+	return startAS(ctx, serverAddr, adminPwd)
 }
 
-func StartASDefaultIp(adminPwd string) {
+func StartASDefaultIp(ctx context.Context, adminPwd string) error {
 	serverAddr := net.UDPAddr{
-		Port: config.AsPort,
+		Port: config.Current().AsPort,
 	}
 
-	startAS(serverAddr, adminPwd)
+	return startAS(ctx, serverAddr, adminPwd)
 }
 
-func startAS(serverAddr net.UDPAddr, adminPwd string) {
+func startAS(ctx context.Context, serverAddr net.UDPAddr, adminPwd string) error {
 	fmt.Println("Kerberos AS listening on " + serverAddr.IP.String() + ":" + fmt.Sprint(serverAddr.Port) + "...")
-	network.ListenUDP(serverAddr, 1024, func(b []byte, a *net.UDPAddr) ([]byte, error) {
+	return serve(ctx, serverAddr, func(b []byte, a *net.UDPAddr) ([]byte, error) {
 		return asRequestHandler(b, a, adminPwd)
 	}, asErrorHandler)
 
@@ -45,7 +47,7 @@ func asRequestHandler(data []byte, clientAddr *net.UDPAddr, adminPwd string) ([]
 
 	reply, err := asBuildReply(req, clientAddr, adminPwd)
 	if err != nil {
-		fmt.Println("[TGS] Server Error: ", err)
+		fmt.Println("[AS] Server Error: ", err)
 	}
 
 	replyJson, err := json.Marshal(reply)
@@ -60,87 +62,182 @@ func asBuildReply(req messages.ASRequest, clientAddr *net.UDPAddr, adminPwd stri
 
 	db, err := dao.OpenEncryptedASDb(config.AsDbPath, adminPwd)
 	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "[AS] ERROR: Generic server error", false), err
 	}
 	defer db.Close()
 
 	//RETRIVE CLIENT
 	client, err := dao.GetClientByClientId(req.ClientId, db)
 	if err != nil {
-		return errorReply("[AS] ERROR: client "+req.ClientId+" not registered or other problems", true), nil
+		return errorReply(messages.ErrClientUnknown, "[AS] ERROR: client "+req.ClientId+" not registered or other problems", true), nil
+	}
+
+	//CHECK PRE-AUTHENTICATION, ERRORS TELL THE CLIENT HOW TO DERIVE ITS KEY
+	if len(req.EncryptedPreAuth) == 0 && client.RequirePreAuth {
+		return preAuthErrorReply(messages.ErrPreAuthRequired, messages.PreAuthRequiredMsg, client), nil
+	}
+	flags := dto.FlagInitial
+	if len(req.EncryptedPreAuth) != 0 {
+		check, code, reason := checkPreAuth(req, client)
+		if !check {
+			return preAuthErrorReply(code, "[AS] "+reason, client), nil
+		}
+		flags |= dto.FlagPreAuthent
 	}
 
 	//RETRIVE TGS
 	tgs, err := dao.GetTGSByTgsId(req.TGSId, db)
 	if err != nil {
-		return errorReply("[AS] ERROR: tgs "+req.TGSId+" not known or other problems", true), nil
+		return errorReply(messages.ErrServerUnknown, "[AS] ERROR: tgs "+req.TGSId+" not known or other problems", true), nil
+	}
+
+	//CHOOSE ENCTYPES: THE REPLY IS READ BY THE CLIENT, THE TICKET BY THE TGS. TGSs ARE SERVED BY THE KDC ITSELF,
+	//SO THEIR KEYS SUPPORT EVERY ENCTYPE PERMITTED
+	replyEnctype, ok := security.StrongestEnctype(req.Enctypes, security.PermittedEnctypes())
+	if !ok {
+		return errorReply(messages.ErrEtypeNoSupp, "[AS] ERROR: no enctype supported by "+req.ClientId+" is permitted", true), nil
+	}
+	enctype, ok := ticketEnctype(req.Enctypes, security.SupportedEnctypes)
+	if !ok {
+		return errorReply(messages.ErrEtypeNoSupp, "[AS] ERROR: no enctype shared by "+req.ClientId+" and "+req.TGSId, true), nil
 	}
 
 	//CREATE TOKEN
 	timestamp := time.Now().UnixMilli()
 	keyClientTGS := security.GenerateRandomKey(config.SymmKeyDim)
 
+	//SET REQUESTED FLAGS
+	flags |= req.Options & (dto.FlagForwardable | dto.FlagProxiable | dto.FlagMayPostdate | dto.FlagRenewable)
+
+	//A POSTDATED TICKET STARTS IN THE FUTURE (NOT TOO FAR) AND MUST BE VALIDATED BY THE TGS BEFORE USE
+	if req.Options.Has(dto.FlagPostdated) && req.From > timestamp+config.Current().MaxPostdate {
+		return errorReply(messages.ErrCannotPostdate, "[AS] ERROR: start time requested by "+req.ClientId+" is too far in the future", true), nil
+	}
+	if req.Options.Has(dto.FlagPostdated) && req.From > timestamp {
+		timestamp = req.From
+		flags |= dto.FlagPostdated | dto.FlagInvalid
+	}
+
+	lifetime := grantedLifetime(timestamp, req.Till, client.MaxLifetime)
+	if lifetime <= 0 {
+		return errorReply(messages.ErrNeverValid, "[AS] ERROR: requested end time for "+req.ClientId+" is in the past", true), nil
+	}
+
+	var renewTill int64
+	if flags.Has(dto.FlagRenewable) {
+		renewTill = timestamp + config.Current().MaxRenewableLifetime
+	}
+
 	ticket := dto.Ticket{
 		Key:           keyClientTGS,
+		Enctype:       enctype,
 		ClientId:      req.ClientId,
 		ClientAddress: clientAddr.IP.String(),
 		TargetId:      req.TGSId,
 		Timestamp:     timestamp,
-		Lifetime:      config.Lifetime,
+		Lifetime:      lifetime,
+		RenewTill:     renewTill,
+		Flags:         flags,
 	}
 
 	//ENCRYPT TOKEN
 	jsonTicket, err := json.Marshal(ticket)
 	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "[AS] ERROR: Generic server error", false), err
 	}
 
-	encryptedTicket, err := security.SymmetricEncryption(jsonTicket, tgs.Key)
+	encryptedTicket, ticketMac, err := security.Encrypt(enctype, tgs.Key, security.UsageTicket, jsonTicket)
 	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "[AS] ERROR: Generic server error", false), err
 	}
 
 	//CREATE TICKET DATA
 	ticketData := dto.TicketData{
 		Key:             keyClientTGS,
+		Enctype:         enctype,
+		Kvno:            tgs.Kvno,
 		TargetId:        req.TGSId,
 		Timestamp:       timestamp,
-		Lifetime:        config.Lifetime,
+		Lifetime:        lifetime,
+		RenewTill:       renewTill,
+		Flags:           flags,
+		Nonce:           req.Nonce,
 		EncryptedTicket: encryptedTicket,
-		EncTicketMac:    security.MacData(encryptedTicket, tgs.Key),
+		EncTicketMac:    ticketMac,
 	}
 
 	//ENCRYPT TICKET DATA
 	jsonTicketData, err := json.Marshal(ticketData)
 	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "[AS] ERROR: Generic server error", false), err
 	}
-	encryptedTicketData, err := security.SymmetricEncryption(jsonTicketData, client.Key)
+	encryptedTicketData, ticketDataMac, err := security.Encrypt(replyEnctype, client.Key, security.UsageASReply, jsonTicketData)
 	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "[AS] ERROR: Generic server error", false), err
 	}
 
 	reply := messages.Reply{
 		IsError:       false,
 		Message:       "OK",
+		Enctype:       replyEnctype,
 		EncryptedData: encryptedTicketData,
-		EncDataMac:    security.MacData(encryptedTicketData, client.Key),
+		EncDataMac:    ticketDataMac,
+		StringToKey:   &client.StringToKey,
 	}
 
 	fmt.Println("[AS]: OK " + req.ClientId + " -> " + req.TGSId)
 	return reply, nil
 }
 
+func checkPreAuth(req messages.ASRequest, client dto.Client) (bool, messages.ErrorCode, string) {
+
+	preAuthJson, err := security.Decrypt(req.PreAuthEnctype, client.Key, security.UsagePreAuth, req.EncryptedPreAuth, req.EncPreAuthMac)
+	if errors.Is(err, security.ErrUnsupportedEnctype) {
+		return false, messages.ErrEtypeNoSupp, "ERROR: enctype " + req.PreAuthEnctype.String() + " of the pre-authentication data is not permitted"
+	}
+	if errors.Is(err, security.ErrModified) {
+		return false, messages.ErrPreAuthFailed, "ERROR: integrity check for pre-authentication data of " + req.ClientId + " failed"
+	}
+	if err != nil {
+		return false, messages.ErrPreAuthFailed, "ERROR: inconsistent pre-authentication data recieved"
+	}
+	var preAuth dto.PreAuthData
+	err = json.Unmarshal(preAuthJson, &preAuth)
+	if err != nil {
+		return false, messages.ErrPreAuthFailed, "ERROR: inconsistent pre-authentication data recieved"
+	}
+
+	if preAuth.ClientId != req.ClientId {
+		return false, messages.ErrPreAuthFailed, "ERROR: pre-authentication data for the wrong client"
+	}
+
+	if fresh, reason := checkTimestamp(preAuth.Timestamp); !fresh {
+		return false, messages.ErrSkew, "ERROR: invalid pre-authentication timestamp, " + reason
+	}
+
+	return true, messages.ErrNone, ""
+}
+
+// preAuthErrorReply is the error reply for a pre-authentication problem of client, with the parameters of its key
+// so that a client that derived its key with the wrong salt can retry
+func preAuthErrorReply(code messages.ErrorCode, msg string, client dto.Client) messages.Reply {
+	reply := errorReply(code, msg, true)
+	reply.StringToKey = &client.StringToKey
+	return reply
+}
+
 func asErrorHandler(err error) {
 	fmt.Println("[AS] [GENERIC ERROR]: ", err)
 }
 
-func AddTGS(tgsId string, key []byte, adminPwd string) error {
+// AddTGS stores key, the current key of tgsId, so that the AS issues tickets for the TGS encrypted with it
+func AddTGS(tgsId string, key dto.VersionedKey, adminPwd string) error {
 
 	db, err := dao.OpenEncryptedASDb(config.AsDbPath, adminPwd)
 	if err != nil {
 		return err
 	}
+	defer db.Close()
 
 	exists, err := dao.TgsExists(tgsId, db)
 	if err != nil {
@@ -148,9 +245,21 @@ func AddTGS(tgsId string, key []byte, adminPwd string) error {
 	}
 
 	if exists {
-		return dao.UpdateTgsKey(tgsId, key, db)
+		return dao.UpdateTgsKey(tgsId, key.Key, key.Kvno, db)
 	} else {
-		return dao.InsertTGS(tgsId, key, db)
+		return dao.InsertTGS(tgsId, key.Key, key.Kvno, db)
+	}
+
+}
+
+// RemoveTGS deletes the key of a TGS no longer served by the KDC, so the AS stops issuing tickets for it
+func RemoveTGS(tgsId string, adminPwd string) error {
+
+	db, err := dao.OpenEncryptedASDb(config.AsDbPath, adminPwd)
+	if err != nil {
+		return err
 	}
+	defer db.Close()
 
+	return dao.DeleteTGSByTgsId(tgsId, db)
 }
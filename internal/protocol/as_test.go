@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"encoding/json"
+	"net"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/messages"
+	"simple_kerberos/internal/security"
+	"testing"
+	"time"
+)
+
+func TestASPreAuth(t *testing.T) {
+	setupAS(t, nil)
+
+	//CAROL DOESN'T REQUIRE PRE-AUTHENTICATION
+	db, err := dao.OpenEncryptedASDb(config.AsDbPath, testAdminPwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := security.DefaultStringToKeyParams("carol")
+	carolKey, err := security.GenerateClientKeyFromPwd("secret", params, config.SymmKeyDim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dao.InsertClient("carol", carolKey, params, false, 0, db)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceKey, err := security.GenerateClientKeyFromPwd("secret", security.DefaultStringToKeyParams("alice"), config.SymmKeyDim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hour := time.Hour.Milliseconds()
+
+	tests := []struct {
+		name        string
+		clientId    string
+		preAuthId   string
+		preAuthKey  []byte
+		clockOffset int64
+		code        messages.ErrorCode
+		preAuthent  bool
+	}{
+		{name: "valid", clientId: "alice", preAuthId: "alice", preAuthKey: aliceKey, preAuthent: true},
+		{name: "missing", clientId: "alice", code: messages.ErrPreAuthRequired},
+		{name: "wrong key", clientId: "alice", preAuthId: "alice", preAuthKey: carolKey, code: messages.ErrPreAuthFailed},
+		{name: "other client", clientId: "alice", preAuthId: "carol", preAuthKey: aliceKey, code: messages.ErrPreAuthFailed},
+		{name: "old timestamp", clientId: "alice", preAuthId: "alice", preAuthKey: aliceKey, clockOffset: -hour, code: messages.ErrSkew},
+		{name: "future timestamp", clientId: "alice", preAuthId: "alice", preAuthKey: aliceKey, clockOffset: hour, code: messages.ErrSkew},
+		{name: "not required", clientId: "carol"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := asRequest(test.clientId)
+			req.Enctypes = security.PermittedEnctypes()
+			if test.preAuthKey != nil {
+				req.PreAuthEnctype = security.EnctypeAesGcm
+				req.EncryptedPreAuth, req.EncPreAuthMac, err = prepareEncryptedPreAuth(test.preAuthId, req.PreAuthEnctype, test.preAuthKey, test.clockOffset)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			reply, err := asBuildReply(req, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, testAdminPwd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.code != messages.ErrNone {
+				if !reply.IsError || reply.ErrorCode != test.code {
+					t.Fatalf("got error %v code %d (%s), want code %d", reply.IsError, reply.ErrorCode, reply.Message, test.code)
+				}
+				if test.code != messages.ErrSkew && reply.StringToKey == nil {
+					t.Error("pre-authentication error without the parameters of the key")
+				}
+				return
+			}
+			if reply.IsError {
+				t.Fatalf("unexpected error reply: %s", reply.Message)
+			}
+
+			//THE TICKET IS PRE-AUTHENTICATED ONLY IF PRE-AUTHENTICATION DATA WAS SENT
+			clientKey := aliceKey
+			if test.clientId == "carol" {
+				clientKey = carolKey
+			}
+			jsonTicketData, err := decryptReply(reply, clientKey, security.UsageASReply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ticketData dto.TicketData
+			if err := json.Unmarshal(jsonTicketData, &ticketData); err != nil {
+				t.Fatal(err)
+			}
+			if ticketData.Flags.Has(dto.FlagPreAuthent) != test.preAuthent {
+				t.Errorf("got flags %v, want pre-authent %v", ticketData.Flags, test.preAuthent)
+			}
+		})
+	}
+}
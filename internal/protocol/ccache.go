@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"fmt"
+	"os"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
+	"strings"
+)
+
+// CCacheNameEnv is the environment variable naming the credential cache of the client, like KRB5CCNAME:
+// FILE:path for a cache in the MIT ccache format, SQLITE:path for a SQLite db. It overrides
+// default_ccache_name of the configuration, so every user and session can have its own cache
+const CCacheNameEnv = "SIMPLE_KRB5CCNAME"
+
+// TicketKind tells the TGS tickets, got from the AS, from the service tickets
+type TicketKind int
+
+const (
+	KindTGS TicketKind = iota
+	KindService
+)
+
+// CredCache stores the tickets of the clients with their session keys. GetTicket returns false if there is
+// no ticket of clientId for targetId, ListTickets returns all the tickets of clientId of a kind
+type CredCache interface {
+	SaveTicket(clientId string, kind TicketKind, data dto.TicketData) error
+	GetTicket(clientId string, kind TicketKind, targetId string) (dto.TicketData, bool, error)
+	ListTickets(clientId string, kind TicketKind) ([]dto.TicketData, error)
+	DeleteTicket(clientId string, kind TicketKind, targetId string) error
+}
+
+// OpenCredCache returns the credential cache of the client, named by CCacheNameEnv or by the configuration
+func OpenCredCache() (CredCache, error) {
+	name := os.Getenv(CCacheNameEnv)
+	if name == "" {
+		name = config.CCacheName
+	}
+	return openCredCache(name)
+}
+
+// openCredCache returns the cache called name. As in MIT, a name without type is a FILE cache, while the empty
+// name is the SQLite db of the client (client_db)
+func openCredCache(name string) (CredCache, error) {
+	if name == "" {
+		return sqliteCCache{dbPath: config.ClientDbPath}, nil
+	}
+
+	ccType, path, found := strings.Cut(name, ":")
+	if !found {
+		return fileCCache{path: name}, nil
+	}
+	switch ccType {
+	case "FILE":
+		return fileCCache{path: path}, nil
+	case "SQLITE":
+		return sqliteCCache{dbPath: path}, nil
+	}
+	return nil, fmt.Errorf("unknown credential cache type %q in %s", ccType, name)
+}
+
+// sqliteCCache keeps the tickets in the tgsTickets and serviceTickets tables of a SQLite db
+type sqliteCCache struct {
+	dbPath string
+}
+
+func (c sqliteCCache) SaveTicket(clientId string, kind TicketKind, data dto.TicketData) error {
+	db, err := dao.OpenDb(c.dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if kind == KindTGS {
+		exists, err := dao.TGSTicketExists(clientId, data.TargetId, db)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return dao.UpdateTGSTicket(clientId, data, db)
+		}
+		return dao.InsertTGSTicket(clientId, data, db)
+	}
+
+	exists, err := dao.ServiceTicketExists(clientId, data.TargetId, db)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return dao.UpdateServiceTicket(clientId, data, db)
+	}
+	return dao.InsertServiceTicket(clientId, data, db)
+}
+
+func (c sqliteCCache) GetTicket(clientId string, kind TicketKind, targetId string) (dto.TicketData, bool, error) {
+	db, err := dao.OpenDb(c.dbPath)
+	if err != nil {
+		return dto.TicketData{}, false, err
+	}
+	defer db.Close()
+
+	exists, err := dao.TGSTicketExists(clientId, targetId, db)
+	if kind == KindService {
+		exists, err = dao.ServiceTicketExists(clientId, targetId, db)
+	}
+	if err != nil || !exists {
+		return dto.TicketData{}, false, err
+	}
+
+	var ticketData dto.TicketData
+	if kind == KindTGS {
+		ticketData, err = dao.GetTGSTicket(clientId, targetId, db)
+	} else {
+		ticketData, err = dao.GetServiceTicket(clientId, targetId, db)
+	}
+	if err != nil {
+		return dto.TicketData{}, false, err
+	}
+	return ticketData, true, nil
+}
+
+func (c sqliteCCache) ListTickets(clientId string, kind TicketKind) ([]dto.TicketData, error) {
+	db, err := dao.OpenDb(c.dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if kind == KindTGS {
+		return dao.GetAllTGSTickets(clientId, db)
+	}
+	return dao.GetAllServiceTickets(clientId, db)
+}
+
+func (c sqliteCCache) DeleteTicket(clientId string, kind TicketKind, targetId string) error {
+	db, err := dao.OpenDb(c.dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if kind == KindTGS {
+		return dao.DeleteTGSTicket(clientId, targetId, db)
+	}
+	return dao.DeleteServiceTicket(clientId, targetId, db)
+}
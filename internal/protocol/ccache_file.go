@@ -0,0 +1,449 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/security"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+/*
+FILE credential caches are written in the MIT ccache format, version 4 (integers big-endian):
+
+	ccache:     uint16 0x0504, uint16 headerLength, header, principal defaultPrincipal, credential*
+	principal:  uint32 nameType, uint32 components, data realm, data component*
+	credential: principal client, principal server, uint16 enctype, data key,
+	            uint32 authTime, startTime, endTime, renewTill (s), uint8 isSKey, uint32 flags,
+	            uint32 count, address*, uint32 count, authData*, data ticket, data secondTicket
+	address:    uint16 type, data
+	authData:   uint16 type, data
+	data:       uint32 length, bytes
+
+TGS tickets have krbtgt/tgsId@REALM as server. The key version and the mac of the ticket, which have no place
+in the format, are stored as authorization data of local types (negative ad-types), the enctypes with the
+numbers for local use of keytabs (see security.Enctype.FileNumber). The credentials of other programs found in
+the cache are kept. Writers take a lock on the file path.lock, so concurrent clients don't lose each other's
+tickets, and replace the cache with a temporary file renamed over it, so readers never see half a cache
+*/
+
+const ccacheVersion = 0x0504
+
+const (
+	ntPrincipal = 1
+	ntSrvInst   = 2
+)
+
+// local authorization data types, -1 and -2 as 16 bit integers
+const (
+	adKvno      uint16 = 0xffff
+	adTicketMac uint16 = 0xfffe
+)
+
+type ccPrincipal struct {
+	nameType   uint32
+	realm      string
+	components []string
+}
+
+type ccTagged struct {
+	tag  uint16
+	data []byte
+}
+
+type ccCredential struct {
+	client, server                          ccPrincipal
+	enctype                                 uint16
+	key                                     []byte
+	authTime, startTime, endTime, renewTill uint32
+	isSKey                                  uint8
+	flags                                   uint32
+	addresses, authData                     []ccTagged
+	ticket, secondTicket                    []byte
+}
+
+// fileCCache keeps the tickets in a file in the MIT ccache format
+type fileCCache struct {
+	path string
+}
+
+func (c fileCCache) SaveTicket(clientId string, kind TicketKind, data dto.TicketData) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	defaultPrincipal, creds, err := c.load()
+	if err != nil {
+		return err
+	}
+
+	cred := newCCCredential(clientId, kind, data)
+	if len(defaultPrincipal.components) == 0 {
+		defaultPrincipal = cred.client
+	}
+	creds = slices.DeleteFunc(creds, func(cc ccCredential) bool { return cc.matches(clientId, kind, data.TargetId) })
+	creds = append(creds, cred)
+
+	return c.store(defaultPrincipal, creds)
+}
+
+func (c fileCCache) GetTicket(clientId string, kind TicketKind, targetId string) (dto.TicketData, bool, error) {
+	_, creds, err := c.load()
+	if err != nil {
+		return dto.TicketData{}, false, err
+	}
+
+	for _, cred := range creds {
+		if cred.matches(clientId, kind, targetId) {
+			return cred.ticketData(), true, nil
+		}
+	}
+	return dto.TicketData{}, false, nil
+}
+
+func (c fileCCache) ListTickets(clientId string, kind TicketKind) ([]dto.TicketData, error) {
+	_, creds, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var tickets []dto.TicketData
+	for _, cred := range creds {
+		if cred.matches(clientId, kind, cred.serverId()) {
+			tickets = append(tickets, cred.ticketData())
+		}
+	}
+	return tickets, nil
+}
+
+func (c fileCCache) DeleteTicket(clientId string, kind TicketKind, targetId string) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	defaultPrincipal, creds, err := c.load()
+	if err != nil {
+		return err
+	}
+
+	creds = slices.DeleteFunc(creds, func(cc ccCredential) bool { return cc.matches(clientId, kind, targetId) })
+	return c.store(defaultPrincipal, creds)
+}
+
+// load reads the cache, a missing file is an empty cache
+func (c fileCCache) load() (ccPrincipal, []ccCredential, error) {
+	data, err := os.ReadFile(filepath.Clean(c.path))
+	if errors.Is(err, os.ErrNotExist) {
+		return ccPrincipal{}, nil, nil
+	}
+	if err != nil {
+		return ccPrincipal{}, nil, err
+	}
+
+	defaultPrincipal, creds, err := parseCCache(data)
+	if err != nil {
+		return ccPrincipal{}, nil, fmt.Errorf("credential cache %s: %w", c.path, err)
+	}
+	return defaultPrincipal, creds, nil
+}
+
+// lock takes the lock of the writers of the cache, the returned function releases it
+func (c fileCCache) lock() (func(), error) {
+	file, err := os.OpenFile(filepath.Clean(c.path)+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("credential cache %s: can't lock: %w", c.path, err)
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// store writes the cache to a temporary file of its directory renamed over the old one, so a reader never sees
+// half a cache. The caller holds the lock
+func (c fileCCache) store(defaultPrincipal ccPrincipal, creds []ccCredential) error {
+	path := filepath.Clean(c.path)
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(marshalCCache(defaultPrincipal, creds))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// newCCCredential converts the ticket of clientId, times are truncated to seconds
+func newCCCredential(clientId string, kind TicketKind, data dto.TicketData) ccCredential {
+	server := ccPrincipal{
+		nameType:   ntPrincipal,
+		realm:      dto.PrincipalRealm(data.TargetId, config.Realm),
+		components: strings.Split(dto.PrincipalId(data.TargetId), "/"),
+	}
+	if kind == KindTGS {
+		server.nameType = ntSrvInst
+		server.components = []string{"krbtgt", dto.PrincipalId(data.TargetId)}
+	}
+
+	cred := ccCredential{
+		client: ccPrincipal{
+			nameType:   ntPrincipal,
+			realm:      dto.PrincipalRealm(clientId, config.Realm),
+			components: strings.Split(dto.PrincipalId(clientId), "/"),
+		},
+		server:    server,
+		enctype:   data.Enctype.FileNumber(),
+		key:       data.Key,
+		authTime:  uint32(data.Timestamp / 1000),
+		startTime: uint32(data.Timestamp / 1000),
+		endTime:   uint32((data.Timestamp + data.Lifetime) / 1000),
+		renewTill: uint32(data.RenewTill / 1000),
+		flags:     bits.Reverse32(uint32(data.Flags)),
+		ticket:    data.EncryptedTicket,
+	}
+
+	if data.Kvno != 0 {
+		cred.authData = append(cred.authData, ccTagged{tag: adKvno, data: binary.BigEndian.AppendUint32(nil, uint32(data.Kvno))})
+	}
+	if len(data.EncTicketMac) != 0 {
+		cred.authData = append(cred.authData, ccTagged{tag: adTicketMac, data: data.EncTicketMac})
+	}
+
+	return cred
+}
+
+func (cred ccCredential) ticketData() dto.TicketData {
+	enctype, _ := security.EnctypeFromFile(cred.enctype)
+	data := dto.TicketData{
+		Key:             cred.key,
+		Enctype:         enctype,
+		TargetId:        cred.serverId(),
+		Timestamp:       int64(cred.startTime) * 1000,
+		Lifetime:        (int64(cred.endTime) - int64(cred.startTime)) * 1000,
+		RenewTill:       int64(cred.renewTill) * 1000,
+		Flags:           dto.TicketFlags(bits.Reverse32(cred.flags)),
+		EncryptedTicket: cred.ticket,
+		EncTicketMac:    []byte{},
+	}
+
+	for _, ad := range cred.authData {
+		switch {
+		case ad.tag == adKvno && len(ad.data) == 4:
+			data.Kvno = int(binary.BigEndian.Uint32(ad.data))
+		case ad.tag == adTicketMac:
+			data.EncTicketMac = ad.data
+		}
+	}
+
+	return data
+}
+
+// serverId returns the ID of the target of the ticket, qualified with its realm if it's not the local one
+func (cred ccCredential) serverId() string {
+	id := strings.Join(cred.server.components, "/")
+	if cred.isTGS() {
+		id = cred.server.components[1]
+	}
+	if cred.server.realm != config.Realm {
+		id += "@" + cred.server.realm
+	}
+	return id
+}
+
+func (cred ccCredential) isTGS() bool {
+	return len(cred.server.components) == 2 && cred.server.components[0] == "krbtgt"
+}
+
+// matches reports whether cred is the ticket of clientId for targetId, with an enctype of this implementation
+func (cred ccCredential) matches(clientId string, kind TicketKind, targetId string) bool {
+	client := strings.Join(cred.client.components, "/") + "@" + cred.client.realm
+	_, ownEnctype := security.EnctypeFromFile(cred.enctype)
+	return ownEnctype && cred.isTGS() == (kind == KindTGS) &&
+		dto.SamePrincipal(client, clientId, config.Realm) &&
+		dto.SamePrincipal(cred.serverId(), targetId, config.Realm)
+}
+
+func parseCCache(data []byte) (ccPrincipal, []ccCredential, error) {
+	r := &ccReader{r: bytes.NewReader(data)}
+	if version := r.uint16(); r.err != nil || version != ccacheVersion {
+		return ccPrincipal{}, nil, fmt.Errorf("not a ccache of version %#x", ccacheVersion)
+	}
+
+	//HEADERS (E.G. THE KDC TIME OFFSET) ARE NOT USED
+	headerLength := r.uint16()
+	r.bytes(int(headerLength))
+
+	defaultPrincipal := r.principal()
+	var creds []ccCredential
+	for r.err == nil && r.r.Len() > 0 {
+		var cred ccCredential
+		cred.client = r.principal()
+		cred.server = r.principal()
+		cred.enctype = r.uint16()
+		cred.key = r.data()
+		cred.authTime = r.uint32()
+		cred.startTime = r.uint32()
+		cred.endTime = r.uint32()
+		cred.renewTill = r.uint32()
+		cred.isSKey = r.uint8()
+		cred.flags = r.uint32()
+		cred.addresses = r.tagged()
+		cred.authData = r.tagged()
+		cred.ticket = r.data()
+		cred.secondTicket = r.data()
+		creds = append(creds, cred)
+	}
+
+	if r.err != nil {
+		return ccPrincipal{}, nil, r.err
+	}
+	return defaultPrincipal, creds, nil
+}
+
+func marshalCCache(defaultPrincipal ccPrincipal, creds []ccCredential) []byte {
+	w := &ccWriter{}
+	w.uint16(ccacheVersion)
+	w.uint16(0)
+	w.principal(defaultPrincipal)
+
+	for _, cred := range creds {
+		w.principal(cred.client)
+		w.principal(cred.server)
+		w.uint16(cred.enctype)
+		w.data(cred.key)
+		w.uint32(cred.authTime)
+		w.uint32(cred.startTime)
+		w.uint32(cred.endTime)
+		w.uint32(cred.renewTill)
+		w.buf.WriteByte(cred.isSKey)
+		w.uint32(cred.flags)
+		w.tagged(cred.addresses)
+		w.tagged(cred.authData)
+		w.data(cred.ticket)
+		w.data(cred.secondTicket)
+	}
+
+	return w.buf.Bytes()
+}
+
+// ccReader reads the fields of a ccache, after the first error it returns only zero values
+type ccReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *ccReader) read(v any) {
+	if r.err == nil {
+		r.err = binary.Read(r.r, binary.BigEndian, v)
+	}
+}
+
+func (r *ccReader) uint8() uint8 {
+	var v uint8
+	r.read(&v)
+	return v
+}
+
+func (r *ccReader) uint16() uint16 {
+	var v uint16
+	r.read(&v)
+	return v
+}
+
+func (r *ccReader) uint32() uint32 {
+	var v uint32
+	r.read(&v)
+	return v
+}
+
+func (r *ccReader) bytes(n int) []byte {
+	if r.err == nil && n > r.r.Len() {
+		r.err = errors.New("truncated ccache")
+	}
+	if r.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	r.r.Read(b)
+	return b
+}
+
+func (r *ccReader) data() []byte {
+	return r.bytes(int(r.uint32()))
+}
+
+func (r *ccReader) principal() ccPrincipal {
+	p := ccPrincipal{nameType: r.uint32()}
+	components := r.uint32()
+	p.realm = string(r.data())
+	for i := uint32(0); i < components && r.err == nil; i++ {
+		p.components = append(p.components, string(r.data()))
+	}
+	return p
+}
+
+func (r *ccReader) tagged() []ccTagged {
+	var values []ccTagged
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		values = append(values, ccTagged{tag: r.uint16(), data: r.data()})
+	}
+	return values
+}
+
+type ccWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *ccWriter) uint16(v uint16) {
+	binary.Write(&w.buf, binary.BigEndian, v)
+}
+
+func (w *ccWriter) uint32(v uint32) {
+	binary.Write(&w.buf, binary.BigEndian, v)
+}
+
+func (w *ccWriter) data(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *ccWriter) principal(p ccPrincipal) {
+	w.uint32(p.nameType)
+	w.uint32(uint32(len(p.components)))
+	w.data([]byte(p.realm))
+	for _, component := range p.components {
+		w.data([]byte(component))
+	}
+}
+
+func (w *ccWriter) tagged(values []ccTagged) {
+	w.uint32(uint32(len(values)))
+	for _, v := range values {
+		w.uint16(v.tag)
+		w.data(v.data)
+	}
+}
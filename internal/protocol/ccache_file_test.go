@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/security"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileCredCache(t *testing.T) {
+	ccacheFile := filepath.Join(t.TempDir(), "krb5cc")
+	t.Setenv(CCacheNameEnv, "FILE:"+ccacheFile)
+	cache, err := OpenCredCache()
+	if err != nil {
+		t.Fatalf("OpenCredCache: %v", err)
+	}
+
+	now := time.Now().UnixMilli() / 1000 * 1000
+	tgsTicket := dto.TicketData{Key: security.GenerateRandomKey(config.SymmKeyDim), Enctype: security.EnctypeAesGcm, Kvno: 3,
+		TargetId: "tgs1", Timestamp: now, Lifetime: 60000, RenewTill: now + 120000, Flags: dto.FlagRenewable | dto.FlagForwardable,
+		EncryptedTicket: []byte("tgs ticket"), EncTicketMac: []byte("tgs mac")}
+	serviceTicket := dto.TicketData{Key: security.GenerateRandomKey(config.SymmKeyDim), Enctype: security.EnctypeAesCbcHmac, Kvno: 1,
+		TargetId: "host/svc", Timestamp: now, Lifetime: 60000, EncryptedTicket: []byte("service ticket"), EncTicketMac: []byte{}}
+
+	if err := cache.SaveTicket("alice", KindTGS, tgsTicket); err != nil {
+		t.Fatalf("SaveTicket: %v", err)
+	}
+	if err := cache.SaveTicket("alice", KindService, serviceTicket); err != nil {
+		t.Fatalf("SaveTicket: %v", err)
+	}
+
+	//THE FILE IS A CCACHE OF VERSION 4 WITH ALICE AS DEFAULT PRINCIPAL
+	data, err := os.ReadFile(ccacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultPrincipal, creds, err := parseCCache(data)
+	if err != nil || !bytes.HasPrefix(data, []byte{0x05, 0x04}) || len(creds) != 2 {
+		t.Fatalf("got %d credentials, err %v", len(creds), err)
+	}
+	if defaultPrincipal.realm != config.Realm || len(defaultPrincipal.components) != 1 || defaultPrincipal.components[0] != "alice" {
+		t.Errorf("got default principal %+v, want alice@%s", defaultPrincipal, config.Realm)
+	}
+	if server := creds[0].server; server.nameType != ntSrvInst || server.components[0] != "krbtgt" || server.components[1] != "tgs1" {
+		t.Errorf("got TGS server %+v, want krbtgt/tgs1", server)
+	}
+
+	//THE ENCTYPES ARE WRITTEN WITH NUMBERS FOR LOCAL USE, 1 AND 2 ARE DES FOR MIT
+	for _, cred := range creds {
+		if int16(cred.enctype) >= 0 {
+			t.Errorf("enctype written as %d, want a number for local use", int16(cred.enctype))
+		}
+	}
+
+	for _, want := range []struct {
+		kind   TicketKind
+		ticket dto.TicketData
+	}{{KindTGS, tgsTicket}, {KindService, serviceTicket}} {
+		got, found, err := cache.GetTicket("alice@"+config.Realm, want.kind, want.ticket.TargetId)
+		if err != nil || !found {
+			t.Fatalf("GetTicket %s: found %v, err %v", want.ticket.TargetId, found, err)
+		}
+		if !reflect.DeepEqual(got, want.ticket) {
+			t.Errorf("got ticket %+v, want %+v", got, want.ticket)
+		}
+	}
+
+	//A SERVICE TICKET IS NOT A TGS TICKET
+	if _, found, _ := cache.GetTicket("alice", KindTGS, "host/svc"); found {
+		t.Error("service ticket returned as TGS ticket")
+	}
+
+	//AN EXPIRED TICKET IS DELETED
+	expired := tgsTicket
+	expired.Timestamp = now - 120000
+	if err := cache.SaveTicket("alice", KindTGS, expired); err != nil {
+		t.Fatalf("SaveTicket: %v", err)
+	}
+	if _, err := retriveTGSTicket(cache, "alice", "tgs1"); err == nil {
+		t.Error("expired ticket returned")
+	}
+	if _, found, _ := cache.GetTicket("alice", KindTGS, "tgs1"); found {
+		t.Error("expired ticket not deleted")
+	}
+	if _, found, _ := cache.GetTicket("alice", KindService, "host/svc"); !found {
+		t.Error("service ticket deleted with the TGS ticket")
+	}
+}
+
+func TestFileCredCacheConcurrentWriters(t *testing.T) {
+	dir := t.TempDir()
+	cache := fileCCache{path: filepath.Join(dir, "krb5cc")}
+
+	//EVERY WRITER KEEPS THE TICKETS SAVED BY THE OTHERS
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticket := dto.TicketData{Key: security.GenerateRandomKey(config.SymmKeyDim), Enctype: security.EnctypeAesGcm,
+				TargetId: "svc" + strconv.Itoa(i), Timestamp: time.Now().UnixMilli(), Lifetime: 60000, EncTicketMac: []byte{}}
+			if err := cache.SaveTicket("alice", KindService, ticket); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range 8 {
+		if _, found, err := cache.GetTicket("alice", KindService, "svc"+strconv.Itoa(i)); err != nil || !found {
+			t.Errorf("ticket for svc%d lost: %v", i, err)
+		}
+	}
+
+	//ONLY THE CACHE AND ITS LOCK FILE ARE LEFT
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Errorf("got %d files, want the cache and its lock file", len(files))
+	}
+}
+
+func TestListTickets(t *testing.T) {
+	caches := map[string]CredCache{
+		"FILE":   fileCCache{path: filepath.Join(t.TempDir(), "krb5cc")},
+		"SQLITE": sqliteCCache{dbPath: filepath.Join(t.TempDir(), "client.db")},
+	}
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			if sqlite, ok := cache.(sqliteCCache); ok {
+				if err := dao.InitNewClientDb(sqlite.dbPath); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			now := time.Now().UnixMilli() / 1000 * 1000
+			for _, ticket := range []struct {
+				clientId string
+				kind     TicketKind
+				targetId string
+			}{
+				{"alice", KindTGS, "tgs1"},
+				{"alice", KindTGS, "tgs2@OTHER.REALM"},
+				{"alice", KindService, "svc"},
+				{"bob", KindTGS, "tgs1"},
+			} {
+				data := dto.TicketData{Key: security.GenerateRandomKey(config.SymmKeyDim), Enctype: security.EnctypeAesGcm,
+					TargetId: ticket.targetId, Timestamp: now, Lifetime: 60000, EncryptedTicket: []byte("ticket"), EncTicketMac: []byte{}}
+				if err := cache.SaveTicket(ticket.clientId, ticket.kind, data); err != nil {
+					t.Fatalf("SaveTicket: %v", err)
+				}
+			}
+
+			//ONLY THE TGS TICKETS OF ALICE ARE LISTED
+			tickets, err := cache.ListTickets("alice", KindTGS)
+			if err != nil {
+				t.Fatalf("ListTickets: %v", err)
+			}
+			var targets []string
+			for _, ticket := range tickets {
+				targets = append(targets, ticket.TargetId)
+			}
+			slices.Sort(targets)
+			if !slices.Equal(targets, []string{"tgs1", "tgs2@OTHER.REALM"}) {
+				t.Errorf("got tickets for %v, want tgs1 and tgs2@OTHER.REALM", targets)
+			}
+		})
+	}
+}
@@ -1,11 +1,11 @@
 package protocol
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	config "simple_kerberos/configs"
-	"simple_kerberos/internal/dao"
 	"simple_kerberos/internal/dto"
 	"simple_kerberos/internal/kerrors"
 	"simple_kerberos/internal/messages"
@@ -14,13 +14,60 @@ import (
 	"time"
 )
 
-func RequestToAs(serverIp string, req messages.ASRequest, clientPwd string) (dto.TicketData, error) {
+// RequestToAs sends req to the first AS of serverIps that answers
+func RequestToAs(serverIps []string, req messages.ASRequest, clientPwd string) (dto.TicketData, error) {
 
-	clientKey, err := security.GenerateClientKeyFromPwd(clientPwd, config.SymmKeyDim)
+	//DERIVE THE KEY WITH THE DEFAULT SALT, THE AS TELLS THE RIGHT ONE IF IT IS DIFFERENT
+	params := security.DefaultStringToKeyParams(req.ClientId)
+	clientKey, err := security.GenerateClientKeyFromPwd(clientPwd, params, config.SymmKeyDim)
 	if err != nil {
 		return dto.TicketData{}, err
 	}
 
+	//ADVERTISE THE ENCTYPES SUPPORTED
+	if len(req.Enctypes) == 0 {
+		req.Enctypes = security.PermittedEnctypes()
+	}
+
+	//ADD NONCE
+	if req.Nonce == 0 {
+		req.Nonce, err = security.GenerateNonce()
+		if err != nil {
+			return dto.TicketData{}, err
+		}
+	}
+
+	ticketData, err := requestToAs(serverIps, req, clientKey, 0)
+	if hint := stringToKeyHint(err); hint != nil && !hint.Equal(params) {
+		if hintErr := security.CheckStringToKeyHint(*hint); hintErr != nil {
+			return dto.TicketData{}, &kerrors.PasswordError{Msg: "ERROR: " + hintErr.Error(), Err: err}
+		}
+
+		//RETRY WITH THE KEY DERIVED WITH THE SALT AND PARAMETERS STORED BY THE AS
+		clientKey, err = security.GenerateClientKeyFromPwd(clientPwd, *hint, config.SymmKeyDim)
+		if err != nil {
+			return dto.TicketData{}, err
+		}
+		ticketData, err = requestToAs(serverIps, req, clientKey, 0)
+	}
+	if offset, retry := retryOffset(err); retry {
+		//RETRY WITH THE PRE-AUTHENTICATION TIMESTAMP OF THE CLOCK OF THE AS
+		ticketData, err = requestToAs(serverIps, req, clientKey, offset)
+	}
+	return ticketData, err
+}
+
+func requestToAs(serverIps []string, req messages.ASRequest, clientKey []byte, clockOffset int64) (dto.TicketData, error) {
+
+	//ADD PRE-AUTHENTICATION DATA, WITH THE STRONGEST ENCTYPE SUPPORTED
+	req.PreAuthEnctype, _ = security.StrongestEnctype(req.Enctypes)
+	encPreAuth, preAuthMac, err := prepareEncryptedPreAuth(req.ClientId, req.PreAuthEnctype, clientKey, clockOffset)
+	if err != nil {
+		return dto.TicketData{}, err
+	}
+	req.EncryptedPreAuth = encPreAuth
+	req.EncPreAuthMac = preAuthMac
+
 	//MARSHAL REQ
 	jsonReq, err := json.Marshal(req)
 	if err != nil {
@@ -28,7 +75,7 @@ func RequestToAs(serverIp string, req messages.ASRequest, clientPwd string) (dto
 	}
 
 	//SEND REQUEST WAITING FOR REPLY
-	jsonReply, err := sendRequest(serverIp, config.AsPort, jsonReq)
+	jsonReply, err := sendRequestToKdcs(serverIps, config.Current().AsPort, jsonReq)
 	if err != nil {
 		return dto.TicketData{}, err
 	}
@@ -37,21 +84,15 @@ func RequestToAs(serverIp string, req messages.ASRequest, clientPwd string) (dto
 	var reply messages.Reply
 	err = json.Unmarshal(jsonReply, &reply)
 	if err != nil {
-		return dto.TicketData{}, err
+		return dto.TicketData{}, &kerrors.ReplyError{Msg: "ERROR: malformed reply", Err: err}
 	}
 
 	if reply.IsError {
-		return dto.TicketData{}, &kerrors.ReplyError{Msg: reply.Message}
-	}
-
-	//CHECK INTEGRITY
-	mac := security.MacData(reply.EncryptedData, clientKey)
-	if !bytes.Equal(mac, reply.EncDataMac) {
-		return dto.TicketData{}, &kerrors.ReplyError{Msg: "ERROR: Recieved hmac does not match with computed hmac. Data has been modified or wrong password provided"}
+		return dto.TicketData{}, replyError(reply)
 	}
 
-	//DECRYPT AND PARSE TICKET DATA
-	jsonTicketData, err := security.SymmetricDecryption(reply.EncryptedData, clientKey)
+	//CHECK INTEGRITY AND DECRYPT TICKET DATA
+	jsonTicketData, err := decryptReply(reply, clientKey, security.UsageASReply)
 	if err != nil {
 		return dto.TicketData{}, err
 	}
@@ -60,39 +101,56 @@ func RequestToAs(serverIp string, req messages.ASRequest, clientPwd string) (dto
 	err = json.Unmarshal(jsonTicketData, &ticketData)
 
 	if err != nil {
-		return dto.TicketData{}, &kerrors.PasswordError{Msg: "Wrong password"}
+		return dto.TicketData{}, &kerrors.PasswordError{Msg: "Wrong password", Err: err}
+	}
+
+	//CHECK NONCE
+	if ticketData.Nonce != req.Nonce {
+		return dto.TicketData{}, &kerrors.ReplyError{Msg: "ERROR: Got a nonce not matching the request from the AS, reply discarded"}
 	}
 	return ticketData, nil
 }
 
-func SaveTGSTicket(clientId string, data dto.TicketData) error {
-	db, err := dao.OpenDb(config.ClientDbPath)
-	if err != nil {
-		return err
+// stringToKeyHint returns the parameters of the key of the client carried by a pre-authentication error of the AS
+func stringToKeyHint(err error) *security.StringToKeyParams {
+	var pwdErr *kerrors.PasswordError
+	if errors.As(err, &pwdErr) {
+		return pwdErr.StringToKey
+	}
+	var preAuthErr *kerrors.PreAuthError
+	if errors.As(err, &preAuthErr) {
+		return preAuthErr.StringToKey
 	}
-	defer db.Close()
+	return nil
+}
 
-	exists, err := dao.TGSTicketExists(clientId, data.TargetId, db)
+func SaveTGSTicket(clientId string, data dto.TicketData) error {
+	cache, err := OpenCredCache()
 	if err != nil {
 		return err
 	}
-
-	if exists {
-		return dao.UpdateTGSTicket(clientId, data, db)
-	} else {
-		return dao.InsertTGSTicket(clientId, data, db)
-	}
-
+	return cache.SaveTicket(clientId, KindTGS, data)
 }
 
 func RetriveTGSTicket(clientId string, tgsId string) (dto.TicketData, error) {
-	db, err := dao.OpenDb(config.ClientDbPath)
+	cache, err := OpenCredCache()
 	if err != nil {
 		return dto.TicketData{}, err
 	}
-	defer db.Close()
+	return retriveTGSTicket(cache, clientId, tgsId)
+}
+
+// RetriveTGSTickets returns all the TGS tickets of clientId in the credential cache, expired ones too
+func RetriveTGSTickets(clientId string) ([]dto.TicketData, error) {
+	cache, err := OpenCredCache()
+	if err != nil {
+		return nil, err
+	}
+	return cache.ListTickets(clientId, KindTGS)
+}
 
-	exists, err := dao.TGSTicketExists(clientId, tgsId, db)
+func retriveTGSTicket(cache CredCache, clientId string, tgsId string) (dto.TicketData, error) {
+	ticketData, exists, err := cache.GetTicket(clientId, KindTGS, tgsId)
 	if err != nil {
 		return dto.TicketData{}, err
 	}
@@ -101,14 +159,8 @@ func RetriveTGSTicket(clientId string, tgsId string) (dto.TicketData, error) {
 		return dto.TicketData{}, &kerrors.TokenError{Msg: "ERROR: No ticket found for " + clientId + " and TGS " + tgsId + ". Authentication with AS needed"}
 	}
 
-	ticketData, err := dao.GetTGSTicket(clientId, tgsId, db)
-
-	if err != nil {
-		return dto.TicketData{}, err
-	}
-
-	if ticketData.Timestamp > time.Now().UnixMilli()+ticketData.Lifetime {
-		dao.DeleteTGSTicket(clientId, tgsId, db)
+	if time.Now().UnixMilli() > ticketData.Timestamp+ticketData.Lifetime {
+		cache.DeleteTicket(clientId, KindTGS, tgsId)
 		return dto.TicketData{}, &kerrors.TokenError{Msg: "ERROR: Ticket for " + clientId + " and TGS " + tgsId + " is expired. Old ticket deleted. Authentication with AS needed"}
 	}
 
@@ -117,13 +169,12 @@ func RetriveTGSTicket(clientId string, tgsId string) (dto.TicketData, error) {
 }
 
 func RetriveServiceTicket(clientId string, serviceId string) (dto.TicketData, error) {
-	db, err := dao.OpenDb(config.ClientDbPath)
+	cache, err := OpenCredCache()
 	if err != nil {
 		return dto.TicketData{}, err
 	}
-	defer db.Close()
 
-	exists, err := dao.ServiceTicketExists(clientId, serviceId, db)
+	ticketData, exists, err := cache.GetTicket(clientId, KindService, serviceId)
 	if err != nil {
 		return dto.TicketData{}, err
 	}
@@ -132,14 +183,8 @@ func RetriveServiceTicket(clientId string, serviceId string) (dto.TicketData, er
 		return dto.TicketData{}, &kerrors.TokenError{Msg: "ERROR: No ticket found for " + clientId + " and service " + serviceId + ". Authentication with TGS needed"}
 	}
 
-	ticketData, err := dao.GetServiceTicket(clientId, serviceId, db)
-
-	if err != nil {
-		return dto.TicketData{}, err
-	}
-
-	if ticketData.Timestamp > time.Now().UnixMilli()+ticketData.Lifetime {
-		dao.DeleteServiceTicket(clientId, serviceId, db)
+	if time.Now().UnixMilli() > ticketData.Timestamp+ticketData.Lifetime {
+		cache.DeleteTicket(clientId, KindService, serviceId)
 		return dto.TicketData{}, &kerrors.TokenError{Msg: "ERROR: Ticket for " + clientId + " and service " + serviceId + " is expired. Old ticket deleted. Authentication with TGS needed"}
 	}
 
@@ -149,40 +194,105 @@ func RetriveServiceTicket(clientId string, serviceId string) (dto.TicketData, er
 
 func PrepareTGSRequest(serverIp string, clientId string, serviceId string, ticketData dto.TicketData) (messages.TGSRequest, error) {
 
-	_, encryptedAuth, err := prepareEncryptedAuthenticator(serverIp, clientId, ticketData.Key)
+	_, encryptedAuth, authMac, err := prepareEncryptedAuthenticator(serverIp, clientId, ticketData.Enctype, ticketData.Key)
+	if err != nil {
+		return messages.TGSRequest{}, err
+	}
+
+	nonce, err := security.GenerateNonce()
 	if err != nil {
 		return messages.TGSRequest{}, err
 	}
 
 	req := messages.TGSRequest{
 		ServiceId:              serviceId,
+		Nonce:                  nonce,
+		Enctypes:               security.PermittedEnctypes(),
+		TicketRealm:            ticketData.IssuerRealm,
+		Enctype:                ticketData.Enctype,
+		Kvno:                   ticketData.Kvno,
 		EncryptedTicket:        ticketData.EncryptedTicket,
 		EncTicketMac:           ticketData.EncTicketMac,
 		EncryptedAuthenticator: encryptedAuth,
-		EncAuthenticatorMac:    security.MacData(encryptedAuth, ticketData.Key),
+		EncAuthenticatorMac:    authMac,
+	}
+
+	return req, nil
+}
+
+// PrepareTGSRenewRequest builds a request asking the TGS to reissue the given TGS ticket with a fresh validity period
+func PrepareTGSRenewRequest(serverIp string, clientId string, ticketData dto.TicketData) (messages.TGSRequest, error) {
+
+	if !ticketData.Flags.Has(dto.FlagRenewable) {
+		return messages.TGSRequest{}, &kerrors.TokenError{Msg: "ERROR: Ticket for " + clientId + " and TGS " + ticketData.TargetId + " is not renewable. Authentication with AS needed"}
+	}
+	if time.Now().UnixMilli() >= ticketData.RenewTill {
+		return messages.TGSRequest{}, &kerrors.TokenError{Msg: "ERROR: Ticket for " + clientId + " and TGS " + ticketData.TargetId + " can't be renewed anymore. Authentication with AS needed"}
+	}
+
+	req, err := PrepareTGSRequest(serverIp, clientId, ticketData.TargetId, ticketData)
+	if err != nil {
+		return messages.TGSRequest{}, err
+	}
+	req.Renew = true
+
+	return req, nil
+}
+
+// PrepareTGSValidateRequest builds a request asking the TGS to validate a postdated TGS ticket whose start time has come
+func PrepareTGSValidateRequest(serverIp string, clientId string, ticketData dto.TicketData) (messages.TGSRequest, error) {
+
+	if !ticketData.Flags.Has(dto.FlagInvalid) {
+		return messages.TGSRequest{}, &kerrors.TokenError{Msg: "ERROR: Ticket for " + clientId + " and TGS " + ticketData.TargetId + " doesn't need to be validated"}
+	}
+	if time.Now().UnixMilli() < ticketData.Timestamp {
+		return messages.TGSRequest{}, &kerrors.TokenError{Msg: "ERROR: Ticket for " + clientId + " and TGS " + ticketData.TargetId + " is postdated and can't be validated before " + time.UnixMilli(ticketData.Timestamp).Format(time.DateTime)}
+	}
+
+	req, err := PrepareTGSRequest(serverIp, clientId, ticketData.TargetId, ticketData)
+	if err != nil {
+		return messages.TGSRequest{}, err
 	}
+	req.Validate = true
 
 	return req, nil
 }
 
 func PrepareServiceRequest(serverIp string, clientId string, serviceId string, ticketData dto.TicketData) (messages.ServiceRequest, int64, error) {
 
-	auth, encryptedAuth, err := prepareEncryptedAuthenticator(serverIp, clientId, ticketData.Key)
+	auth, encryptedAuth, authMac, err := prepareEncryptedAuthenticator(serverIp, clientId, ticketData.Enctype, ticketData.Key)
 	if err != nil {
 		return messages.ServiceRequest{}, -1, err
 	}
 
 	req := messages.ServiceRequest{
+		Enctype:                ticketData.Enctype,
+		Kvno:                   ticketData.Kvno,
 		EncryptedTicket:        ticketData.EncryptedTicket,
 		EncTicketMac:           ticketData.EncTicketMac,
 		EncryptedAuthenticator: encryptedAuth,
-		EncAuthenticatorMac:    security.MacData(encryptedAuth, ticketData.Key),
+		EncAuthenticatorMac:    authMac,
 	}
 
 	return req, auth.Timestamp, nil
 }
 
-func RequestToTgs(serverIp string, req messages.TGSRequest, tgsTicketData dto.TicketData) (dto.TicketData, error) {
+// RequestToTgs sends req to the first TGS of serverIps that answers. If the TGS replies with a clock skew error,
+// the request is sent again with the authenticator timestamp of the clock of the TGS
+func RequestToTgs(serverIps []string, req messages.TGSRequest, tgsTicketData dto.TicketData) (dto.TicketData, error) {
+
+	ticketData, err := requestToTgs(serverIps, req, tgsTicketData)
+	if offset, retry := retryOffset(err); retry {
+		req.EncryptedAuthenticator, req.EncAuthenticatorMac, _, err = refreshAuthenticator(req.EncryptedAuthenticator, req.EncAuthenticatorMac, tgsTicketData.Enctype, tgsTicketData.Key, offset)
+		if err != nil {
+			return dto.TicketData{}, err
+		}
+		ticketData, err = requestToTgs(serverIps, req, tgsTicketData)
+	}
+	return ticketData, err
+}
+
+func requestToTgs(serverIps []string, req messages.TGSRequest, tgsTicketData dto.TicketData) (dto.TicketData, error) {
 
 	//MARSHAL REQ
 	jsonReq, err := json.Marshal(req)
@@ -191,7 +301,7 @@ func RequestToTgs(serverIp string, req messages.TGSRequest, tgsTicketData dto.Ti
 	}
 
 	//SEND REQUEST WAITING FOR REPLY
-	jsonReply, err := sendRequest(serverIp, config.TgsPort, jsonReq)
+	jsonReply, err := sendRequestToKdcs(serverIps, config.Current().TgsPort, jsonReq)
 	if err != nil {
 		return dto.TicketData{}, err
 	}
@@ -200,21 +310,15 @@ func RequestToTgs(serverIp string, req messages.TGSRequest, tgsTicketData dto.Ti
 	var reply messages.Reply
 	err = json.Unmarshal(jsonReply, &reply)
 	if err != nil {
-		return dto.TicketData{}, err
+		return dto.TicketData{}, &kerrors.ReplyError{Msg: "ERROR: malformed reply", Err: err}
 	}
 
 	if reply.IsError {
-		return dto.TicketData{}, &kerrors.ReplyError{Msg: reply.Message}
+		return dto.TicketData{}, replyError(reply)
 	}
 
-	//CHECK INTEGRITY
-	mac := security.MacData(reply.EncryptedData, tgsTicketData.Key)
-	if !bytes.Equal(mac, reply.EncDataMac) {
-		return dto.TicketData{}, &kerrors.ReplyError{Msg: "ERROR: Recieved hmac does not match with computed hmac. Data has been modified or wrong password provided"}
-	}
-
-	//DECRYPT AND PARSE TICKET DATA
-	jsonTicketData, err := security.SymmetricDecryption(reply.EncryptedData, tgsTicketData.Key)
+	//CHECK INTEGRITY AND DECRYPT TICKET DATA
+	jsonTicketData, err := decryptReply(reply, tgsTicketData.Key, security.UsageTGSReply)
 	if err != nil {
 		return dto.TicketData{}, err
 	}
@@ -223,13 +327,33 @@ func RequestToTgs(serverIp string, req messages.TGSRequest, tgsTicketData dto.Ti
 	err = json.Unmarshal(jsonTicketData, &serviceTicketData)
 
 	if err != nil {
-		return dto.TicketData{}, &kerrors.PasswordError{Msg: "Wrong key used to decrypt"}
+		return dto.TicketData{}, &kerrors.PasswordError{Msg: "Wrong key used to decrypt", Err: err}
+	}
+
+	//CHECK NONCE
+	if serviceTicketData.Nonce != req.Nonce {
+		return dto.TicketData{}, &kerrors.ReplyError{Msg: "ERROR: Got a nonce not matching the request from the TGS, reply discarded"}
 	}
 	return serviceTicketData, nil
 }
 
+// RequestToService sends req to the service, currentTimestamp is the timestamp of the authenticator. If the service
+// replies with a clock skew error, the request is sent again with the authenticator timestamp of the clock of the service
 func RequestToService(serverIp string, serverPort int, req messages.ServiceRequest, serviceTicketData dto.TicketData, currentTimestamp int64) (string, error) {
 
+	msg, err := requestToService(serverIp, serverPort, req, serviceTicketData, currentTimestamp)
+	if offset, retry := retryOffset(err); retry {
+		req.EncryptedAuthenticator, req.EncAuthenticatorMac, currentTimestamp, err = refreshAuthenticator(req.EncryptedAuthenticator, req.EncAuthenticatorMac, serviceTicketData.Enctype, serviceTicketData.Key, offset)
+		if err != nil {
+			return "", err
+		}
+		msg, err = requestToService(serverIp, serverPort, req, serviceTicketData, currentTimestamp)
+	}
+	return msg, err
+}
+
+func requestToService(serverIp string, serverPort int, req messages.ServiceRequest, serviceTicketData dto.TicketData, currentTimestamp int64) (string, error) {
+
 	//MARSHAL REQ
 	jsonReq, err := json.Marshal(req)
 	if err != nil {
@@ -246,21 +370,15 @@ func RequestToService(serverIp string, serverPort int, req messages.ServiceReque
 	var reply messages.Reply
 	err = json.Unmarshal(jsonReply, &reply)
 	if err != nil {
-		return "", err
+		return "", &kerrors.ReplyError{Msg: "ERROR: malformed reply", Err: err}
 	}
 
 	if reply.IsError {
-		return "", &kerrors.ReplyError{Msg: reply.Message}
+		return "", replyError(reply)
 	}
 
-	//CHECK INTEGRITY
-	mac := security.MacData(reply.EncryptedData, serviceTicketData.Key)
-	if !bytes.Equal(mac, reply.EncDataMac) {
-		return "", &kerrors.ReplyError{Msg: "ERROR: Recieved hmac does not match with computed hmac. Data has been modified or wrong key used"}
-	}
-
-	//DECRYPT AND PARSE TICKET DATA
-	jsonServiceReply, err := security.SymmetricDecryption(reply.EncryptedData, serviceTicketData.Key)
+	//CHECK INTEGRITY AND DECRYPT SERVICE REPLY
+	jsonServiceReply, err := decryptReply(reply, serviceTicketData.Key, security.UsageServiceReply)
 	if err != nil {
 		return "", err
 	}
@@ -268,7 +386,7 @@ func RequestToService(serverIp string, serverPort int, req messages.ServiceReque
 	var serviceReply messages.ServiceReply
 	err = json.Unmarshal(jsonServiceReply, &serviceReply)
 	if err != nil {
-		return "", &kerrors.PasswordError{Msg: "Wrong key used to decrypt"}
+		return "", &kerrors.PasswordError{Msg: "Wrong key used to decrypt", Err: err}
 	}
 	if currentTimestamp != serviceReply.Timestamp-1 {
 		return "", &kerrors.ReplyError{Msg: "ERROR: Got incorrect timestamp from the server, reply discarded"}
@@ -277,8 +395,58 @@ func RequestToService(serverIp string, serverPort int, req messages.ServiceReque
 	return reply.Message, nil
 }
 
+// sendRequestToKdcs sends the request to the KDCs in order, moving on to the next one when a KDC doesn't answer
+func sendRequestToKdcs(serverIps []string, serverPort int, jsonReq []byte) ([]byte, error) {
+
+	var err error = &kerrors.NetworkError{Msg: "ERROR: no KDC address provided"}
+	for i, serverIp := range serverIps {
+		var jsonReply []byte
+		jsonReply, err = sendRequest(serverIp, serverPort, jsonReq)
+
+		var timeoutErr *kerrors.TimeoutError
+		var networkErr *kerrors.NetworkError
+		if !errors.As(err, &timeoutErr) && !errors.As(err, &networkErr) {
+			return jsonReply, err
+		}
+		if i < len(serverIps)-1 {
+			fmt.Println(err.Error() + ", trying " + serverIps[i+1])
+		}
+	}
+
+	return nil, err
+}
+
+// sendRequest sends the request to serverIp, retransmitting it with a doubled timeout every time no reply
+// comes back in time
 func sendRequest(serverIp string, serverPort int, jsonReq []byte) ([]byte, error) {
 
+	timeout := time.Duration(config.RequestTimeout) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		jsonReply, err := sendRequestOnce(serverIp, serverPort, jsonReq, timeout)
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if attempt > config.RequestRetries {
+				return nil, &kerrors.TimeoutError{Msg: "ERROR: no reply from " + serverIp + ":" + fmt.Sprint(serverPort) + " after " + fmt.Sprint(attempt) + " attempts", Err: err}
+			}
+			timeout *= 2
+			continue
+		}
+		if err != nil {
+			return nil, &kerrors.NetworkError{Msg: "ERROR: can't reach " + serverIp + ":" + fmt.Sprint(serverPort), Err: err}
+		}
+
+		return jsonReply, nil
+	}
+}
+
+func sendRequestOnce(serverIp string, serverPort int, jsonReq []byte, timeout time.Duration) ([]byte, error) {
+
+	//REQUESTS THAT DON'T FIT IN A UDP DATAGRAM GO OVER TCP
+	if len(jsonReq) > config.Current().MaxMessageSize {
+		return sendTCPRequest(serverIp, serverPort, jsonReq, timeout)
+	}
+
 	serverAddr := net.UDPAddr{
 		Port: serverPort,
 		IP:   net.ParseIP(serverIp),
@@ -295,49 +463,124 @@ func sendRequest(serverIp string, serverPort int, jsonReq []byte) ([]byte, error
 	}
 
 	//SEND REQUEST WAITING FOR REPLY
-	return network.SendUDPRequest(&localAddr, &serverAddr, jsonReq, 1024)
+	jsonReply, err := network.SendUDPRequest(&localAddr, &serverAddr, jsonReq, config.Current().MaxMessageSize, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	//RETRY OVER TCP IF THE REPLY IS TOO BIG FOR UDP
+	var reply messages.Reply
+	if json.Unmarshal(jsonReply, &reply) == nil && reply.IsError && reply.ErrorCode == messages.ErrResponseTooBig {
+		return sendTCPRequest(serverIp, serverPort, jsonReq, timeout)
+	}
+
+	return jsonReply, nil
 }
 
-func SaveServiceTicket(clientId string, data dto.TicketData) error {
-	db, err := dao.OpenDb(config.ClientDbPath)
-	if err != nil {
-		return err
+// replyError converts an error reply to the kerrors type of its code, so that callers can tell the reasons apart
+// with errors.As
+func replyError(reply messages.Reply) error {
+	switch reply.ErrorCode {
+	case messages.ErrPreAuthRequired:
+		return &kerrors.PreAuthError{Msg: reply.Message, Code: reply.ErrorCode, StringToKey: reply.StringToKey}
+	case messages.ErrPreAuthFailed:
+		return &kerrors.PasswordError{Msg: reply.Message, Code: reply.ErrorCode, StringToKey: reply.StringToKey}
+	case messages.ErrClientUnknown, messages.ErrServerUnknown:
+		return &kerrors.PrincipalUnknownError{Msg: reply.Message, Code: reply.ErrorCode}
+	case messages.ErrTicketExpired, messages.ErrBadKeyVer:
+		return &kerrors.TicketExpiredError{Msg: reply.Message, Code: reply.ErrorCode}
+	case messages.ErrTicketNotYetValid:
+		return &kerrors.TicketNotYetValidError{Msg: reply.Message, Code: reply.ErrorCode}
+	case messages.ErrRepeat:
+		return &kerrors.ReplayError{Msg: reply.Message, Code: reply.ErrorCode}
+	case messages.ErrSkew:
+		return &kerrors.ClockSkewError{Msg: reply.Message, Code: reply.ErrorCode, ServerTime: reply.ServerTime}
+	case messages.ErrBadIntegrity, messages.ErrModified, messages.ErrBadMatch:
+		return &kerrors.IntegrityError{Msg: reply.Message, Code: reply.ErrorCode}
+	case messages.ErrCannotPostdate, messages.ErrNeverValid, messages.ErrPolicy, messages.ErrBadOption, messages.ErrEtypeNoSupp, messages.ErrPathNotAccepted:
+		return &kerrors.PolicyError{Msg: reply.Message, Code: reply.ErrorCode}
+	default:
+		return &kerrors.ReplyError{Msg: reply.Message, Code: reply.ErrorCode}
 	}
-	defer db.Close()
+}
 
-	exists, err := dao.ServiceTicketExists(clientId, data.TargetId, db)
+func sendTCPRequest(serverIp string, serverPort int, jsonReq []byte, timeout time.Duration) ([]byte, error) {
+
+	serverAddr := net.TCPAddr{
+		Port: serverPort,
+		IP:   net.ParseIP(serverIp),
+	}
+
+	localIp, err := network.GetActiveIP(serverIp)
 	if err != nil {
-		return err
+		return []byte{}, err
 	}
 
-	if exists {
-		return dao.UpdateServiceTicket(clientId, data, db)
-	} else {
-		return dao.InsertServiceTicket(clientId, data, db)
+	localAddr := net.TCPAddr{
+		Port: 0,
+		IP:   localIp,
 	}
 
+	return network.SendTCPRequest(&localAddr, &serverAddr, jsonReq, config.Current().MaxTCPMessageSize, timeout)
+}
+
+func SaveServiceTicket(clientId string, data dto.TicketData) error {
+	cache, err := OpenCredCache()
+	if err != nil {
+		return err
+	}
+	return cache.SaveTicket(clientId, KindService, data)
 }
 
-func prepareEncryptedAuthenticator(serverIp string, clientId string, encryptionKey []byte) (dto.Authenticator, []byte, error) {
+func prepareEncryptedAuthenticator(serverIp string, clientId string, enctype security.Enctype, encryptionKey []byte) (dto.Authenticator, []byte, []byte, error) {
 	localIp, err := network.GetActiveIP(serverIp)
 	if err != nil {
-		return dto.Authenticator{}, nil, err
+		return dto.Authenticator{}, nil, nil, err
 	}
 
 	auth := dto.Authenticator{
-		ClientId:      clientId,
+		ClientId:      dto.QualifyPrincipal(clientId, config.Realm),
 		ClientAddress: localIp.String(),
 		Timestamp:     time.Now().UnixMilli(),
 	}
 
 	jsonAuth, err := json.Marshal(auth)
 	if err != nil {
-		return dto.Authenticator{}, nil, err
+		return dto.Authenticator{}, nil, nil, err
 	}
 
-	encAuth, err := security.SymmetricEncryption(jsonAuth, encryptionKey)
+	encAuth, authMac, err := security.Encrypt(enctype, encryptionKey, security.UsageAuthenticator, jsonAuth)
+	if err != nil {
+		return dto.Authenticator{}, nil, nil, err
+	}
+	return auth, encAuth, authMac, nil
+}
+
+func prepareEncryptedPreAuth(clientId string, enctype security.Enctype, clientKey []byte, clockOffset int64) ([]byte, []byte, error) {
+	preAuth := dto.PreAuthData{
+		ClientId:  clientId,
+		Timestamp: time.Now().UnixMilli() + clockOffset,
+	}
+
+	jsonPreAuth, err := json.Marshal(preAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return security.Encrypt(enctype, clientKey, security.UsagePreAuth, jsonPreAuth)
+}
+
+// decryptReply checks the integrity of the data of a reply and decrypts it with key
+func decryptReply(reply messages.Reply, key []byte, usage security.Usage) ([]byte, error) {
+	data, err := security.Decrypt(reply.Enctype, key, usage, reply.EncryptedData, reply.EncDataMac)
+	if errors.Is(err, security.ErrModified) {
+		return nil, &kerrors.IntegrityError{Msg: "ERROR: integrity check of the reply failed. Data has been modified or wrong key or password used", Code: messages.ErrModified}
+	}
+	if errors.Is(err, security.ErrUnsupportedEnctype) {
+		return nil, &kerrors.PolicyError{Msg: "ERROR: the reply uses enctype " + reply.Enctype.String() + ", which is not permitted", Code: messages.ErrEtypeNoSupp}
+	}
 	if err != nil {
-		return dto.Authenticator{}, nil, err
+		return nil, &kerrors.IntegrityError{Msg: "ERROR: can't decrypt the reply", Code: messages.ErrBadIntegrity, Err: err}
 	}
-	return auth, encAuth, nil
+	return data, nil
 }
@@ -0,0 +1,523 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/kerrors"
+	"simple_kerberos/internal/messages"
+	"simple_kerberos/internal/security"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testAdminPwd = "admin"
+
+// setupAS creates an AS db with alice (password "secret") and tgs1, and serves it on a random port of 127.0.0.1.
+// edit, if not nil, changes every reply before it is sent
+func setupAS(t *testing.T, edit func(reply []byte) []byte) {
+	t.Helper()
+	saveConfig(t)
+	config.AsDbPath = filepath.Join(t.TempDir(), "as.db")
+
+	db, err := dao.OpenEncryptedASDb(config.AsDbPath, testAdminPwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	params := security.DefaultStringToKeyParams("alice")
+	clientKey, err := security.GenerateClientKeyFromPwd("secret", params, config.SymmKeyDim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dao.InsertClient("alice", clientKey, params, true, 0, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := dao.InsertTGS("tgs1", security.GenerateRandomKey(config.SymmKeyDim), 1, db); err != nil {
+		t.Fatal(err)
+	}
+
+	asPort := fakeServer(t, func(req []byte, clientAddr *net.UDPAddr) []byte {
+		reply, err := asRequestHandler(req, clientAddr, testAdminPwd)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		if edit != nil {
+			reply = edit(reply)
+		}
+		return reply
+	})
+	config.Update(func(s *config.Settings) { s.AsPort = asPort })
+}
+
+// fakeServer serves UDP requests on a random port of 127.0.0.1 until the end of the test, nil replies are not sent
+func fakeServer(t *testing.T, handler func(req []byte, clientAddr *net.UDPAddr) []byte) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, config.Current().MaxMessageSize)
+		for {
+			n, clientAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if reply := handler(buffer[:n], clientAddr); reply != nil {
+				conn.WriteToUDP(reply, clientAddr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func saveConfig(t *testing.T) {
+	settings := config.Current()
+	asDbPath, timeout, retries := config.AsDbPath, config.RequestTimeout, config.RequestRetries
+	stringToKey, iterations, argon2Time, argon2Memory, scryptN := config.StringToKey, config.StringToKeyIterations, config.Argon2Time, config.Argon2Memory, config.ScryptN
+	t.Cleanup(func() {
+		config.AsDbPath, config.RequestTimeout, config.RequestRetries = asDbPath, timeout, retries
+		config.StringToKey, config.StringToKeyIterations, config.Argon2Time, config.Argon2Memory, config.ScryptN = stringToKey, iterations, argon2Time, argon2Memory, scryptN
+		config.Update(func(s *config.Settings) { *s = *settings })
+	})
+}
+
+func asRequest(clientId string) messages.ASRequest {
+	return messages.ASRequest{ClientId: clientId, TGSId: "tgs1", Timestamp: time.Now().UnixMilli()}
+}
+
+func TestRequestToAsOk(t *testing.T) {
+	setupAS(t, nil)
+
+	ticketData, err := RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "secret")
+	if err != nil {
+		t.Fatalf("RequestToAs: %v", err)
+	}
+	if ticketData.TargetId != "tgs1" {
+		t.Errorf("got a ticket for %q, want tgs1", ticketData.TargetId)
+	}
+}
+
+func TestRequestToAsBadPassword(t *testing.T) {
+	setupAS(t, nil)
+
+	_, err := RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "wrong")
+
+	var pwdErr *kerrors.PasswordError
+	if !errors.As(err, &pwdErr) {
+		t.Fatalf("got %T (%v), want *kerrors.PasswordError", err, err)
+	}
+	if !errors.Is(err, &kerrors.PasswordError{}) {
+		t.Error("errors.Is doesn't match *kerrors.PasswordError")
+	}
+	if !errors.Is(err, &kerrors.ReplyError{Code: messages.ErrPreAuthFailed}) {
+		t.Error("bad password refused by the AS is not a ReplyError with its code")
+	}
+	if errors.Is(err, &kerrors.NetworkError{}) {
+		t.Error("bad password classified as another error")
+	}
+}
+
+func TestRequestToAsNonceMismatch(t *testing.T) {
+	//THE AS ANSWERS EVERY REQUEST WITH THE REPLY TO THE FIRST ONE, AS AN ATTACKER REPLAYING AN OLD REPLY
+	var first []byte
+	setupAS(t, func(reply []byte) []byte {
+		if first == nil {
+			first = reply
+		}
+		return first
+	})
+
+	if _, err := RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "secret"); err != nil {
+		t.Fatalf("RequestToAs: %v", err)
+	}
+	_, err := RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "secret")
+
+	var replyErr *kerrors.ReplyError
+	if !errors.As(err, &replyErr) || !strings.Contains(replyErr.Msg, "nonce") {
+		t.Fatalf("got %T (%v), want the old reply discarded for its nonce", err, err)
+	}
+}
+
+func TestRequestToAsMacMismatch(t *testing.T) {
+	setupAS(t, func(jsonReply []byte) []byte {
+		var reply messages.Reply
+		json.Unmarshal(jsonReply, &reply)
+		reply.EncryptedData[0] ^= 0xff
+		jsonReply, _ = json.Marshal(reply)
+		return jsonReply
+	})
+
+	_, err := RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "secret")
+
+	var integrityErr *kerrors.IntegrityError
+	if !errors.As(err, &integrityErr) {
+		t.Fatalf("got %T (%v), want *kerrors.IntegrityError", err, err)
+	}
+	if integrityErr.Code != messages.ErrModified {
+		t.Errorf("got code %v, want %v", integrityErr.Code, messages.ErrModified)
+	}
+	if !errors.Is(err, &kerrors.ReplyError{}) {
+		t.Error("a modified reply must be a ReplyError")
+	}
+	if errors.Is(err, &kerrors.PasswordError{}) {
+		t.Error("a modified reply classified as a PasswordError")
+	}
+}
+
+func TestRequestToAsReplyError(t *testing.T) {
+	setupAS(t, nil)
+
+	_, err := RequestToAs([]string{"127.0.0.1"}, asRequest("bob"), "secret")
+
+	var unknownErr *kerrors.PrincipalUnknownError
+	if !errors.As(err, &unknownErr) {
+		t.Fatalf("got %T (%v), want *kerrors.PrincipalUnknownError", err, err)
+	}
+
+	var replyErr *kerrors.ReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatal("errors.As doesn't get the ReplyError of a reply error")
+	}
+	if replyErr.Code != messages.ErrClientUnknown {
+		t.Errorf("got code %v, want %v", replyErr.Code, messages.ErrClientUnknown)
+	}
+	if !errors.Is(err, &kerrors.ReplyError{Code: messages.ErrClientUnknown}) {
+		t.Error("errors.Is doesn't match the ReplyError with the same code")
+	}
+	if errors.Is(err, &kerrors.ReplyError{Code: messages.ErrTicketExpired}) {
+		t.Error("errors.Is matches the ReplyError with another code")
+	}
+	if errors.Is(err, &kerrors.TicketExpiredError{}) || errors.Is(err, &kerrors.PasswordError{}) {
+		t.Error("reply error classified as another error")
+	}
+}
+
+func TestRequestToAsTimeout(t *testing.T) {
+	saveConfig(t)
+	config.RequestTimeout = 20
+	config.RequestRetries = 1
+	asPort := fakeServer(t, func([]byte, *net.UDPAddr) []byte { return nil })
+	config.Update(func(s *config.Settings) { s.AsPort = asPort })
+
+	_, err := RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "secret")
+
+	var timeoutErr *kerrors.TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("got %T (%v), want *kerrors.TimeoutError", err, err)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("the timeout doesn't wrap its cause")
+	}
+	if errors.Is(err, &kerrors.NetworkError{}) || errors.Is(err, &kerrors.ReplyError{}) {
+		t.Error("timeout classified as another error")
+	}
+}
+
+// skewedAS replies to the first request with a clock skew error carrying a server time moved by offset (ms),
+// then forwards the requests to the AS of setupAS. It returns the number of requests received
+func skewedAS(t *testing.T, offset int64) *atomic.Int32 {
+	t.Helper()
+	setupAS(t, nil)
+	var requests atomic.Int32
+	asPort := fakeServer(t, func(req []byte, clientAddr *net.UDPAddr) []byte {
+		if requests.Add(1) == 1 {
+			reply := errorReply(messages.ErrSkew, "clock skew too great", false)
+			reply.ServerTime += offset
+			jsonReply, _ := json.Marshal(reply)
+			return jsonReply
+		}
+		reply, err := asRequestHandler(req, clientAddr, testAdminPwd)
+		if err != nil {
+			t.Error(err)
+		}
+		return reply
+	})
+	config.Update(func(s *config.Settings) { s.AsPort = asPort })
+	return &requests
+}
+
+func TestRequestToAsClockSkewRetry(t *testing.T) {
+
+	//THE AS CLOCK IS 2 MINUTES AHEAD: THE RETRY USES IT, WITHIN THE CLOCK SKEW ACCEPTED BY THE REAL AS
+	requests := skewedAS(t, 2*60*1000)
+	_, err := RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "secret")
+	if err != nil {
+		t.Fatalf("RequestToAs: %v", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("got %d requests, want the request and one retry", n)
+	}
+}
+
+func TestRequestToAsClockSkewTooGreat(t *testing.T) {
+	adjustment := config.MaxClockAdjustment
+	t.Cleanup(func() { config.MaxClockAdjustment = adjustment })
+	config.MaxClockAdjustment = 60 * 1000
+
+	//AN OFFSET BEYOND MaxClockAdjustment IS NOT TRUSTED: NO RETRY
+	requests := skewedAS(t, 2*60*1000)
+	_, err := RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "secret")
+	if !errors.Is(err, &kerrors.ClockSkewError{Code: messages.ErrSkew}) {
+		t.Fatalf("got %v, want the clock skew error", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("got %d requests, want no retry", n)
+	}
+}
+
+func TestReplyErrorClockSkew(t *testing.T) {
+	err := replyError(messages.Reply{IsError: true, ErrorCode: messages.ErrSkew, Message: "skew", ServerTime: 42})
+
+	var skewErr *kerrors.ClockSkewError
+	if !errors.As(err, &skewErr) {
+		t.Fatalf("got %T (%v), want *kerrors.ClockSkewError", err, err)
+	}
+	if skewErr.ServerTime != 42 {
+		t.Errorf("got server time %d, want 42", skewErr.ServerTime)
+	}
+	if !errors.Is(err, &kerrors.ReplyError{Code: messages.ErrSkew}) {
+		t.Error("clock skew error is not a ReplyError with its code")
+	}
+}
+
+// TestReplyErrorCodes checks that every code replied is converted to its kerrors type and is a ReplyError with
+// that code too
+func TestReplyErrorCodes(t *testing.T) {
+	tests := []struct {
+		code messages.ErrorCode
+		kind error
+	}{
+		{messages.ErrClientUnknown, &kerrors.PrincipalUnknownError{}},
+		{messages.ErrServerUnknown, &kerrors.PrincipalUnknownError{}},
+		{messages.ErrCannotPostdate, &kerrors.PolicyError{}},
+		{messages.ErrNeverValid, &kerrors.PolicyError{}},
+		{messages.ErrPolicy, &kerrors.PolicyError{}},
+		{messages.ErrBadOption, &kerrors.PolicyError{}},
+		{messages.ErrEtypeNoSupp, &kerrors.PolicyError{}},
+		{messages.ErrPreAuthFailed, &kerrors.PasswordError{}},
+		{messages.ErrPreAuthRequired, &kerrors.PreAuthError{}},
+		{messages.ErrPathNotAccepted, &kerrors.PolicyError{}},
+		{messages.ErrBadIntegrity, &kerrors.IntegrityError{}},
+		{messages.ErrTicketExpired, &kerrors.TicketExpiredError{}},
+		{messages.ErrTicketNotYetValid, &kerrors.TicketNotYetValidError{}},
+		{messages.ErrRepeat, &kerrors.ReplayError{}},
+		{messages.ErrNotUs, &kerrors.ReplyError{}},
+		{messages.ErrBadMatch, &kerrors.IntegrityError{}},
+		{messages.ErrSkew, &kerrors.ClockSkewError{}},
+		{messages.ErrBadAddr, &kerrors.ReplyError{}},
+		{messages.ErrModified, &kerrors.IntegrityError{}},
+		{messages.ErrBadKeyVer, &kerrors.TicketExpiredError{}},
+		{messages.ErrResponseTooBig, &kerrors.ReplyError{}},
+		{messages.ErrGeneric, &kerrors.ReplyError{}},
+	}
+	for _, test := range tests {
+		t.Run(test.code.String(), func(t *testing.T) {
+			err := replyError(messages.Reply{IsError: true, ErrorCode: test.code, Message: "error"})
+
+			if !errors.Is(err, test.kind) {
+				t.Errorf("got %T, want %T", err, test.kind)
+			}
+			if !errors.Is(err, &kerrors.ReplyError{}) || !errors.Is(err, &kerrors.ReplyError{Code: test.code}) {
+				t.Errorf("%T is not a ReplyError with its code", err)
+			}
+			other := messages.ErrGeneric
+			if test.code == other {
+				other = messages.ErrPolicy
+			}
+			if errors.Is(err, &kerrors.ReplyError{Code: other}) {
+				t.Errorf("%T matches a ReplyError with another code", err)
+			}
+			var replyErr *kerrors.ReplyError
+			if !errors.As(err, &replyErr) || replyErr.Code != test.code {
+				t.Errorf("errors.As of %T got %v, want a ReplyError with code %d", err, replyErr, test.code)
+			}
+		})
+	}
+
+	//A KEY THAT CAN'T DECRYPT THE REPLY IS A PASSWORD ERROR FOUND BY THE CLIENT, NOT REPLIED
+	err := &kerrors.PasswordError{Msg: "Wrong password", Err: security.ErrModified}
+	if errors.Is(err, &kerrors.ReplyError{}) {
+		t.Error("local password error is a ReplyError")
+	}
+}
+
+func TestRequestToAsPostdate(t *testing.T) {
+	setupAS(t, nil)
+	config.Update(func(s *config.Settings) { s.MaxPostdate = time.Hour.Milliseconds() })
+
+	req := asRequest("alice")
+	req.Options = dto.FlagMayPostdate | dto.FlagPostdated
+	req.From = time.Now().Add(30 * time.Minute).UnixMilli()
+	ticketData, err := RequestToAs([]string{"127.0.0.1"}, req, "secret")
+	if err != nil {
+		t.Fatalf("RequestToAs: %v", err)
+	}
+	if !ticketData.Flags.Has(dto.FlagPostdated) || ticketData.Timestamp != req.From {
+		t.Errorf("got a ticket starting at %d with flags %v, want postdated to %d", ticketData.Timestamp, ticketData.Flags, req.From)
+	}
+
+	//A START TIME BEYOND max_postdate IS REFUSED
+	req = asRequest("alice")
+	req.Options = dto.FlagMayPostdate | dto.FlagPostdated
+	req.From = time.Now().Add(2 * time.Hour).UnixMilli()
+	_, err = RequestToAs([]string{"127.0.0.1"}, req, "secret")
+	if !errors.Is(err, &kerrors.PolicyError{Code: messages.ErrCannotPostdate}) {
+		t.Errorf("got %T (%v), want a KDC_ERR_CANNOT_POSTDATE error", err, err)
+	}
+}
+
+func TestRequestToAsEnctypeNegotiation(t *testing.T) {
+	setupAS(t, nil)
+
+	ticketData, err := RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "secret")
+	if err != nil {
+		t.Fatalf("RequestToAs: %v", err)
+	}
+	if ticketData.Enctype != security.EnctypeAesGcm {
+		t.Errorf("got a ticket with enctype %v, want %v", ticketData.Enctype, security.EnctypeAesGcm)
+	}
+
+	//A CLIENT SUPPORTING ONLY AES-CBC+HMAC GETS IT FOR THE REPLY AND THE TICKET
+	req := asRequest("alice")
+	req.Enctypes = []security.Enctype{security.EnctypeAesCbcHmac}
+	ticketData, err = RequestToAs([]string{"127.0.0.1"}, req, "secret")
+	if err != nil {
+		t.Fatalf("RequestToAs: %v", err)
+	}
+	if ticketData.Enctype != security.EnctypeAesCbcHmac || len(ticketData.EncTicketMac) == 0 {
+		t.Errorf("got a ticket with enctype %v, want %v with its mac", ticketData.Enctype, security.EnctypeAesCbcHmac)
+	}
+}
+
+func TestASNoSharedEnctype(t *testing.T) {
+	setupAS(t, nil)
+	config.Update(func(s *config.Settings) { s.PermittedEnctypes = []string{"aes-gcm"} })
+
+	//THE CLIENT SUPPORTS ONLY AES-CBC+HMAC, WHICH THE AS DOESN'T PERMIT
+	clientKey, err := security.GenerateClientKeyFromPwd("secret", security.DefaultStringToKeyParams("alice"), config.SymmKeyDim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := asRequest("alice")
+	req.Enctypes = []security.Enctype{security.EnctypeAesCbcHmac}
+	req.PreAuthEnctype = security.EnctypeAesGcm
+	req.EncryptedPreAuth, req.EncPreAuthMac, err = prepareEncryptedPreAuth("alice", req.PreAuthEnctype, clientKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonReq, _ := json.Marshal(req)
+	jsonReply, err := asRequestHandler(jsonReq, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, testAdminPwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply messages.Reply
+	json.Unmarshal(jsonReply, &reply)
+
+	var policyErr *kerrors.PolicyError
+	if err := replyError(reply); !reply.IsError || !errors.As(err, &policyErr) {
+		t.Fatalf("got reply %+v, want a *kerrors.PolicyError", reply)
+	}
+	if policyErr.Code != messages.ErrEtypeNoSupp {
+		t.Errorf("got code %v, want %v", policyErr.Code, messages.ErrEtypeNoSupp)
+	}
+}
+
+func TestRequestToAsStringToKeyHint(t *testing.T) {
+	randomSalt := security.DefaultStringToKeyParams("alice")
+	randomSalt.Salt = security.GenerateRandomKey(128)
+	randomSalt.Iterations = 2000
+
+	argon2id := security.StringToKeyParams{Algorithm: security.StringToKeyArgon2id, Salt: randomSalt.Salt, Iterations: 1, Memory: 1024, Parallelism: 1}
+	scrypt := security.StringToKeyParams{Algorithm: security.StringToKeyScrypt, Salt: randomSalt.Salt, Iterations: 1024, Parallelism: 1}
+
+	for name, params := range map[string]security.StringToKeyParams{"legacy": security.LegacyStringToKeyParams, "random": randomSalt, "argon2id": argon2id, "scrypt": scrypt} {
+		t.Run(name, func(t *testing.T) {
+			setupAS(t, nil)
+
+			//THE CLIENT ACCEPTS HINTS AT LEAST AS STRONG AS ITS CONFIGURATION
+			config.StringToKeyIterations, config.Argon2Time, config.Argon2Memory, config.ScryptN = 1000, 1, 1024, 1024
+
+			//STORE A KEY THAT THE CLIENT CAN'T DERIVE WITH THE DEFAULT SALT
+			db, err := dao.OpenEncryptedASDb(config.AsDbPath, testAdminPwd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			clientKey, err := security.GenerateClientKeyFromPwd("secret", params, config.SymmKeyDim)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.UpdateClientKey("alice", clientKey, params, db); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "secret")
+			if err != nil {
+				t.Fatalf("RequestToAs: %v", err)
+			}
+
+			//A WRONG PASSWORD IS STILL REFUSED AFTER THE RETRY
+			_, err = RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "wrong")
+			var pwdErr *kerrors.PasswordError
+			if !errors.As(err, &pwdErr) {
+				t.Fatalf("got %T (%v), want *kerrors.PasswordError", err, err)
+			}
+			if pwdErr.StringToKey == nil || !pwdErr.StringToKey.Equal(params) {
+				t.Errorf("got string-to-key %v from the AS, want %v", pwdErr.StringToKey, params)
+			}
+		})
+	}
+}
+
+func TestRequestToAsWeakStringToKeyHint(t *testing.T) {
+	salt := security.GenerateRandomKey(128)
+
+	//THE AS (OR WHOEVER ANSWERS FOR IT) ASKS FOR FEWER ITERATIONS THAN THE CONFIGURED ONES, OR FOR PBKDF2 WHEN THE
+	//CLIENT USES A MEMORY-HARD ALGORITHM
+	for name, tc := range map[string]struct {
+		stringToKey string
+		params      security.StringToKeyParams
+	}{
+		"fewer iterations": {security.StringToKeyPbkdf2, security.StringToKeyParams{Algorithm: security.StringToKeyPbkdf2, Salt: salt, Iterations: config.StringToKeyIterations / 2}},
+		"weaker algorithm": {security.StringToKeyScrypt, security.StringToKeyParams{Algorithm: security.StringToKeyPbkdf2, Salt: salt, Iterations: config.StringToKeyIterations}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			setupAS(t, nil)
+
+			db, err := dao.OpenEncryptedASDb(config.AsDbPath, testAdminPwd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			clientKey, err := security.GenerateClientKeyFromPwd("secret", tc.params, config.SymmKeyDim)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.UpdateClientKey("alice", clientKey, tc.params, db); err != nil {
+				t.Fatal(err)
+			}
+
+			config.StringToKey = tc.stringToKey
+			_, err = RequestToAs([]string{"127.0.0.1"}, asRequest("alice"), "secret")
+			var pwdErr *kerrors.PasswordError
+			if !errors.As(err, &pwdErr) || !strings.Contains(err.Error(), "weaker") {
+				t.Fatalf("got %T (%v), want the weak string-to-key refused", err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/kerrors"
+	"simple_kerberos/internal/security"
+	"time"
+)
+
+// retryOffset returns the offset (ms) between the time of the server carried by a clock skew error and the local
+// clock. The error is not authenticated, so the offset is used only for the single retry of the rejected request,
+// never for the local checks of the tickets, and only up to MaxClockAdjustment.
+// It returns false if err is not a clock skew error or the offset is too big, so there is no reason to retry
+func retryOffset(err error) (int64, bool) {
+	var skewErr *kerrors.ClockSkewError
+	if !errors.As(err, &skewErr) || skewErr.ServerTime == 0 {
+		return 0, false
+	}
+
+	offset := skewErr.ServerTime - time.Now().UnixMilli()
+	if offset > config.MaxClockAdjustment || -offset > config.MaxClockAdjustment {
+		fmt.Println("Clock skew with the server of", time.Duration(offset)*time.Millisecond, "too great to retry, check the clock of this host")
+		return 0, false
+	}
+	fmt.Println("Clock skew with the server, retrying with the clock moved by", time.Duration(offset)*time.Millisecond)
+	return offset, true
+}
+
+// refreshAuthenticator encrypts again the authenticator encAuth (encrypted with enctype, authMac is its mac) with the
+// local time moved by clockOffset (ms), returning the new encrypted authenticator with its mac and timestamp
+func refreshAuthenticator(encAuth []byte, authMac []byte, enctype security.Enctype, key []byte, clockOffset int64) ([]byte, []byte, int64, error) {
+	jsonAuth, err := security.Decrypt(enctype, key, security.UsageAuthenticator, encAuth, authMac)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var auth dto.Authenticator
+	err = json.Unmarshal(jsonAuth, &auth)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	auth.Timestamp = time.Now().UnixMilli() + clockOffset
+
+	jsonAuth, err = json.Marshal(auth)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	newEncAuth, newAuthMac, err := security.Encrypt(enctype, key, security.UsageAuthenticator, jsonAuth)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return newEncAuth, newAuthMac, auth.Timestamp, nil
+}
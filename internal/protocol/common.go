@@ -1,18 +1,116 @@
 package protocol
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	config "simple_kerberos/configs"
 	"simple_kerberos/internal/messages"
+	"simple_kerberos/internal/network"
+	"simple_kerberos/internal/security"
+	"time"
 )
 
-func errorReply(msg string, print bool) messages.Reply {
+// serve handles requests at serverAddr over both UDP and TCP until ctx is done or one of the two listeners fails.
+// Replies that don't fit in a UDP datagram are replaced by an error telling the client to retry over TCP, while
+// retransmitted requests get the reply already sent
+func serve(ctx context.Context, serverAddr net.UDPAddr, onRequest func([]byte, *net.UDPAddr) ([]byte, error), onError func(err error)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	onRequest = newRetransmissionCache().handler(onRequest)
+
+	//SIZES AND WORKERS ARE READ WHEN THE SERVER STARTS, A RELOAD CHANGES THEM FOR THE SERVERS STARTED AFTER IT
+	settings := config.Current()
+	tcpAddr := net.TCPAddr{
+		Port: serverAddr.Port,
+		IP:   serverAddr.IP,
+	}
+	tcpErr := make(chan error, 1)
+	go func() {
+		err := network.ListenTCP(ctx, tcpAddr, settings.MaxTCPMessageSize, settings.ServerWorkers, settings.MaxTCPConnections, time.Duration(settings.TCPIdleTimeout)*time.Millisecond, onRequest, onError)
+		if err != nil {
+			cancel()
+		}
+		tcpErr <- err
+	}()
+
+	udpErr := network.ListenUDP(ctx, serverAddr, settings.MaxMessageSize, settings.ServerWorkers, func(b []byte, u *net.UDPAddr) ([]byte, error) {
+		responseData, err := onRequest(b, u)
+		if err != nil || len(responseData) <= settings.MaxMessageSize {
+			return responseData, err
+		}
+		return json.Marshal(errorReply(messages.ErrResponseTooBig, messages.ResponseTooBigMsg, false))
+	}, onError)
+	cancel()
+
+	return errors.Join(udpErr, <-tcpErr)
+}
+
+func errorReply(code messages.ErrorCode, msg string, print bool) messages.Reply {
 	if print {
 		fmt.Println(msg)
 	}
 	return messages.Reply{
 		IsError:       true,
+		ErrorCode:     code,
 		Message:       msg,
+		ServerTime:    time.Now().UnixMilli(),
 		EncryptedData: []byte{},
 		EncDataMac:    []byte{},
 	}
 }
+
+// decryptErrorCode returns the error code replied when a message can't be decrypted: the integrity check failed,
+// the enctype is not permitted or the message is malformed
+func decryptErrorCode(err error) messages.ErrorCode {
+	switch {
+	case errors.Is(err, security.ErrModified):
+		return messages.ErrModified
+	case errors.Is(err, security.ErrUnsupportedEnctype):
+		return messages.ErrEtypeNoSupp
+	default:
+		return messages.ErrBadIntegrity
+	}
+}
+
+// ticketEnctype returns the enctype of a new ticket (and of its session key): the strongest one supported by the
+// client, permitted by this server and supported with its key by the target of the ticket
+func ticketEnctype(clientEnctypes []security.Enctype, targetEnctypes []security.Enctype) (security.Enctype, bool) {
+	return security.StrongestEnctype(clientEnctypes, security.PermittedEnctypes(), targetEnctypes)
+}
+
+// checkTimestamp checks that a timestamp set by a client is in the freshness window, allowing the clocks
+// to differ by MaxClockSkew in both directions
+func checkTimestamp(timestamp int64) (bool, string) {
+	settings := config.Current()
+	now := time.Now().UnixMilli()
+	if timestamp > now+settings.MaxClockSkew {
+		return false, "clock skew too great, it's coming from the future"
+	}
+	if now-timestamp > settings.AuthenticatorFreshnessTime+settings.MaxClockSkew {
+		return false, "too old or clock skew too great"
+	}
+	return true, ""
+}
+
+// grantedLifetime returns the lifetime of a ticket issued at timestamp: the one requested with till
+// (or the default one if till is 0) bounded by the realm maximum and by every positive maximum given
+func grantedLifetime(timestamp int64, till int64, maxLifetimes ...int64) int64 {
+	settings := config.Current()
+	lifetime := settings.Lifetime
+	if till != 0 {
+		lifetime = till - timestamp
+	}
+
+	lifetime = min(lifetime, settings.MaxLifetime)
+	for _, maxLifetime := range maxLifetimes {
+		if maxLifetime > 0 {
+			lifetime = min(lifetime, maxLifetime)
+		}
+	}
+
+	return lifetime
+}
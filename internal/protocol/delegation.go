@@ -0,0 +1,224 @@
+package protocol
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/kerrors"
+	"simple_kerberos/internal/messages"
+	"simple_kerberos/internal/security"
+	"slices"
+	"time"
+)
+
+// PrepareS4U2SelfRequest builds the request of a service (authenticated with its own TGS ticket) asking a ticket
+// to itself on behalf of forUser, who authenticated to the service by other means (protocol transition)
+func PrepareS4U2SelfRequest(serverIp string, serviceId string, forUser string, tgsTicketData dto.TicketData) (messages.TGSRequest, error) {
+
+	req, err := PrepareTGSRequest(serverIp, serviceId, serviceId, tgsTicketData)
+	if err != nil {
+		return messages.TGSRequest{}, err
+	}
+	req.ForUser = forUser
+
+	return req, nil
+}
+
+// PrepareS4U2ProxyRequest builds the request of a service asking a ticket to targetServiceId on behalf of the client
+// of evidenceTicketData, a ticket to the service itself (got by the client or with S4U2Self)
+func PrepareS4U2ProxyRequest(serverIp string, serviceId string, targetServiceId string, evidenceTicketData dto.TicketData, tgsTicketData dto.TicketData) (messages.TGSRequest, error) {
+
+	if !evidenceTicketData.Flags.Has(dto.FlagForwardable) {
+		return messages.TGSRequest{}, &kerrors.TokenError{Msg: "ERROR: Evidence ticket for " + evidenceTicketData.TargetId + " is not forwardable, it can't be used for delegation"}
+	}
+
+	req, err := PrepareTGSRequest(serverIp, serviceId, targetServiceId, tgsTicketData)
+	if err != nil {
+		return messages.TGSRequest{}, err
+	}
+	req.EvidenceTicketEnctype = evidenceTicketData.Enctype
+	req.EvidenceTicketKvno = evidenceTicketData.Kvno
+	req.EvidenceTicket = evidenceTicketData.EncryptedTicket
+	req.EvidenceTicketMac = evidenceTicketData.EncTicketMac
+
+	return req, nil
+}
+
+// tgsBuildS4U2SelfReply issues to the requesting service a ticket to itself for req.ForUser. The TGS can't check
+// how the user has been authenticated, so the ticket is not pre-authenticated and it is forwardable (usable for
+// S4U2Proxy) only if the service is allowed to delegate to some other service.
+// The user must be a client of the realm registered in the AS db
+func tgsBuildS4U2SelfReply(req messages.TGSRequest, tgsTicket dto.Ticket, db *sql.DB, adminPwd string) (messages.Reply, error) {
+
+	if req.ServiceId != tgsTicket.ClientId {
+		return errorReply(messages.ErrPolicy, "[TGS] ERROR: "+tgsTicket.ClientId+" can ask tickets on behalf of other users only for itself", true), nil
+	}
+
+	//CHECK THE USER
+	userId := dto.PrincipalId(req.ForUser)
+	if userId == "" {
+		return errorReply(messages.ErrClientUnknown, "[TGS] ERROR: "+tgsTicket.ClientId+" asked a ticket on behalf of an empty user", true), nil
+	}
+	if dto.PrincipalRealm(req.ForUser, config.Realm) != config.Realm {
+		return errorReply(messages.ErrPolicy, "[TGS] ERROR: "+tgsTicket.ClientId+" can't ask tickets on behalf of "+req.ForUser+" of another realm", true), nil
+	}
+	exists, err := tgsClientExists(userId, adminPwd)
+	if err != nil {
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+	}
+	if !exists {
+		return errorReply(messages.ErrClientUnknown, "[TGS] ERROR: "+req.ForUser+" is not a client of the realm", true), nil
+	}
+
+	service, ok, err := tgsGetService(tgsTicket.ClientId, db)
+	if err != nil {
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+	}
+	if !ok {
+		return errorReply(messages.ErrClientUnknown, "[TGS] ERROR: "+tgsTicket.ClientId+" is not a registered service", true), nil
+	}
+
+	timestamp := time.Now().UnixMilli()
+	lifetime := min(grantedLifetime(timestamp, req.Till, service.MaxLifetime), tgsTicket.Timestamp+tgsTicket.Lifetime-timestamp)
+	if lifetime <= 0 {
+		return errorReply(messages.ErrNeverValid, "[TGS] ERROR: requested end time for "+req.ServiceId+" is in the past", true), nil
+	}
+
+	enctype, ok := ticketEnctype(req.Enctypes, service.Enctypes)
+	if !ok {
+		return errorReply(messages.ErrEtypeNoSupp, "[TGS] ERROR: no enctype shared by "+tgsTicket.ClientId+" and its key", true), nil
+	}
+
+	var flags dto.TicketFlags
+	if len(service.DelegationTargets) > 0 {
+		flags |= dto.FlagForwardable
+	}
+
+	ticket := dto.Ticket{
+		Key:           security.GenerateRandomKey(config.SymmKeyDim),
+		Enctype:       enctype,
+		ClientId:      userId,
+		ClientAddress: tgsTicket.ClientAddress,
+		TargetId:      service.ServiceId,
+		Timestamp:     timestamp,
+		Lifetime:      lifetime,
+		Flags:         flags,
+	}
+
+	fmt.Println("[TGS]: OK S4U2Self " + tgsTicket.ClientId + " on behalf of " + req.ForUser)
+	return tgsTicketReply(req, tgsTicket, ticket, service.VersionedKey())
+}
+
+// tgsBuildS4U2ProxyReply issues to the requesting service a ticket to req.ServiceId for the client of the evidence
+// ticket, if req.ServiceId is in the delegation allow-list of the requesting service
+func tgsBuildS4U2ProxyReply(req messages.TGSRequest, tgsTicket dto.Ticket, db *sql.DB) (messages.Reply, error) {
+
+	service, ok, err := tgsGetService(tgsTicket.ClientId, db)
+	if err != nil {
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+	}
+	if !ok {
+		return errorReply(messages.ErrClientUnknown, "[TGS] ERROR: "+tgsTicket.ClientId+" is not a registered service", true), nil
+	}
+
+	if !slices.Contains(service.DelegationTargets, req.ServiceId) {
+		return errorReply(messages.ErrPolicy, "[TGS] ERROR: "+service.ServiceId+" is not allowed to delegate to "+req.ServiceId, true), nil
+	}
+
+	//THE EVIDENCE TICKET CAN BE ENCRYPTED WITH A PREVIOUS KEY OF THE SERVICE
+	serviceKeys, err := dao.GetKeySet(dao.KeyKindService, service.ServiceId, service.VersionedKey(), db)
+	if err != nil {
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+	}
+	evidenceKey, ok := serviceKeys.Find(req.EvidenceTicketKvno, time.Now().UnixMilli())
+	if !ok {
+		return errorReply(messages.ErrBadKeyVer, "[TGS] ERROR: key version "+fmt.Sprint(req.EvidenceTicketKvno)+" of the evidence ticket of "+service.ServiceId+" is unknown or expired", true), nil
+	}
+
+	//CHECK INTEGRITY AND DECRYPT EVIDENCE TICKET
+	evidenceJson, err := security.Decrypt(req.EvidenceTicketEnctype, evidenceKey, security.UsageTicket, req.EvidenceTicket, req.EvidenceTicketMac)
+	if err != nil {
+		return errorReply(decryptErrorCode(err), "[TGS] ERROR: check of evidence ticket of "+service.ServiceId+" failed: "+err.Error(), true), nil
+	}
+	var evidence dto.Ticket
+	err = json.Unmarshal(evidenceJson, &evidence)
+	if err != nil {
+		return errorReply(messages.ErrBadIntegrity, "[TGS] ERROR: inconsistent evidence ticket recieved", true), nil
+	}
+
+	//CHECK EVIDENCE TICKET
+	timestamp := time.Now().UnixMilli()
+	if !dto.SamePrincipal(evidence.TargetId, service.ServiceId, config.Realm) {
+		return errorReply(messages.ErrBadMatch, "[TGS] ERROR: evidence ticket is not for "+service.ServiceId, true), nil
+	}
+	if !evidence.Flags.Has(dto.FlagForwardable) || evidence.Flags.Has(dto.FlagInvalid) {
+		return errorReply(messages.ErrBadOption, "[TGS] ERROR: evidence ticket of "+evidence.ClientId+" can't be used for delegation", true), nil
+	}
+	if timestamp > evidence.Timestamp+evidence.Lifetime {
+		return errorReply(messages.ErrTicketExpired, "[TGS] ERROR: evidence ticket of "+evidence.ClientId+" expired", true), nil
+	}
+
+	target, ok, err := tgsGetService(req.ServiceId, db)
+	if err != nil {
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+	}
+	if !ok {
+		return errorReply(messages.ErrServerUnknown, "[TGS] ERROR: unknown "+req.ServiceId+" or other problems", true), nil
+	}
+
+	enctype, ok := ticketEnctype(req.Enctypes, target.Enctypes)
+	if !ok {
+		return errorReply(messages.ErrEtypeNoSupp, "[TGS] ERROR: no enctype shared by "+service.ServiceId+" and "+req.ServiceId, true), nil
+	}
+
+	//THE TICKET CAN'T OUTLIVE THE EVIDENCE TICKET AND THE TGS TICKET OF THE SERVICE
+	lifetime := min(
+		grantedLifetime(timestamp, req.Till, target.MaxLifetime),
+		evidence.Timestamp+evidence.Lifetime-timestamp,
+		tgsTicket.Timestamp+tgsTicket.Lifetime-timestamp,
+	)
+	if lifetime <= 0 {
+		return errorReply(messages.ErrNeverValid, "[TGS] ERROR: requested end time for "+req.ServiceId+" is in the past", true), nil
+	}
+
+	ticket := dto.Ticket{
+		Key:           security.GenerateRandomKey(config.SymmKeyDim),
+		Enctype:       enctype,
+		ClientId:      evidence.ClientId,
+		ClientAddress: tgsTicket.ClientAddress,
+		TargetId:      target.ServiceId,
+		Timestamp:     timestamp,
+		Lifetime:      lifetime,
+		Flags:         dto.FlagForwardable | evidence.Flags&dto.FlagPreAuthent,
+	}
+
+	fmt.Println("[TGS]: OK S4U2Proxy " + service.ServiceId + " -> " + target.ServiceId + " on behalf of " + evidence.ClientId)
+	return tgsTicketReply(req, tgsTicket, ticket, target.VersionedKey())
+}
+
+func tgsGetService(serviceId string, db *sql.DB) (dto.Service, bool, error) {
+	exists, err := dao.ServiceExists(serviceId, db)
+	if err != nil || !exists {
+		return dto.Service{}, false, err
+	}
+
+	service, err := dao.GetServiceByServiceId(serviceId, db)
+	if err != nil {
+		return dto.Service{}, false, err
+	}
+	return service, true, nil
+}
+
+// tgsClientExists reports if clientId is registered in the AS db of the realm
+func tgsClientExists(clientId string, adminPwd string) (bool, error) {
+	db, err := dao.OpenEncryptedASDb(config.AsDbPath, adminPwd)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	return dao.ClientExists(clientId, db)
+}
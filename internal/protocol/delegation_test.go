@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/messages"
+	"simple_kerberos/internal/security"
+	"testing"
+	"time"
+)
+
+// setupDelegation creates the AS db of setupAS and a TGS db with svc1 (allowed to delegate to backend), backend
+// and other. It returns the TGS db, the key of svc1 and a TGS ticket of svc1
+func setupDelegation(t *testing.T) (*sql.DB, []byte, dto.Ticket) {
+	t.Helper()
+	setupAS(t, nil)
+
+	db, err := dao.OpenEncryptedTGSDb(filepath.Join(t.TempDir(), "tgs1.db"), testAdminPwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	enctypes := []security.Enctype{security.EnctypeAesCbcHmac}
+	svcKey := security.GenerateRandomKey(config.SymmKeyDim)
+	if err := dao.InsertService("svc1", svcKey, 0, enctypes, db); err != nil {
+		t.Fatal(err)
+	}
+	for _, serviceId := range []string{"backend", "other"} {
+		if err := dao.InsertService(serviceId, security.GenerateRandomKey(config.SymmKeyDim), 0, enctypes, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dao.UpdateServiceDelegationTargets("svc1", []string{"backend"}, db); err != nil {
+		t.Fatal(err)
+	}
+
+	tgsTicket := dto.Ticket{
+		Key:       security.GenerateRandomKey(config.SymmKeyDim),
+		Enctype:   security.EnctypeAesCbcHmac,
+		ClientId:  "svc1",
+		TargetId:  "tgs1",
+		Timestamp: time.Now().UnixMilli(),
+		Lifetime:  time.Hour.Milliseconds(),
+	}
+	return db, svcKey, tgsTicket
+}
+
+// replyTicket decrypts the ticket data of a TGS reply and the ticket in it
+func replyTicket(t *testing.T, reply messages.Reply, tgsTicket dto.Ticket, targetKey []byte) (dto.TicketData, dto.Ticket) {
+	t.Helper()
+	if reply.IsError {
+		t.Fatalf("unexpected error reply: %s", reply.Message)
+	}
+
+	jsonTicketData, err := security.Decrypt(reply.Enctype, tgsTicket.Key, security.UsageTGSReply, reply.EncryptedData, reply.EncDataMac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ticketData dto.TicketData
+	if err := json.Unmarshal(jsonTicketData, &ticketData); err != nil {
+		t.Fatal(err)
+	}
+
+	jsonTicket, err := security.Decrypt(ticketData.Enctype, targetKey, security.UsageTicket, ticketData.EncryptedTicket, ticketData.EncTicketMac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ticket dto.Ticket
+	if err := json.Unmarshal(jsonTicket, &ticket); err != nil {
+		t.Fatal(err)
+	}
+	return ticketData, ticket
+}
+
+func TestS4U2Self(t *testing.T) {
+	db, svcKey, tgsTicket := setupDelegation(t)
+
+	req := messages.TGSRequest{ServiceId: "svc1", ForUser: "alice", Enctypes: security.PermittedEnctypes()}
+	reply, err := tgsBuildS4U2SelfReply(req, tgsTicket, db, testAdminPwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ticket := replyTicket(t, reply, tgsTicket, svcKey)
+	if ticket.ClientId != "alice" || ticket.TargetId != "svc1" {
+		t.Errorf("ticket for %s to %s, want alice to svc1", ticket.ClientId, ticket.TargetId)
+	}
+	if !ticket.Flags.Has(dto.FlagForwardable) || ticket.Flags.Has(dto.FlagPreAuthent) {
+		t.Errorf("ticket flags %v, want forwardable and not pre-authenticated", ticket.Flags)
+	}
+
+	tests := []struct {
+		name    string
+		forUser string
+		code    messages.ErrorCode
+	}{
+		{"empty", "", messages.ErrClientUnknown},
+		{"empty with realm", "@" + config.Realm, messages.ErrClientUnknown},
+		{"unknown", "bob", messages.ErrClientUnknown},
+		{"foreign realm", "alice@OTHER.REALM", messages.ErrPolicy},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := messages.TGSRequest{ServiceId: "svc1", ForUser: test.forUser, Enctypes: security.PermittedEnctypes()}
+			reply, err := tgsBuildS4U2SelfReply(req, tgsTicket, db, testAdminPwd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reply.IsError || reply.ErrorCode != test.code {
+				t.Errorf("reply for %q: error %v code %d, want code %d", test.forUser, reply.IsError, reply.ErrorCode, test.code)
+			}
+		})
+	}
+}
+
+func TestS4U2Proxy(t *testing.T) {
+	db, svcKey, tgsTicket := setupDelegation(t)
+
+	//THE EVIDENCE TICKET IS GOT WITH S4U2SELF
+	req := messages.TGSRequest{ServiceId: "svc1", ForUser: "alice", Enctypes: security.PermittedEnctypes()}
+	reply, err := tgsBuildS4U2SelfReply(req, tgsTicket, db, testAdminPwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evidence, _ := replyTicket(t, reply, tgsTicket, svcKey)
+
+	backend, err := dao.GetServiceByServiceId("backend", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyRequest := func(targetId string) messages.TGSRequest {
+		return messages.TGSRequest{
+			ServiceId:             targetId,
+			Enctypes:              security.PermittedEnctypes(),
+			EvidenceTicketEnctype: evidence.Enctype,
+			EvidenceTicketKvno:    evidence.Kvno,
+			EvidenceTicket:        evidence.EncryptedTicket,
+			EvidenceTicketMac:     evidence.EncTicketMac,
+		}
+	}
+
+	reply, err = tgsBuildS4U2ProxyReply(proxyRequest("backend"), tgsTicket, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ticket := replyTicket(t, reply, tgsTicket, backend.Key)
+	if ticket.ClientId != "alice" || ticket.TargetId != "backend" {
+		t.Errorf("ticket for %s to %s, want alice to backend", ticket.ClientId, ticket.TargetId)
+	}
+
+	reply, err = tgsBuildS4U2ProxyReply(proxyRequest("other"), tgsTicket, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.IsError || reply.ErrorCode != messages.ErrPolicy {
+		t.Errorf("reply for a target not allowed: error %v code %d, want code %d", reply.IsError, reply.ErrorCode, messages.ErrPolicy)
+	}
+}
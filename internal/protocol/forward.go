@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/kerrors"
+	"simple_kerberos/internal/messages"
+	"simple_kerberos/internal/security"
+)
+
+// PrepareTGSForwardRequest builds a request asking the TGS for a copy of the given TGS ticket bound to address,
+// which is the address of the service that will use it
+func PrepareTGSForwardRequest(serverIp string, clientId string, address string, ticketData dto.TicketData) (messages.TGSRequest, error) {
+
+	if !ticketData.Flags.Has(dto.FlagForwardable) {
+		return messages.TGSRequest{}, &kerrors.TokenError{Msg: "ERROR: Ticket for " + clientId + " and TGS " + ticketData.TargetId + " is not forwardable. Authentication with AS asking a forwardable ticket needed"}
+	}
+
+	req, err := PrepareTGSRequest(serverIp, clientId, ticketData.TargetId, ticketData)
+	if err != nil {
+		return messages.TGSRequest{}, err
+	}
+	req.Options = dto.FlagForwarded
+	req.Address = address
+
+	return req, nil
+}
+
+// AttachForwardedTicket adds a forwarded TGS ticket to a service request (like a KRB-CRED message),
+// encrypted with the client-service session key
+func AttachForwardedTicket(req *messages.ServiceRequest, serviceTicketData dto.TicketData, forwardedTicketData dto.TicketData) error {
+
+	jsonCred, err := json.Marshal(forwardedTicketData)
+	if err != nil {
+		return err
+	}
+
+	encCred, credMac, err := security.Encrypt(serviceTicketData.Enctype, serviceTicketData.Key, security.UsageCred, jsonCred)
+	if err != nil {
+		return err
+	}
+
+	req.EncryptedCred = encCred
+	req.EncCredMac = credMac
+	return nil
+}
+
+// SaveForwardedTGSTicket stores a TGS ticket forwarded to serviceId by clientId, so the service can
+// later retrieve it and use it with RequestToTgs to reach other services on behalf of the client
+func SaveForwardedTGSTicket(serviceId string, clientId string, data dto.TicketData) error {
+	cache, err := forwardedCCache(serviceId)
+	if err != nil {
+		return err
+	}
+	return cache.SaveTicket(clientId, KindTGS, data)
+}
+
+func RetriveForwardedTGSTicket(serviceId string, clientId string, tgsId string) (dto.TicketData, error) {
+	cache, err := forwardedCCache(serviceId)
+	if err != nil {
+		return dto.TicketData{}, err
+	}
+	return retriveTGSTicket(cache, clientId, tgsId)
+}
+
+// forwardedCCache returns the cache of the TGS tickets forwarded to serviceId. Every service has a db of its own,
+// readable only by its owner as the key file of the service, so a service can't read the tickets of the others
+func forwardedCCache(serviceId string) (CredCache, error) {
+	dbPath := filepath.Clean(config.ForwardedTicketsPath + serviceId + ".forwarded.db")
+
+	//THE DB IS CREATED WITH ITS PERMISSIONS BEFORE SQLITE OPENS IT
+	f, err := os.OpenFile(dbPath, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		f.Close()
+		err = dao.InitNewClientDb(dbPath)
+	} else if errors.Is(err, os.ErrExist) {
+		err = os.Chmod(dbPath, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return sqliteCCache{dbPath: dbPath}, nil
+}
+
+// decryptForwardedTicket returns the forwarded TGS ticket attached to a service request, nil if there is none.
+// The ticket is encrypted with the session key of the service ticket
+func decryptForwardedTicket(req messages.ServiceRequest, ticket dto.Ticket) (*dto.TicketData, error) {
+	if len(req.EncryptedCred) == 0 {
+		return nil, nil
+	}
+
+	jsonCred, err := security.Decrypt(ticket.Enctype, ticket.Key, security.UsageCred, req.EncryptedCred, req.EncCredMac)
+	if err != nil {
+		return nil, err
+	}
+
+	var cred dto.TicketData
+	err = json.Unmarshal(jsonCred, &cred)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cred, nil
+}
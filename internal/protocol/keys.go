@@ -0,0 +1,184 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/security"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Key files hold the keys of a service, one version per line:
+
+	kvno hexKey [expires]
+
+The current key has no expires, the previous ones are valid until expires (ms). A file with only
+the hex key, as written before key versions were introduced, holds the first version of the key
+*/
+
+// ReadServiceKeys reads the keys of serviceId from keyFile, either a key file or a keytab, the current one first
+func ReadServiceKeys(keyFile string, serviceId string) (dto.KeySet, error) {
+	data, err := os.ReadFile(filepath.Clean(keyFile))
+	if err != nil {
+		return nil, err
+	}
+	if security.IsKeytab(data) {
+		return readKeytabKeys(data, keyFile, serviceId)
+	}
+	return ReadKeyFile(keyFile)
+}
+
+// readKeytabKeys returns the keys of serviceId in a keytab. The keytab has an entry for every enctype of a key
+// version, all with the same key. Previous versions don't expire, they are valid until removed from the keytab.
+// Keys of 16, 24 or 32 bytes are used whatever symmetric_key_bits is, a key of another size is an error
+func readKeytabKeys(data []byte, keytabFile string, serviceId string) (dto.KeySet, error) {
+	entries, err := security.ParseKeytab(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keytabFile, err)
+	}
+
+	var keys dto.KeySet
+	for _, entry := range entries {
+		if !dto.SamePrincipal(entry.Principal+"@"+entry.Realm, serviceId, config.Realm) {
+			continue
+		}
+		if !slices.Contains(security.SupportedEnctypes, entry.Enctype) {
+			continue
+		}
+		if err := security.CheckKeySize(entry.Key); err != nil {
+			return nil, fmt.Errorf("%s: key version %d of %s: %w", keytabFile, entry.Kvno, serviceId, err)
+		}
+		if slices.ContainsFunc(keys, func(k dto.VersionedKey) bool { return k.Kvno == int(entry.Kvno) }) {
+			continue
+		}
+		keys = append(keys, dto.VersionedKey{Kvno: int(entry.Kvno), Key: entry.Key})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no key of " + serviceId + " in " + keytabFile)
+	}
+
+	//THE CURRENT KEY IS THE LAST VERSION
+	slices.SortFunc(keys, func(a, b dto.VersionedKey) int { return b.Kvno - a.Kvno })
+	return keys, nil
+}
+
+// ReadKeyFile reads the keys of a service from keyFile, the current one first
+func ReadKeyFile(keyFile string) (dto.KeySet, error) {
+	data, err := os.ReadFile(filepath.Clean(keyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys dto.KeySet
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		//LEGACY KEY FILE
+		if len(fields) == 1 {
+			fields = []string{"1", fields[0]}
+		}
+
+		var k dto.VersionedKey
+		k.Kvno, err = strconv.Atoi(fields[0])
+		if err != nil || k.Kvno < 1 {
+			return nil, fmt.Errorf("malformed key version %q in %s", fields[0], keyFile)
+		}
+		k.Key, err = hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed key version %d in %s", k.Kvno, keyFile)
+		}
+		if len(k.Key) != config.SymmKeyDim/8 {
+			return nil, fmt.Errorf("key version %d in %s not matching with symmetric key dim", k.Kvno, keyFile)
+		}
+		if len(fields) > 2 {
+			k.Expires, err = strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed expiration of key version %d in %s", k.Kvno, keyFile)
+			}
+		}
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no key in " + keyFile)
+	}
+
+	//THE CURRENT KEY IS THE LAST VERSION
+	slices.SortFunc(keys, func(a, b dto.VersionedKey) int { return b.Kvno - a.Kvno })
+	return keys, nil
+}
+
+// WriteKeyFile writes keys to keyFile, readable only by its owner. The keys are written to a temporary file
+// renamed over keyFile, so a running service never reads half a key file
+func WriteKeyFile(keyFile string, keys dto.KeySet) error {
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(strconv.Itoa(k.Kvno) + " " + hex.EncodeToString(k.Key))
+		if k.Expires != 0 {
+			sb.WriteString(" " + strconv.FormatInt(k.Expires, 10))
+		}
+		sb.WriteString("\n")
+	}
+
+	keyFile = filepath.Clean(keyFile)
+	tmp, err := os.CreateTemp(filepath.Dir(keyFile), "."+filepath.Base(keyFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(sb.String())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), keyFile)
+}
+
+// serviceKeyLoader returns a function returning the keys of serviceId in keyFile (see ReadServiceKeys). The keys
+// are kept until the modification time or the size of the file change, so a rotated key is used at the next request
+// without reading the file at every request
+func serviceKeyLoader(keyFile string, serviceId string) func() (dto.KeySet, error) {
+	var mu sync.Mutex
+	var keys dto.KeySet
+	var modTime time.Time
+	var size int64
+
+	return func() (dto.KeySet, error) {
+		info, err := os.Stat(filepath.Clean(keyFile))
+		if err != nil {
+			return nil, err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if keys != nil && info.ModTime().Equal(modTime) && info.Size() == size {
+			return keys, nil
+		}
+
+		newKeys, err := ReadServiceKeys(keyFile, serviceId)
+		if err != nil {
+			return nil, err
+		}
+		keys, modTime, size = newKeys, info.ModTime(), info.Size()
+		return keys, nil
+	}
+}
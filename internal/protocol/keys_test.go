@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/security"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyFileVersions(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "svc.key")
+	oldKey := security.GenerateRandomKey(config.SymmKeyDim)
+	newKey := security.GenerateRandomKey(config.SymmKeyDim)
+
+	//A KEY FILE WITHOUT VERSIONS HOLDS THE FIRST ONE, USED BY THE TICKETS WITHOUT A KVNO TOO
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(oldKey)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ReadKeyFile(keyFile)
+	if err != nil {
+		t.Fatalf("ReadKeyFile: %v", err)
+	}
+	now := time.Now().UnixMilli()
+	if key, ok := keys.Find(0, now); !ok || !bytes.Equal(key, oldKey) {
+		t.Errorf("legacy key not found for kvno 0")
+	}
+
+	//AFTER A ROTATION THE PREVIOUS KEY IS VALID UNTIL IT EXPIRES
+	expires := now + 1000
+	err = WriteKeyFile(keyFile, dto.KeySet{{Kvno: 2, Key: newKey}, {Kvno: 1, Key: oldKey, Expires: expires}})
+	if err != nil {
+		t.Fatalf("WriteKeyFile: %v", err)
+	}
+	keys, err = ReadKeyFile(keyFile)
+	if err != nil {
+		t.Fatalf("ReadKeyFile: %v", err)
+	}
+	if current := keys.Current(); current.Kvno != 2 || !bytes.Equal(current.Key, newKey) {
+		t.Errorf("got current key version %d, want 2", current.Kvno)
+	}
+	if key, ok := keys.Find(1, now); !ok || !bytes.Equal(key, oldKey) {
+		t.Errorf("previous key not found before it expires")
+	}
+	if _, ok := keys.Find(1, expires); ok {
+		t.Errorf("previous key found after it expired")
+	}
+	if _, ok := keys.Find(3, now); ok {
+		t.Errorf("unknown key version found")
+	}
+}
+
+func TestServiceKeyLoader(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "svc.key")
+	oldKey := security.GenerateRandomKey(config.SymmKeyDim)
+	newKey := security.GenerateRandomKey(config.SymmKeyDim)
+
+	if err := WriteKeyFile(keyFile, dto.KeySet{{Kvno: 1, Key: oldKey}}); err != nil {
+		t.Fatal(err)
+	}
+	keys := serviceKeyLoader(keyFile, "svc")
+	if current, err := keys(); err != nil || !bytes.Equal(current.Current().Key, oldKey) {
+		t.Fatalf("got %v, %v, want the key written", current, err)
+	}
+
+	//A ROTATION REPLACES THE FILE, THE NEXT CALL READS THE NEW KEY
+	if err := WriteKeyFile(keyFile, dto.KeySet{{Kvno: 2, Key: newKey}, {Kvno: 1, Key: oldKey, Expires: time.Now().UnixMilli() + 60000}}); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(keyFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if current, err := keys(); err != nil || !bytes.Equal(current.Current().Key, newKey) {
+		t.Fatalf("got %v, %v, want the rotated key", current, err)
+	}
+
+	//NO TEMPORARY FILE IS LEFT BEHIND
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("got %d files in the key directory, want only the key file", len(files))
+	}
+}
+
+func TestKeytabServiceKeys(t *testing.T) {
+	keytabFile := filepath.Join(t.TempDir(), "svc.keytab")
+	oldKey := security.GenerateRandomKey(config.SymmKeyDim)
+	newKey := security.GenerateRandomKey(config.SymmKeyDim)
+
+	entries := []security.KeytabEntry{
+		{Principal: "svc", Realm: config.Realm, Kvno: 1, Enctype: security.EnctypeAesCbcHmac, Key: oldKey},
+		{Principal: "svc", Realm: config.Realm, Kvno: 2, Enctype: security.EnctypeAesGcm, Key: newKey},
+		{Principal: "svc", Realm: config.Realm, Kvno: 2, Enctype: security.EnctypeAesCbcHmac, Key: newKey},
+		{Principal: "other", Realm: config.Realm, Kvno: 3, Enctype: security.EnctypeAesGcm, Key: security.GenerateRandomKey(config.SymmKeyDim)},
+		{Principal: "svc", Realm: config.Realm, Kvno: 4, OtherEnctype: 18, Key: make([]byte, 32)},
+		{Principal: "svc", Realm: config.Realm, Kvno: 5, OtherEnctype: 1, Key: make([]byte, config.SymmKeyDim/8)},
+	}
+	if err := security.WriteKeytab(keytabFile, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	//ONLY THE KEYS OF THE SERVICE WITH ENCTYPES OF THIS IMPLEMENTATION ARE USED
+	keys, err := ReadServiceKeys(keytabFile, "svc")
+	if err != nil {
+		t.Fatalf("ReadServiceKeys: %v", err)
+	}
+	if len(keys) != 2 || keys.Current().Kvno != 2 || !bytes.Equal(keys.Current().Key, newKey) || keys[1].Kvno != 1 {
+		t.Errorf("got keys %+v, want versions 2 and 1", keys)
+	}
+}
+
+func TestKeytabKeySizes(t *testing.T) {
+	keytabFile := filepath.Join(t.TempDir(), "svc.keytab")
+
+	//KEYS OF ANY AES SIZE ARE USED, WHATEVER THE CONFIGURED SIZE
+	for _, size := range []int{16, 24, 32} {
+		key := security.GenerateRandomKey(size * 8)
+		entries := []security.KeytabEntry{{Principal: "svc", Realm: config.Realm, Kvno: 1, Enctype: security.EnctypeAesGcm, Key: key}}
+		if err := security.WriteKeytab(keytabFile, entries); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := ReadServiceKeys(keytabFile, "svc")
+		if err != nil {
+			t.Fatalf("ReadServiceKeys with a key of %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(keys.Current().Key, key) {
+			t.Errorf("got another key than the one of %d bytes", size)
+		}
+	}
+
+	//A KEY OF ANOTHER SIZE IS AN ERROR NAMING THE SIZE
+	entries := []security.KeytabEntry{{Principal: "svc", Realm: config.Realm, Kvno: 1, Enctype: security.EnctypeAesGcm, Key: make([]byte, 20)}}
+	if err := security.WriteKeytab(keytabFile, entries); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadServiceKeys(keytabFile, "svc"); err == nil || !strings.Contains(err.Error(), "20") {
+		t.Errorf("got %v, want an error naming the key size", err)
+	}
+}
@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"database/sql"
+	"fmt"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/kerrors"
+	"simple_kerberos/internal/messages"
+	"simple_kerberos/internal/security"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RequestToTgsFollowingReferrals sends req to the first TGS of serverIps that answers and, if the service belongs to
+// another realm, follows the referrals to the TGS of the next realm (from config.RealmTgs) until a ticket for the
+// service is issued
+func RequestToTgsFollowingReferrals(serverIps []string, clientId string, req messages.TGSRequest, tgsTicketData dto.TicketData) (dto.TicketData, error) {
+
+	ticketData, err := RequestToTgs(serverIps, req, tgsTicketData)
+	if err != nil {
+		return dto.TicketData{}, err
+	}
+
+	for referrals := 0; !dto.SamePrincipal(ticketData.TargetId, req.ServiceId, config.Realm); referrals++ {
+		if referrals >= config.MaxReferrals {
+			return dto.TicketData{}, &kerrors.ReplyError{Msg: "ERROR: too many referrals asking a ticket for " + req.ServiceId}
+		}
+
+		realmTgsIps, ok := config.RealmTgs[ticketData.TargetId]
+		if !ok || len(realmTgsIps) == 0 {
+			return dto.TicketData{}, &kerrors.ReplyError{Msg: "ERROR: got a referral to " + ticketData.TargetId + ", but its address is unknown"}
+		}
+
+		fmt.Println("Referral to " + ticketData.TargetId + " at " + strings.Join(realmTgsIps, ","))
+
+		nextReq, err := PrepareTGSRequest(realmTgsIps[0], clientId, req.ServiceId, ticketData)
+		if err != nil {
+			return dto.TicketData{}, err
+		}
+		nextReq.Till = req.Till
+		nextReq.Options = req.Options
+
+		ticketData, err = RequestToTgs(realmTgsIps, nextReq, ticketData)
+		if err != nil {
+			return dto.TicketData{}, err
+		}
+	}
+
+	return ticketData, nil
+}
+
+// tgsBuildReferralReply issues a TGS ticket for the TGS of the realm of req.ServiceId, encrypted with the key shared
+// with that realm. The client id is qualified with the local realm, so that the other realm knows who it is
+func tgsBuildReferralReply(req messages.TGSRequest, tgsTicket dto.Ticket, db *sql.DB) (messages.Reply, error) {
+
+	realmName := dto.PrincipalRealm(req.ServiceId, config.Realm)
+	exists, err := dao.RealmExists(realmName, db)
+	if err != nil {
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+	}
+	if !exists {
+		return errorReply(messages.ErrPathNotAccepted, "[TGS] ERROR: no trust with realm "+realmName+" to reach "+req.ServiceId, true), nil
+	}
+
+	realm, err := dao.GetRealm(realmName, db)
+	if err != nil {
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+	}
+
+	//REFERRING A CLIENT OF ANOTHER REALM ONWARD ADDS THIS REALM TO THE TRANSITED PATH, WHICH CAN'T LOOP
+	clientRealm := dto.PrincipalRealm(tgsTicket.ClientId, config.Realm)
+	transited := tgsTicket.Transited
+	if clientRealm != config.Realm {
+		transited = append(slices.Clone(transited), config.Realm)
+	}
+	if realmName == clientRealm || slices.Contains(transited, realmName) {
+		return errorReply(messages.ErrPathNotAccepted, "[TGS] ERROR: "+tgsTicket.ClientId+" already went through realm "+realmName, true), nil
+	}
+
+	//THE REFERRAL TICKET CAN'T OUTLIVE THE TGS TICKET
+	timestamp := time.Now().UnixMilli()
+	lifetime := min(grantedLifetime(timestamp, req.Till), tgsTicket.Timestamp+tgsTicket.Lifetime-timestamp)
+	if lifetime <= 0 {
+		return errorReply(messages.ErrNeverValid, "[TGS] ERROR: requested end time for "+req.ServiceId+" is in the past", true), nil
+	}
+
+	enctype, ok := ticketEnctype(req.Enctypes, realm.Enctypes)
+	if !ok {
+		return errorReply(messages.ErrEtypeNoSupp, "[TGS] ERROR: no enctype shared by "+tgsTicket.ClientId+" and realm "+realm.Realm, true), nil
+	}
+
+	flags := tgsTicket.Flags & (dto.FlagPreAuthent | dto.FlagForwarded | dto.FlagProxy)
+	flags |= req.Options & tgsTicket.Flags & (dto.FlagForwardable | dto.FlagProxiable)
+
+	referralTicket := dto.Ticket{
+		Key:           security.GenerateRandomKey(config.SymmKeyDim),
+		Enctype:       enctype,
+		ClientId:      dto.QualifyPrincipal(tgsTicket.ClientId, config.Realm),
+		ClientAddress: tgsTicket.ClientAddress,
+		TargetId:      dto.QualifyPrincipal(realm.TgsId, realm.Realm),
+		Timestamp:     timestamp,
+		Lifetime:      lifetime,
+		Flags:         flags,
+		Transited:     transited,
+	}
+
+	fmt.Println("[TGS]: OK " + tgsTicket.ClientId + " referral to " + referralTicket.TargetId + " for " + req.ServiceId)
+	return tgsTicketReply(req, tgsTicket, referralTicket, realm.VersionedKey())
+}
+
+// checkTransited checks a ticket issued by the TGS of ticketRealm. The client must belong to ticketRealm or, if it
+// was referred through other realms, to the first realm of the path, ending with ticketRealm. Clients of this realm
+// are never accepted from other realms, and every realm transited must be trusted here too
+func checkTransited(ticket dto.Ticket, ticketRealm string, db *sql.DB) (bool, string, error) {
+	clientRealm := dto.PrincipalRealm(ticket.ClientId, config.Realm)
+	if clientRealm == config.Realm {
+		return false, "realm " + ticketRealm + " issued a ticket for " + ticket.ClientId + " of this realm", nil
+	}
+
+	issuer := clientRealm
+	if len(ticket.Transited) > 0 {
+		issuer = ticket.Transited[len(ticket.Transited)-1]
+	}
+	if issuer != ticketRealm {
+		return false, "realm " + ticketRealm + " issued a ticket for " + ticket.ClientId + " not referred by it", nil
+	}
+
+	path := append([]string{clientRealm}, ticket.Transited...)
+	for i, realmName := range path {
+		if realmName == config.Realm || slices.Contains(path[:i], realmName) {
+			return false, "transited path " + strings.Join(path, ",") + " of " + ticket.ClientId + " loops", nil
+		}
+		if i == 0 {
+			continue
+		}
+		trusted, err := dao.RealmExists(realmName, db)
+		if err != nil {
+			return false, "", err
+		}
+		if !trusted {
+			return false, "transited path " + strings.Join(path, ",") + " of " + ticket.ClientId + " goes through realm " + realmName + " not trusted", nil
+		}
+	}
+
+	return true, "", nil
+}
+
+// tgsGetRealm returns the trusted realm with the inter-realm key
+func tgsGetRealm(realmName string, db *sql.DB) (dto.Realm, bool, error) {
+	exists, err := dao.RealmExists(realmName, db)
+	if err != nil || !exists {
+		return dto.Realm{}, false, err
+	}
+
+	realm, err := dao.GetRealm(realmName, db)
+	if err != nil {
+		return dto.Realm{}, false, err
+	}
+	return realm, true, nil
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"path/filepath"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/security"
+	"testing"
+)
+
+func TestCheckTransited(t *testing.T) {
+	db, err := dao.OpenEncryptedTGSDb(filepath.Join(t.TempDir(), "tgs1.db"), testAdminPwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, realm := range []string{"B.REALM", "C.REALM"} {
+		if err := dao.InsertRealm(realm, "tgs1", security.GenerateRandomKey(config.SymmKeyDim), security.SupportedEnctypes, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name        string
+		clientId    string
+		transited   []string
+		ticketRealm string
+		ok          bool
+	}{
+		{"client of the issuing realm", "bob@B.REALM", nil, "B.REALM", true},
+		{"client referred through a trusted realm", "carl@D.REALM", []string{"B.REALM"}, "B.REALM", true},
+		{"local client", "admin", nil, "B.REALM", false},
+		{"qualified local client", "admin@" + config.Realm, nil, "B.REALM", false},
+		{"client of another realm", "carl@C.REALM", nil, "B.REALM", false},
+		{"issuer not last in path", "carl@D.REALM", []string{"B.REALM", "C.REALM"}, "B.REALM", false},
+		{"path through an untrusted realm", "carl@D.REALM", []string{"E.REALM", "B.REALM"}, "B.REALM", false},
+		{"path through this realm", "carl@D.REALM", []string{config.Realm, "B.REALM"}, "B.REALM", false},
+		{"path loop", "carl@B.REALM", []string{"C.REALM", "B.REALM"}, "B.REALM", false},
+	} {
+		ok, reason, err := checkTransited(dto.Ticket{ClientId: tc.clientId, Transited: tc.transited}, tc.ticketRealm, db)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if ok != tc.ok {
+			t.Errorf("%s: got %v (%s), want %v", tc.name, ok, reason, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dao"
+	"simple_kerberos/internal/dto"
+	"sync"
+	"time"
+)
+
+// replayPurgeInterval is the number of authenticators stored between two deletions of the expired ones from the db
+const replayPurgeInterval = 1000
+
+// ReplayCache remembers the authenticators accepted inside the freshness window, so that
+// a captured TGSRequest or ServiceRequest can't be sent again while it is still fresh.
+// If a db is attached the entries survive a restart of the server.
+type ReplayCache struct {
+	mu      sync.Mutex
+	entries map[string]int64
+	order   []queuedAuth
+	inserts int
+	db      *sql.DB
+}
+
+type queuedAuth struct {
+	key       string
+	timestamp int64
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{
+		entries: make(map[string]int64),
+	}
+}
+
+func NewPersistentReplayCache(path string) (*ReplayCache, error) {
+	db, err := dao.OpenReplayCacheDb(path)
+	if err != nil {
+		return nil, err
+	}
+
+	//DROP EXPIRED ENTRIES AND LOAD THE OTHERS
+	err = dao.DeleteReplayEntriesOlderThan(replayWindowStart(), db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	entries, err := dao.GetAllReplayEntries(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	rc := NewReplayCache()
+	rc.db = db
+	for _, e := range entries {
+		rc.store(replayKey(e.ClientId, e.Timestamp, e.AuthHash), e.Timestamp)
+	}
+
+	return rc, nil
+}
+
+// openReplayCache returns a persistent cache when enabled in the config, falling back to
+// an in-memory one if the db can't be opened
+func openReplayCache(path string) *ReplayCache {
+	if !config.Current().PersistReplayCache {
+		return NewReplayCache()
+	}
+
+	rc, err := NewPersistentReplayCache(path)
+	if err != nil {
+		fmt.Println("Can't open replay cache db, using an in-memory one: ", err)
+		return NewReplayCache()
+	}
+	return rc
+}
+
+// CheckAndStore returns false if the authenticator has already been seen, otherwise it
+// stores it and returns true
+func (rc *ReplayCache) CheckAndStore(clientId string, timestamp int64, encryptedAuth []byte) (bool, error) {
+	hash := sha256.Sum256(encryptedAuth)
+	key := replayKey(clientId, timestamp, hash[:])
+
+	rc.mu.Lock()
+	rc.expire(replayWindowStart())
+	if _, found := rc.entries[key]; found {
+		rc.mu.Unlock()
+		return false, nil
+	}
+	rc.store(key, timestamp)
+	rc.inserts++
+	purge := rc.inserts%replayPurgeInterval == 0
+	rc.mu.Unlock()
+
+	//THE DB IS WRITTEN OUTSIDE THE LOCK, SO THE OTHER REQUESTS DON'T WAIT FOR THE DISK
+	if rc.db == nil {
+		return true, nil
+	}
+	if purge {
+		rc.purge()
+	}
+	entry := dto.ReplayEntry{
+		ClientId:  clientId,
+		Timestamp: timestamp,
+		AuthHash:  hash[:],
+	}
+	if err := dao.InsertReplayEntry(entry, rc.db); err != nil {
+		return true, err
+	}
+
+	return true, nil
+}
+
+func (rc *ReplayCache) Close() error {
+	if rc.db == nil {
+		return nil
+	}
+	return rc.db.Close()
+}
+
+func (rc *ReplayCache) store(key string, timestamp int64) {
+	rc.entries[key] = timestamp
+	rc.order = append(rc.order, queuedAuth{key: key, timestamp: timestamp})
+}
+
+// authenticators older than the freshness window (plus the clock skew) are already rejected by checkTicketValidity,
+// so there is no need to remember them. The entries are queued in arrival order, which follows the order of their
+// timestamps up to the clock skew of the clients, so only the head of the queue is looked at: an entry behind one
+// with a later timestamp is dropped a bit late, never too early
+func (rc *ReplayCache) expire(limit int64) {
+	expired := 0
+	for _, queued := range rc.order {
+		if queued.timestamp >= limit {
+			break
+		}
+		delete(rc.entries, queued.key)
+		expired++
+	}
+
+	//THE ARRAY IS COPIED WHEN MOST OF IT IS HELD BY EXPIRED ENTRIES, SO THEY CAN BE FREED
+	rc.order = rc.order[expired:]
+	if cap(rc.order) > 2*len(rc.order)+64 {
+		rc.order = append([]queuedAuth(nil), rc.order...)
+	}
+}
+
+// purge deletes the expired entries from the db, every replayPurgeInterval insertions instead of at every request
+func (rc *ReplayCache) purge() {
+	if err := dao.DeleteReplayEntriesOlderThan(replayWindowStart(), rc.db); err != nil {
+		fmt.Println("Can't delete expired entries of the replay cache db: ", err)
+	}
+}
+
+func replayKey(clientId string, timestamp int64, authHash []byte) string {
+	return clientId + "|" + fmt.Sprint(timestamp) + "|" + hex.EncodeToString(authHash)
+}
+
+// replayWindowStart returns the time before which authenticators are too old to be accepted
+func replayWindowStart() int64 {
+	settings := config.Current()
+	return time.Now().UnixMilli() - settings.AuthenticatorFreshnessTime - settings.MaxClockSkew
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"path/filepath"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dao"
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	saveConfig(t)
+	config.Update(func(s *config.Settings) {
+		s.AuthenticatorFreshnessTime = 100
+		s.MaxClockSkew = 0
+	})
+	rc := NewReplayCache()
+
+	now := time.Now().UnixMilli()
+	fresh, err := rc.CheckAndStore("alice", now, []byte("auth1"))
+	if err != nil || !fresh {
+		t.Fatalf("first authenticator: fresh %v, error %v", fresh, err)
+	}
+	fresh, err = rc.CheckAndStore("alice", now, []byte("auth1"))
+	if err != nil || fresh {
+		t.Fatalf("replayed authenticator: fresh %v, error %v", fresh, err)
+	}
+	fresh, err = rc.CheckAndStore("alice", now, []byte("auth2"))
+	if err != nil || !fresh {
+		t.Fatalf("other authenticator with the same timestamp: fresh %v, error %v", fresh, err)
+	}
+
+	//ONCE THE WINDOW IS OVER THE ENTRIES ARE DROPPED
+	time.Sleep(150 * time.Millisecond)
+	fresh, err = rc.CheckAndStore("alice", time.Now().UnixMilli(), []byte("auth3"))
+	if err != nil || !fresh {
+		t.Fatalf("authenticator after the window: fresh %v, error %v", fresh, err)
+	}
+	if len(rc.entries) != 1 || len(rc.order) != 1 {
+		t.Errorf("%d entries and %d queued after the window, want 1", len(rc.entries), len(rc.order))
+	}
+}
+
+func TestPersistentReplayCache(t *testing.T) {
+	saveConfig(t)
+	path := filepath.Join(t.TempDir(), "test.rcache")
+
+	rc, err := NewPersistentReplayCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UnixMilli()
+	expired := now - config.Current().AuthenticatorFreshnessTime - config.Current().MaxClockSkew - 1000
+	if _, err := rc.CheckAndStore("alice", now, []byte("auth1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.CheckAndStore("alice", expired, []byte("auth2")); err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+
+	//AFTER A RESTART THE FRESH AUTHENTICATOR IS STILL A REPLAY AND THE EXPIRED ONE IS DELETED
+	rc, err = NewPersistentReplayCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	fresh, err := rc.CheckAndStore("alice", now, []byte("auth1"))
+	if err != nil || fresh {
+		t.Fatalf("authenticator replayed after a restart: fresh %v, error %v", fresh, err)
+	}
+	entries, err := dao.GetAllReplayEntries(rc.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Timestamp != now {
+		t.Errorf("entries in the db after a restart: %v, want only the fresh one", entries)
+	}
+}
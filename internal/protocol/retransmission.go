@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"net"
+	config "simple_kerberos/configs"
+	"sync"
+	"time"
+)
+
+// maxCachedReplies bounds the replies remembered by a server, the oldest ones are dropped first
+const maxCachedReplies = 10000
+
+// retransmissionCache remembers the replies sent in the freshness window, so that a client retransmitting a request
+// whose reply got lost (or is still being built) gets the same reply instead of having its authenticator rejected
+// as a replay. The replies are kept by address of the client too, so a request captured and sent again from
+// another host is handled as a new one (and rejected by the checks of the address and of the replay cache)
+type retransmissionCache struct {
+	mu      sync.Mutex
+	replies map[replyKey]*cachedReply
+	order   []*cachedReply
+}
+
+type replyKey struct {
+	clientIp string
+	hash     [sha256.Size]byte
+}
+
+type cachedReply struct {
+	key       replyKey
+	done      chan struct{}
+	data      []byte
+	err       error
+	timestamp int64
+}
+
+func newRetransmissionCache() *retransmissionCache {
+	return &retransmissionCache{replies: make(map[replyKey]*cachedReply)}
+}
+
+// handler wraps onRequest, answering retransmitted requests with the reply of the first one
+func (rc *retransmissionCache) handler(onRequest func([]byte, *net.UDPAddr) ([]byte, error)) func([]byte, *net.UDPAddr) ([]byte, error) {
+	return func(data []byte, clientAddr *net.UDPAddr) ([]byte, error) {
+		key := replyKey{hash: sha256.Sum256(data)}
+		if clientAddr != nil {
+			key.clientIp = clientAddr.IP.String()
+		}
+		now := time.Now().UnixMilli()
+
+		rc.mu.Lock()
+		rc.expire(now)
+		cached, ok := rc.replies[key]
+		if ok {
+			rc.mu.Unlock()
+			<-cached.done
+			return cached.data, cached.err
+		}
+		cached = &cachedReply{key: key, done: make(chan struct{}), timestamp: now}
+		rc.replies[key] = cached
+		rc.order = append(rc.order, cached)
+		rc.mu.Unlock()
+
+		cached.data, cached.err = onRequest(data, clientAddr)
+		close(cached.done)
+
+		return cached.data, cached.err
+	}
+}
+
+// expire drops the replies older than the freshness window and, over maxCachedReplies, the oldest ones.
+// The replies are added in time order, so only the head of the queue is looked at
+func (rc *retransmissionCache) expire(now int64) {
+	expired := 0
+	for _, cached := range rc.order {
+		if now-cached.timestamp <= config.Current().AuthenticatorFreshnessTime && len(rc.order)-expired < maxCachedReplies {
+			break
+		}
+		delete(rc.replies, cached.key)
+		expired++
+	}
+
+	//THE ARRAY IS COPIED WHEN MOST OF IT IS HELD BY EXPIRED REPLIES, SO THEY CAN BE FREED
+	rc.order = rc.order[expired:]
+	if cap(rc.order) > 2*len(rc.order)+64 {
+		rc.order = append([]*cachedReply(nil), rc.order...)
+	}
+}
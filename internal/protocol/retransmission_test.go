@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetransmissionCache(t *testing.T) {
+	var handled atomic.Int32
+	handler := newRetransmissionCache().handler(func(data []byte, clientAddr *net.UDPAddr) ([]byte, error) {
+		handled.Add(1)
+		return []byte("reply to " + clientAddr.IP.String()), nil
+	})
+
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+	retryOverTcp := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40001}
+	attacker := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 40000}
+	req := []byte("request")
+
+	//THE RETRANSMISSION OF THE CLIENT, EVEN FROM ANOTHER PORT, GETS THE REPLY ALREADY BUILT
+	first, _ := handler(req, client)
+	again, _ := handler(req, retryOverTcp)
+	if string(again) != string(first) || handled.Load() != 1 {
+		t.Errorf("retransmission handled %d times, got %q want %q", handled.Load(), again, first)
+	}
+
+	//THE SAME BYTES FROM ANOTHER HOST ARE A NEW REQUEST, LEFT TO THE CHECKS OF THE HANDLER
+	replayed, _ := handler(req, attacker)
+	if handled.Load() != 2 || string(replayed) == string(first) {
+		t.Errorf("request from another address answered from the cache: %q", replayed)
+	}
+}
@@ -1,41 +1,81 @@
 package protocol
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	config "simple_kerberos/configs"
 	"simple_kerberos/internal/dto"
 	"simple_kerberos/internal/messages"
-	"simple_kerberos/internal/network"
 	"simple_kerberos/internal/security"
+	"time"
 )
 
-func StartService(serverIp string, serverPort int, serviceId string, key []byte) {
+// AuthenticatedClient is what the service application knows about an authenticated client: its ticket (so it can check
+// client, flags and validity) and, if the client forwarded it, a TGS ticket to act on its behalf
+type AuthenticatedClient struct {
+	Ticket          dto.Ticket
+	ForwardedTicket *dto.TicketData
+	serviceId       string
+}
+
+// KeepForwardedTicket stores the TGS ticket forwarded by the client in the forwarded tickets of the service, where
+// RetriveForwardedTGSTicket finds it. Forwarded tickets are kept only if the application asks for it
+func (c AuthenticatedClient) KeepForwardedTicket() error {
+	if c.ForwardedTicket == nil {
+		return errors.New("no ticket forwarded by " + c.Ticket.ClientId)
+	}
+	return SaveForwardedTGSTicket(c.serviceId, c.Ticket.ClientId, *c.ForwardedTicket)
+}
+
+// ServiceApplication is called for every authenticated client, the returned message is sent back to the client
+type ServiceApplication func(client AuthenticatedClient) string
+
+// StartService serves the service requests until ctx is done, it returns an error if it can't listen on serverIp.
+// The keys of the service are read from keyFile (a key file or a keytab) again when the file changes, so a rotated
+// key is used without restarting it
+func StartService(ctx context.Context, serverIp string, serverPort int, serviceId string, keyFile string) error {
+	return StartServiceWithApplication(ctx, serverIp, serverPort, serviceId, keyFile, helloApplication)
+}
+
+func StartServiceWithApplication(ctx context.Context, serverIp string, serverPort int, serviceId string, keyFile string, app ServiceApplication) error {
 	serverAddr := net.UDPAddr{
 		Port: serverPort,
 		IP:   net.ParseIP(serverIp),
 	}
 
-	startService(serverAddr, serviceId, key)
+	return startService(ctx, serverAddr, serviceId, serviceKeyLoader(keyFile, serviceId), nil, app)
 }
 
-func startService(serverAddr net.UDPAddr, serviceId string, key []byte) {
+// startService serves clients with tickets encrypted with one of the keys returned by keys. tgsTicketData is the TGS
+// ticket of a user-to-user peer, which is sent to the clients asking it, nil for services with a long-term key
+func startService(ctx context.Context, serverAddr net.UDPAddr, serviceId string, keys func() (dto.KeySet, error), tgsTicketData *dto.TicketData, app ServiceApplication) error {
+	replayCache := openReplayCache(config.ReplayCachePath + serviceId + ".rcache")
+	defer replayCache.Close()
+
 	fmt.Println("Service " + serviceId + " listening on " + serverAddr.IP.String() + ":" + fmt.Sprint(serverAddr.Port) + "...")
-	network.ListenUDP(serverAddr, 1024, func(b []byte, u *net.UDPAddr) ([]byte, error) {
-		return serviceRequestHandler(b, u, serviceId, key)
+	return serve(ctx, serverAddr, func(b []byte, u *net.UDPAddr) ([]byte, error) {
+		return serviceRequestHandler(b, u, serviceId, keys, tgsTicketData, replayCache, app)
 	}, serviceErrorHandler)
 
 }
 
-func serviceRequestHandler(data []byte, clientAddr *net.UDPAddr, serviceId string, tgsKey []byte) ([]byte, error) {
+func serviceRequestHandler(data []byte, clientAddr *net.UDPAddr, serviceId string, keys func() (dto.KeySet, error), tgsTicketData *dto.TicketData, replayCache *ReplayCache, app ServiceApplication) ([]byte, error) {
 
 	var req messages.ServiceRequest
 	json.Unmarshal(data, &req)
 
 	fmt.Println("[" + serviceId + "]: recieved request")
 
-	reply, err := serviceBuildReply(req, clientAddr, serviceId, tgsKey)
+	var reply messages.Reply
+	var err error
+	if req.AskTGSTicket {
+		reply = peerTGSTicketReply(serviceId, tgsTicketData)
+	} else {
+		reply, err = serviceBuildReply(req, clientAddr, serviceId, keys, replayCache, app)
+	}
 	if err != nil {
 		fmt.Println("["+serviceId+"] Server Error: ", err)
 	}
@@ -48,42 +88,67 @@ func serviceRequestHandler(data []byte, clientAddr *net.UDPAddr, serviceId strin
 	return replyJson, nil
 }
 
-func serviceBuildReply(req messages.ServiceRequest, clientAddr *net.UDPAddr, serviceId string, asKey []byte) (messages.Reply, error) {
+func serviceBuildReply(req messages.ServiceRequest, clientAddr *net.UDPAddr, serviceId string, keys func() (dto.KeySet, error), replayCache *ReplayCache, app ServiceApplication) (messages.Reply, error) {
 
-	//CHECK MAC AND DECRYPT TICKET
-	mac := security.MacData(req.EncryptedTicket, asKey)
-	if !bytes.Equal(mac, req.EncTicketMac) {
-		return errorReply("["+serviceId+"] ERROR: mac check for recieved ticket failed", true), nil
+	//THE TICKET NAMES THE VERSION OF THE KEY IT IS ENCRYPTED WITH
+	serviceKeys, err := keys()
+	if err != nil {
+		return errorReply(messages.ErrGeneric, "["+serviceId+"] ERROR: Generic server error", false), err
+	}
+	key, ok := serviceKeys.Find(req.Kvno, time.Now().UnixMilli())
+	if !ok {
+		return errorReply(messages.ErrBadKeyVer, "["+serviceId+"] ERROR: key version "+fmt.Sprint(req.Kvno)+" of the recieved ticket is unknown or expired", true), nil
 	}
 
-	ticketJson, err := security.SymmetricDecryption(req.EncryptedTicket, asKey)
+	//CHECK INTEGRITY AND DECRYPT TICKET
+	ticketJson, err := security.Decrypt(req.Enctype, key, security.UsageTicket, req.EncryptedTicket, req.EncTicketMac)
+	if err != nil {
+		return errorReply(decryptErrorCode(err), "["+serviceId+"] ERROR: check of recieved ticket failed: "+err.Error(), true), nil
+	}
 	var ticket dto.Ticket
 	err = json.Unmarshal(ticketJson, &ticket)
 	if err != nil {
-		return errorReply("["+serviceId+"] ERROR: inconsistent message recieved", true), nil
+		return errorReply(messages.ErrBadIntegrity, "["+serviceId+"] ERROR: inconsistent message recieved", true), nil
 	}
 
-	if ticket.TargetId != serviceId {
-		return errorReply("["+serviceId+"] ERROR: wrong serviceId", true), nil
+	if !dto.SamePrincipal(ticket.TargetId, serviceId, config.Realm) {
+		return errorReply(messages.ErrNotUs, "["+serviceId+"] ERROR: wrong serviceId", true), nil
 	}
 
-	//CHECK MAC AND DECRYPT AUTHENTICATOR
-	mac = security.MacData(req.EncryptedAuthenticator, ticket.Key)
-	if !bytes.Equal(mac, req.EncAuthenticatorMac) {
-		return errorReply("["+serviceId+"] ERROR: mac check for recieved authenticator failed", true), nil
+	if ticket.Flags.Has(dto.FlagInvalid) {
+		return errorReply(messages.ErrTicketNotYetValid, "["+serviceId+"] ERROR: invalid ticket", true), nil
 	}
 
-	authenticatorJson, err := security.SymmetricDecryption(req.EncryptedAuthenticator, ticket.Key)
+	//CHECK INTEGRITY AND DECRYPT AUTHENTICATOR WITH THE ENCTYPE OF THE SESSION KEY
+	authenticatorJson, err := security.Decrypt(ticket.Enctype, ticket.Key, security.UsageAuthenticator, req.EncryptedAuthenticator, req.EncAuthenticatorMac)
+	if err != nil {
+		return errorReply(decryptErrorCode(err), "["+serviceId+"] ERROR: check of recieved authenticator failed: "+err.Error(), true), nil
+	}
 	var authenticator dto.Authenticator
 	err = json.Unmarshal(authenticatorJson, &authenticator)
 	if err != nil {
-		return errorReply("["+serviceId+"] ERROR: inconsistent authenticator recieved", true), nil
+		return errorReply(messages.ErrBadIntegrity, "["+serviceId+"] ERROR: inconsistent authenticator recieved", true), nil
 	}
 
 	//CHECK AUTHENTICATOR
-	check, reason := checkTicketValidity(authenticator, ticket, clientAddr)
+	check, code, reason := checkTicketValidity(authenticator, ticket, clientAddr)
 	if !check {
-		return errorReply("["+serviceId+"] "+reason, true), nil
+		return errorReply(code, "["+serviceId+"] "+reason, true), nil
+	}
+
+	//CHECK REPLAY
+	fresh, err := replayCache.CheckAndStore(authenticator.ClientId, authenticator.Timestamp, req.EncryptedAuthenticator)
+	if err != nil {
+		fmt.Println("["+serviceId+"] Replay cache error: ", err)
+	}
+	if !fresh {
+		return errorReply(messages.ErrRepeat, "["+serviceId+"] Error: authenticator already used, possible replay attack", true), nil
+	}
+
+	//DECRYPT FORWARDED TICKET
+	forwardedTicket, err := decryptForwardedTicket(req, ticket)
+	if err != nil {
+		return errorReply(decryptErrorCode(err), "["+serviceId+"] ERROR: check of forwarded ticket failed: "+err.Error(), true), nil
 	}
 
 	//CREATE RESPONSE TIMESTAMP
@@ -93,25 +158,54 @@ func serviceBuildReply(req messages.ServiceRequest, clientAddr *net.UDPAddr, ser
 
 	serviceReplyJson, err := json.Marshal(serviceReply)
 	if err != nil {
-		return errorReply("["+serviceId+"] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "["+serviceId+"] ERROR: Generic server error", false), err
 	}
 
-	encryptedServiceReply, err := security.SymmetricEncryption(serviceReplyJson, ticket.Key)
+	encryptedServiceReply, serviceReplyMac, err := security.Encrypt(ticket.Enctype, ticket.Key, security.UsageServiceReply, serviceReplyJson)
 	if err != nil {
-		return errorReply("["+serviceId+"] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "["+serviceId+"] ERROR: Generic server error", false), err
 	}
 
 	reply := messages.Reply{
 		IsError:       false,
-		Message:       "Hello " + ticket.ClientId + ": Authenticated",
+		Message:       app(AuthenticatedClient{Ticket: ticket, ForwardedTicket: forwardedTicket, serviceId: serviceId}),
+		Enctype:       ticket.Enctype,
 		EncryptedData: encryptedServiceReply,
-		EncDataMac:    security.MacData(encryptedServiceReply, ticket.Key),
+		EncDataMac:    serviceReplyMac,
 	}
 
 	fmt.Println("[" + serviceId + "]: OK " + ticket.ClientId + " authenticated")
 	return reply, nil
 }
 
+func helloApplication(client AuthenticatedClient) string {
+	msg := "Hello " + client.Ticket.ClientId + ": Authenticated"
+	if client.Ticket.Flags != 0 {
+		msg += " (ticket flags: " + client.Ticket.Flags.String() + ")"
+	}
+
+	if client.ForwardedTicket != nil {
+		msg += ", forwarded ticket for " + client.ForwardedTicket.TargetId + " received"
+	}
+
+	return msg
+}
+
+// KeepForwardedHelloApplication is helloApplication keeping the TGS tickets forwarded by the clients
+func KeepForwardedHelloApplication(client AuthenticatedClient) string {
+	msg := helloApplication(client)
+	if client.ForwardedTicket == nil {
+		return msg
+	}
+
+	err := client.KeepForwardedTicket()
+	if err != nil {
+		fmt.Println("Can't save forwarded ticket of "+client.Ticket.ClientId+": ", err)
+		return msg + ", not saved"
+	}
+	return msg + " and saved"
+}
+
 func serviceErrorHandler(err error) {
-	fmt.Println("Error recieving UDP packet")
+	fmt.Println("Error recieving request: ", err)
 }
@@ -1,7 +1,8 @@
 package protocol
 
 import (
-	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -9,44 +10,48 @@ import (
 	"simple_kerberos/internal/dao"
 	"simple_kerberos/internal/dto"
 	"simple_kerberos/internal/messages"
-	"simple_kerberos/internal/network"
 	"simple_kerberos/internal/security"
 	"time"
 )
 
-func StartTGS(serverIp string, tgsId string, key []byte, adminPwd string) {
+// StartTGS serves TGS requests until ctx is done, it returns an error if it can't listen on serverIp
+// The keys of the TGS are read from its db at every request, so a rotated key is used without restarting it
+func StartTGS(ctx context.Context, serverIp string, tgsId string, adminPwd string) error {
 	serverAddr := net.UDPAddr{
-		Port: config.TgsPort,
+		Port: config.Current().TgsPort,
 		IP:   net.ParseIP(serverIp),
 	}
 
-	startTGS(serverAddr, tgsId, key, adminPwd)
+	return startTGS(ctx, serverAddr, tgsId, adminPwd)
 }
 
-func StartTGSDefaultIp(tgsId string, key []byte, adminPwd string) {
+func StartTGSDefaultIp(ctx context.Context, tgsId string, adminPwd string) error {
 	serverAddr := net.UDPAddr{
-		Port: config.TgsPort,
+		Port: config.Current().TgsPort,
 	}
 
-	startTGS(serverAddr, tgsId, key, adminPwd)
+	return startTGS(ctx, serverAddr, tgsId, adminPwd)
 }
 
-func startTGS(serverAddr net.UDPAddr, tgsId string, key []byte, adminPwd string) {
+func startTGS(ctx context.Context, serverAddr net.UDPAddr, tgsId string, adminPwd string) error {
+	replayCache := openReplayCache(config.ReplayCachePath + tgsId + ".rcache")
+	defer replayCache.Close()
+
 	fmt.Println("Kerberos TGS " + tgsId + " listening on " + serverAddr.IP.String() + ":" + fmt.Sprint(serverAddr.Port) + "...")
-	network.ListenUDP(serverAddr, 1024, func(b []byte, u *net.UDPAddr) ([]byte, error) {
-		return tgsRequestHandler(b, u, tgsId, key, adminPwd)
+	return serve(ctx, serverAddr, func(b []byte, u *net.UDPAddr) ([]byte, error) {
+		return tgsRequestHandler(b, u, tgsId, adminPwd, replayCache)
 	}, tgsErrorHandler)
 
 }
 
-func tgsRequestHandler(data []byte, clientAddr *net.UDPAddr, tgsId string, asKey []byte, adminPwd string) ([]byte, error) {
+func tgsRequestHandler(data []byte, clientAddr *net.UDPAddr, tgsId string, adminPwd string, replayCache *ReplayCache) ([]byte, error) {
 
 	var req messages.TGSRequest
 	json.Unmarshal(data, &req)
 
 	fmt.Println("[TGS]: recieved request for " + req.ServiceId)
 
-	reply, err := tgsBuildReply(req, clientAddr, tgsId, asKey, adminPwd)
+	reply, err := tgsBuildReply(req, clientAddr, tgsId, adminPwd, replayCache)
 	if err != nil {
 		fmt.Println("[TGS] Server Error: ", err)
 	}
@@ -59,149 +64,339 @@ func tgsRequestHandler(data []byte, clientAddr *net.UDPAddr, tgsId string, asKey
 	return replyJson, nil
 }
 
-func tgsBuildReply(req messages.TGSRequest, clientAddr *net.UDPAddr, tgsId string, asKey []byte, adminPwd string) (messages.Reply, error) {
+func tgsBuildReply(req messages.TGSRequest, clientAddr *net.UDPAddr, tgsId string, adminPwd string, replayCache *ReplayCache) (messages.Reply, error) {
+
+	//OPEN DB
+	db, err := dao.OpenEncryptedTGSDb(config.TgsDbPath+tgsId+".db", adminPwd)
+	if err != nil {
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+	}
+	defer db.Close()
+
+	tgsKeys, err := tgsGetKeySet(tgsId, db)
+	if err != nil {
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+	}
 
-	//CHECK MAC AND DECRYPT TICKET
-	mac := security.MacData(req.EncryptedTicket, asKey)
-	if !bytes.Equal(mac, req.EncTicketMac) {
-		return errorReply("[TGS] ERROR: mac check for recieved ticket for service "+req.ServiceId+" failed", true), nil
+	//TICKETS ISSUED BY THE TGS OF ANOTHER REALM ARE ENCRYPTED WITH THE INTER-REALM KEY
+	ticketKeys := tgsKeys
+	crossRealm := req.TicketRealm != "" && req.TicketRealm != config.Realm
+	if crossRealm {
+		realm, ok, err := tgsGetRealm(req.TicketRealm, db)
+		if err != nil {
+			return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+		}
+		if !ok {
+			return errorReply(messages.ErrPathNotAccepted, "[TGS] ERROR: no trust with realm "+req.TicketRealm, true), nil
+		}
+		ticketKeys, err = dao.GetKeySet(dao.KeyKindRealm, realm.Realm, realm.VersionedKey(), db)
+		if err != nil {
+			return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+		}
 	}
 
-	tgsTicketJson, err := security.SymmetricDecryption(req.EncryptedTicket, asKey)
+	//THE TICKET NAMES THE VERSION OF THE KEY IT IS ENCRYPTED WITH
+	ticketKey, ok := ticketKeys.Find(req.Kvno, time.Now().UnixMilli())
+	if !ok {
+		return errorReply(messages.ErrBadKeyVer, "[TGS] ERROR: key version "+fmt.Sprint(req.Kvno)+" of the ticket for service "+req.ServiceId+" is unknown or expired", true), nil
+	}
+
+	//CHECK INTEGRITY AND DECRYPT TICKET
+	tgsTicketJson, err := security.Decrypt(req.Enctype, ticketKey, security.UsageTicket, req.EncryptedTicket, req.EncTicketMac)
+	if err != nil {
+		return errorReply(decryptErrorCode(err), "[TGS] ERROR: check of recieved ticket for service "+req.ServiceId+" failed: "+err.Error(), true), nil
+	}
 	var tgsTicket dto.Ticket
-	json.Unmarshal(tgsTicketJson, &tgsTicket)
+	err = json.Unmarshal(tgsTicketJson, &tgsTicket)
 	if err != nil {
-		return errorReply("[TGS] ERROR: inconsistent message recieved", true), nil
+		return errorReply(messages.ErrBadIntegrity, "[TGS] ERROR: inconsistent message recieved", true), nil
 	}
 
-	if tgsTicket.TargetId != tgsId {
-		return errorReply("[TGS] ERROR: wrong tsgId", true), nil
+	if !dto.SamePrincipal(tgsTicket.TargetId, tgsId, config.Realm) {
+		return errorReply(messages.ErrNotUs, "[TGS] ERROR: wrong tsgId", true), nil
 	}
 
-	//CHECK MAC AND DECRYPT AUTHENTICATOR
-	mac = security.MacData(req.EncryptedAuthenticator, tgsTicket.Key)
-	if !bytes.Equal(mac, req.EncAuthenticatorMac) {
-		return errorReply("[TGS] ERROR: mac check for recieved authenticator for service "+req.ServiceId+" failed", true), nil
+	//A REALM CAN ONLY VOUCH FOR ITS CLIENTS OR FOR THE ONES REFERRED TO IT THROUGH THE TRANSITED REALMS
+	if crossRealm {
+		ok, reason, err := checkTransited(tgsTicket, req.TicketRealm, db)
+		if err != nil {
+			return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
+		}
+		if !ok {
+			return errorReply(messages.ErrPathNotAccepted, "[TGS] ERROR: "+reason, true), nil
+		}
 	}
 
-	authenticatorJson, err := security.SymmetricDecryption(req.EncryptedAuthenticator, tgsTicket.Key)
+	//CHECK INTEGRITY AND DECRYPT AUTHENTICATOR WITH THE ENCTYPE OF THE SESSION KEY
+	authenticatorJson, err := security.Decrypt(tgsTicket.Enctype, tgsTicket.Key, security.UsageAuthenticator, req.EncryptedAuthenticator, req.EncAuthenticatorMac)
+	if err != nil {
+		return errorReply(decryptErrorCode(err), "[TGS] ERROR: check of recieved authenticator for service "+req.ServiceId+" failed: "+err.Error(), true), nil
+	}
 	var authenticator dto.Authenticator
-	json.Unmarshal(authenticatorJson, &authenticator)
+	err = json.Unmarshal(authenticatorJson, &authenticator)
 	if err != nil {
-		return errorReply("[TGS] ERROR: inconsistent authenticator recieved", true), nil
+		return errorReply(messages.ErrBadIntegrity, "[TGS] ERROR: inconsistent authenticator recieved", true), nil
 	}
 
 	//CHECK AUTHENTICATOR
-	check, reason := checkTicketValidity(authenticator, tgsTicket, clientAddr)
+	check, code, reason := checkTicketValidity(authenticator, tgsTicket, clientAddr)
 	if !check {
-		return errorReply("[TGS] "+reason, true), nil
+		return errorReply(code, "[TGS] "+reason, true), nil
 	}
 
-	//OPEN DB
-	db, err := dao.OpenEncryptedTGSDb(config.TgsDbPath+tgsId+".db", adminPwd)
+	//CHECK REPLAY
+	fresh, err := replayCache.CheckAndStore(authenticator.ClientId, authenticator.Timestamp, req.EncryptedAuthenticator)
 	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+		fmt.Println("[TGS] Replay cache error: ", err)
+	}
+	if !fresh {
+		return errorReply(messages.ErrRepeat, "[TGS] Error: authenticator already used, possible replay attack", true), nil
+	}
+
+	//TICKETS OF OTHER REALMS CAN ONLY BE USED TO GET SERVICE TICKETS OR FURTHER REFERRALS
+	if crossRealm && (req.Validate || req.Renew || req.Options.Has(dto.FlagForwarded) || req.ForUser != "" || len(req.EvidenceTicket) != 0 || len(req.AdditionalTicket) != 0) {
+		return errorReply(messages.ErrPolicy, "[TGS] ERROR: tickets issued by realm "+req.TicketRealm+" can't be renewed, validated, forwarded or used for delegation here", true), nil
+	}
+
+	if req.Validate {
+		return tgsBuildValidateReply(req, tgsTicket, tgsKeys.Current())
+	}
+
+	if tgsTicket.Flags.Has(dto.FlagInvalid) {
+		return errorReply(messages.ErrTicketNotYetValid, "[TGS] ERROR: ticket of "+tgsTicket.ClientId+" is invalid, it must be validated before use", true), nil
+	}
+
+	if req.Renew {
+		return tgsBuildRenewReply(req, tgsTicket, tgsKeys.Current())
+	}
+
+	if req.Options.Has(dto.FlagForwarded) {
+		return tgsBuildForwardReply(req, tgsTicket, tgsId, tgsKeys.Current())
+	}
+
+	if len(req.AdditionalTicket) != 0 {
+		return tgsBuildUserToUserReply(req, tgsTicket, tgsId, tgsKeys)
+	}
+
+	//DELEGATION
+	if req.ForUser != "" {
+		return tgsBuildS4U2SelfReply(req, tgsTicket, db, adminPwd)
+	}
+	if len(req.EvidenceTicket) != 0 {
+		return tgsBuildS4U2ProxyReply(req, tgsTicket, db)
+	}
+
+	//SERVICES OF OTHER REALMS ARE REACHED WITH A REFERRAL TO THE TGS OF THAT REALM
+	if dto.PrincipalRealm(req.ServiceId, config.Realm) != config.Realm {
+		return tgsBuildReferralReply(req, tgsTicket, db)
 	}
-	defer db.Close()
 
 	//RETRIVE SERVICE
-	exists, err := dao.ServiceExists(req.ServiceId, db)
+	service, ok, err := tgsGetService(dto.PrincipalId(req.ServiceId), db)
 	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
 	}
-	if !exists {
-		return errorReply("[TGS] ERROR: unknown "+req.ServiceId+" or other problems", true), nil
+	if !ok {
+		return errorReply(messages.ErrServerUnknown, "[TGS] ERROR: unknown "+req.ServiceId+" or other problems", true), nil
 	}
 
-	service, err := dao.GetServiceByServiceId(req.ServiceId, db)
-	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+	enctype, ok := ticketEnctype(req.Enctypes, service.Enctypes)
+	if !ok {
+		return errorReply(messages.ErrEtypeNoSupp, "[TGS] ERROR: no enctype shared by "+tgsTicket.ClientId+" and "+req.ServiceId, true), nil
 	}
 
 	//CREATE TICKET
 	timestamp := time.Now().UnixMilli()
 	keyClientService := security.GenerateRandomKey(config.SymmKeyDim)
 
+	//POSTDATED SERVICE TICKETS COULDN'T BE VALIDATED, SO THEY ARE NOT ISSUED
+	if req.Options.Has(dto.FlagPostdated) {
+		return errorReply(messages.ErrCannotPostdate, "[TGS] ERROR: postdated service tickets are not supported, use a postdated TGS ticket", true), nil
+	}
+
+	//FLAGS ARE INHERITED FROM THE TGS TICKET
+	flags := tgsTicket.Flags & (dto.FlagPreAuthent | dto.FlagForwarded | dto.FlagProxy)
+	flags |= req.Options & tgsTicket.Flags & (dto.FlagForwardable | dto.FlagProxiable)
+
+	//THE SERVICE TICKET CAN'T OUTLIVE THE TGS TICKET
+	tgsTicketLeft := tgsTicket.Timestamp + tgsTicket.Lifetime - timestamp
+	lifetime := min(grantedLifetime(timestamp, req.Till, service.MaxLifetime), tgsTicketLeft)
+	if lifetime <= 0 {
+		return errorReply(messages.ErrNeverValid, "[TGS] ERROR: requested end time for "+req.ServiceId+" is in the past", true), nil
+	}
+
 	serviceTicket := dto.Ticket{
 		Key:           keyClientService,
+		Enctype:       enctype,
 		ClientId:      tgsTicket.ClientId,
 		ClientAddress: tgsTicket.ClientAddress,
 		TargetId:      req.ServiceId,
 		Timestamp:     timestamp,
-		Lifetime:      config.Lifetime,
+		Lifetime:      lifetime,
+		Flags:         flags,
+		Transited:     tgsTicket.Transited,
+	}
+
+	fmt.Println("[TGS]: OK " + tgsTicket.ClientId + " -> " + req.ServiceId)
+	return tgsTicketReply(req, tgsTicket, serviceTicket, service.VersionedKey())
+}
+
+// tgsBuildRenewReply reissues the presented TGS ticket with the same session key and a fresh
+// validity period, as long as its renewable lifetime is not over
+func tgsBuildRenewReply(req messages.TGSRequest, tgsTicket dto.Ticket, tgsKey dto.VersionedKey) (messages.Reply, error) {
+
+	timestamp := time.Now().UnixMilli()
+	if !tgsTicket.Flags.Has(dto.FlagRenewable) {
+		return errorReply(messages.ErrBadOption, "[TGS] ERROR: ticket of "+tgsTicket.ClientId+" is not renewable", true), nil
+	}
+	if timestamp >= tgsTicket.RenewTill {
+		return errorReply(messages.ErrTicketExpired, "[TGS] ERROR: renewable lifetime of the ticket of "+tgsTicket.ClientId+" is over", true), nil
+	}
+
+	//RENEW TICKET
+	renewedTicket := tgsTicket
+	renewedTicket.Timestamp = timestamp
+	renewedTicket.Lifetime = min(tgsTicket.Lifetime, tgsTicket.RenewTill-timestamp)
+
+	fmt.Println("[TGS]: OK " + tgsTicket.ClientId + " renewed ticket for " + tgsTicket.TargetId)
+	return tgsTicketReply(req, tgsTicket, renewedTicket, tgsKey)
+}
+
+// tgsBuildValidateReply reissues a postdated TGS ticket without the invalid flag once its start time has come
+func tgsBuildValidateReply(req messages.TGSRequest, tgsTicket dto.Ticket, tgsKey dto.VersionedKey) (messages.Reply, error) {
+
+	if !tgsTicket.Flags.Has(dto.FlagInvalid) {
+		return errorReply(messages.ErrBadOption, "[TGS] ERROR: ticket of "+tgsTicket.ClientId+" doesn't need to be validated", true), nil
 	}
 
+	//VALIDATE TICKET
+	validatedTicket := tgsTicket
+	validatedTicket.Flags &^= dto.FlagInvalid
+
+	fmt.Println("[TGS]: OK " + tgsTicket.ClientId + " validated ticket for " + tgsTicket.TargetId)
+	return tgsTicketReply(req, tgsTicket, validatedTicket, tgsKey)
+}
+
+// tgsBuildForwardReply issues a TGS ticket bound to another address, so that the client can forward it to a service
+// that will act on its behalf. A new session key is generated, while the end time of the ticket doesn't change
+func tgsBuildForwardReply(req messages.TGSRequest, tgsTicket dto.Ticket, tgsId string, tgsKey dto.VersionedKey) (messages.Reply, error) {
+
+	if !tgsTicket.Flags.Has(dto.FlagForwardable) {
+		return errorReply(messages.ErrBadOption, "[TGS] ERROR: ticket of "+tgsTicket.ClientId+" is not forwardable", true), nil
+	}
+	if req.ServiceId != tgsId {
+		return errorReply(messages.ErrBadOption, "[TGS] ERROR: only TGS tickets can be forwarded", true), nil
+	}
+	if net.ParseIP(req.Address) == nil {
+		return errorReply(messages.ErrBadAddr, "[TGS] ERROR: invalid address for the forwarded ticket", true), nil
+	}
+
+	//FORWARD TICKET
+	timestamp := time.Now().UnixMilli()
+	forwardedTicket := tgsTicket
+	forwardedTicket.Key = security.GenerateRandomKey(config.SymmKeyDim)
+	forwardedTicket.ClientAddress = req.Address
+	forwardedTicket.Timestamp = timestamp
+	forwardedTicket.Lifetime = tgsTicket.Timestamp + tgsTicket.Lifetime - timestamp
+	forwardedTicket.Flags = (tgsTicket.Flags | dto.FlagForwarded) &^ dto.FlagInitial
+
+	fmt.Println("[TGS]: OK " + tgsTicket.ClientId + " forwarded ticket for " + tgsTicket.TargetId + " to " + req.Address)
+	return tgsTicketReply(req, tgsTicket, forwardedTicket, tgsKey)
+}
+
+// tgsTicketReply builds the reply containing ticket encrypted with targetKey (with the enctype of the ticket), while
+// the ticket data for the client is encrypted with the session key of tgsTicket (the TGS ticket presented by the client).
+// The ticket data names the version of targetKey, so that the target knows which of its keys to use
+func tgsTicketReply(req messages.TGSRequest, tgsTicket dto.Ticket, ticket dto.Ticket, targetKey dto.VersionedKey) (messages.Reply, error) {
+
 	//ENCRYPT TICKET
-	jsonServiceTicket, err := json.Marshal(serviceTicket)
+	jsonTicket, err := json.Marshal(ticket)
 	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
 	}
 
-	encryptedServiceTicket, err := security.SymmetricEncryption(jsonServiceTicket, service.Key)
+	encryptedTicket, ticketMac, err := security.Encrypt(ticket.Enctype, targetKey.Key, security.UsageTicket, jsonTicket)
 	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
 	}
 
 	//CREATE TICKET DATA
 	ticketData := dto.TicketData{
-		Key:             keyClientService,
-		TargetId:        req.ServiceId,
-		Timestamp:       timestamp,
-		Lifetime:        config.Lifetime,
-		EncryptedTicket: encryptedServiceTicket,
-		EncTicketMac:    security.MacData(encryptedServiceTicket, service.Key),
+		Key:             ticket.Key,
+		Enctype:         ticket.Enctype,
+		Kvno:            targetKey.Kvno,
+		TargetId:        ticket.TargetId,
+		Timestamp:       ticket.Timestamp,
+		Lifetime:        ticket.Lifetime,
+		RenewTill:       ticket.RenewTill,
+		Flags:           ticket.Flags,
+		IssuerRealm:     config.Realm,
+		Nonce:           req.Nonce,
+		EncryptedTicket: encryptedTicket,
+		EncTicketMac:    ticketMac,
 	}
 
 	//ENCRYPT TICKET DATA
 	jsonTicketData, err := json.Marshal(ticketData)
 	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
 	}
-	encryptedTicketData, err := security.SymmetricEncryption(jsonTicketData, tgsTicket.Key)
+	encryptedTicketData, ticketDataMac, err := security.Encrypt(tgsTicket.Enctype, tgsTicket.Key, security.UsageTGSReply, jsonTicketData)
 	if err != nil {
-		return errorReply("[TGS] ERROR: Generic server error", false), err
+		return errorReply(messages.ErrGeneric, "[TGS] ERROR: Generic server error", false), err
 	}
 
 	reply := messages.Reply{
 		IsError:       false,
 		Message:       "OK",
+		Enctype:       tgsTicket.Enctype,
 		EncryptedData: encryptedTicketData,
-		EncDataMac:    security.MacData(encryptedTicketData, tgsTicket.Key),
+		EncDataMac:    ticketDataMac,
 	}
 
-	fmt.Println("[TGS]: OK " + tgsTicket.ClientId + " -> " + req.ServiceId)
 	return reply, nil
 }
 
+// tgsGetKeySet returns the current key of the TGS, shared with the AS, and the previous versions
+func tgsGetKeySet(tgsId string, db *sql.DB) (dto.KeySet, error) {
+	_, key, err := dao.GetTgsConfig(db)
+	if err != nil {
+		return nil, err
+	}
+	return dao.GetKeySet(dao.KeyKindTGS, tgsId, key, db)
+}
+
 func tgsErrorHandler(err error) {
-	fmt.Println("Error recieving UDP packet")
+	fmt.Println("Error recieving request: ", err)
 }
 
-func checkTicketValidity(authenticator dto.Authenticator, ticket dto.Ticket, clientAddr *net.UDPAddr) (bool, string) {
+func checkTicketValidity(authenticator dto.Authenticator, ticket dto.Ticket, clientAddr *net.UDPAddr) (bool, messages.ErrorCode, string) {
 
-	if authenticator.Timestamp > time.Now().UnixMilli() {
-		return false, "Error: invalid authenticator, it's coming from the future?!"
+	//TICKET TIMES ARE SET BY THE KDC, WHOSE CLOCK CAN DIFFER FROM THE ONE OF THE SERVER
+	skew := config.Current().MaxClockSkew
+	if time.Now().UnixMilli()+skew < ticket.Timestamp {
+		return false, messages.ErrTicketNotYetValid, "Error: ticket not yet valid"
 	}
 
-	if time.Now().UnixMilli()-authenticator.Timestamp > config.AuthenticatorFreshnessTime {
-		return false, "Error: invalid authenticator, too old"
+	if fresh, reason := checkTimestamp(authenticator.Timestamp); !fresh {
+		return false, messages.ErrSkew, "Error: invalid authenticator, " + reason
 	}
 
-	if time.Now().UnixMilli() > ticket.Timestamp+ticket.Lifetime {
-		return false, "Error: ticket expired"
+	if time.Now().UnixMilli()-skew > ticket.Timestamp+ticket.Lifetime {
+		return false, messages.ErrTicketExpired, "Error: ticket expired"
 	}
 
-	if authenticator.ClientId != ticket.ClientId {
-		return false, "Error: wrong clientId"
+	if !dto.SamePrincipal(authenticator.ClientId, ticket.ClientId, config.Realm) {
+		return false, messages.ErrBadMatch, "Error: wrong clientId"
 	}
 
 	if authenticator.ClientAddress != ticket.ClientAddress {
-		return false, "Error: wrong declared clientAddress"
+		return false, messages.ErrBadAddr, "Error: wrong declared clientAddress"
 	}
 
 	if clientAddr.IP.String() != ticket.ClientAddress {
-		return false, "Error: request recieved from a wrong address"
+		return false, messages.ErrBadAddr, "Error: request recieved from a wrong address"
 	}
 
-	return true, ""
+	return true, messages.ErrNone, ""
 }
@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	config "simple_kerberos/configs"
+	"simple_kerberos/internal/dto"
+	"simple_kerberos/internal/kerrors"
+	"simple_kerberos/internal/messages"
+	"simple_kerberos/internal/security"
+	"time"
+)
+
+// StartUserToUserService serves clients as clientId without a long-term key: the clients get their tickets from the
+// TGS in user-to-user mode, encrypted with the session key of the TGS ticket of clientId
+func StartUserToUserService(ctx context.Context, serverIp string, serverPort int, clientId string, tgsTicketData dto.TicketData) error {
+	serverAddr := net.UDPAddr{
+		Port: serverPort,
+		IP:   net.ParseIP(serverIp),
+	}
+
+	//THE TICKETS OF THE PEERS ARE ENCRYPTED WITH THE SESSION KEY, WHICH HAS NO VERSION
+	keys := func() (dto.KeySet, error) { return dto.KeySet{{Key: tgsTicketData.Key}}, nil }
+	return startService(ctx, serverAddr, clientId, keys, &tgsTicketData, helloApplication)
+}
+
+// RequestPeerTGSTicket asks a user-to-user peer its TGS ticket. Only the encrypted ticket with its enctype and mac and
+// the ID of the TGS that issued it (TargetId) are known, the session key stays with the peer
+func RequestPeerTGSTicket(serverIp string, serverPort int) (dto.TicketData, error) {
+
+	jsonReq, err := json.Marshal(messages.ServiceRequest{AskTGSTicket: true})
+	if err != nil {
+		return dto.TicketData{}, err
+	}
+
+	jsonReply, err := sendRequest(serverIp, serverPort, jsonReq)
+	if err != nil {
+		return dto.TicketData{}, err
+	}
+
+	var reply messages.Reply
+	err = json.Unmarshal(jsonReply, &reply)
+	if err != nil {
+		return dto.TicketData{}, &kerrors.ReplyError{Msg: "ERROR: malformed reply", Err: err}
+	}
+
+	if reply.IsError {
+		return dto.TicketData{}, replyError(reply)
+	}
+
+	peerTicket := dto.TicketData{
+		TargetId:        reply.Message,
+		Enctype:         reply.Enctype,
+		Kvno:            reply.Kvno,
+		EncryptedTicket: reply.EncryptedData,
+		EncTicketMac:    reply.EncDataMac,
+	}
+	return peerTicket, nil
+}
+
+// PrepareUserToUserRequest builds a request asking the TGS a ticket for the user peerId, encrypted with the
+// session key of its TGS ticket (peerTicket, got with RequestPeerTGSTicket)
+func PrepareUserToUserRequest(serverIp string, clientId string, peerId string, peerTicket dto.TicketData, tgsTicketData dto.TicketData) (messages.TGSRequest, error) {
+
+	req, err := PrepareTGSRequest(serverIp, clientId, peerId, tgsTicketData)
+	if err != nil {
+		return messages.TGSRequest{}, err
+	}
+	req.AdditionalTicketEnctype = peerTicket.Enctype
+	req.AdditionalTicketKvno = peerTicket.Kvno
+	req.AdditionalTicket = peerTicket.EncryptedTicket
+	req.AdditionalTicketMac = peerTicket.EncTicketMac
+
+	return req, nil
+}
+
+// peerTGSTicketReply sends the TGS ticket of a user-to-user peer, the ticket is encrypted with the TGS key so
+// it can be sent in clear
+func peerTGSTicketReply(serviceId string, tgsTicketData *dto.TicketData) messages.Reply {
+	if tgsTicketData == nil {
+		return errorReply(messages.ErrBadOption, "["+serviceId+"] ERROR: "+serviceId+" is not a user-to-user service", true)
+	}
+
+	fmt.Println("[" + serviceId + "]: sent TGS ticket for user-to-user authentication")
+	return messages.Reply{
+		IsError:       false,
+		Message:       tgsTicketData.TargetId,
+		Enctype:       tgsTicketData.Enctype,
+		Kvno:          tgsTicketData.Kvno,
+		EncryptedData: tgsTicketData.EncryptedTicket,
+		EncDataMac:    tgsTicketData.EncTicketMac,
+	}
+}
+
+// tgsBuildUserToUserReply issues a ticket for the owner of the additional TGS ticket, encrypted with the session key
+// of that ticket instead of a service key, so that a peer holding only its TGS ticket can verify it
+func tgsBuildUserToUserReply(req messages.TGSRequest, tgsTicket dto.Ticket, tgsId string, tgsKeys dto.KeySet) (messages.Reply, error) {
+
+	tgsKey, ok := tgsKeys.Find(req.AdditionalTicketKvno, time.Now().UnixMilli())
+	if !ok {
+		return errorReply(messages.ErrBadKeyVer, "[TGS] ERROR: key version "+fmt.Sprint(req.AdditionalTicketKvno)+" of the TGS ticket of "+req.ServiceId+" is unknown or expired", true), nil
+	}
+
+	//CHECK INTEGRITY AND DECRYPT ADDITIONAL TICKET
+	peerTicketJson, err := security.Decrypt(req.AdditionalTicketEnctype, tgsKey, security.UsageTicket, req.AdditionalTicket, req.AdditionalTicketMac)
+	if err != nil {
+		return errorReply(decryptErrorCode(err), "[TGS] ERROR: check of the TGS ticket of "+req.ServiceId+" failed: "+err.Error(), true), nil
+	}
+	var peerTicket dto.Ticket
+	err = json.Unmarshal(peerTicketJson, &peerTicket)
+	if err != nil {
+		return errorReply(messages.ErrBadIntegrity, "[TGS] ERROR: inconsistent TGS ticket of "+req.ServiceId+" recieved", true), nil
+	}
+
+	//CHECK ADDITIONAL TICKET
+	timestamp := time.Now().UnixMilli()
+	if !dto.SamePrincipal(peerTicket.TargetId, tgsId, config.Realm) {
+		return errorReply(messages.ErrNotUs, "[TGS] ERROR: the TGS ticket of "+req.ServiceId+" is not for this TGS", true), nil
+	}
+	if !dto.SamePrincipal(peerTicket.ClientId, req.ServiceId, config.Realm) {
+		return errorReply(messages.ErrBadMatch, "[TGS] ERROR: the additional TGS ticket doesn't belong to "+req.ServiceId, true), nil
+	}
+	if peerTicket.Flags.Has(dto.FlagInvalid) || timestamp < peerTicket.Timestamp {
+		return errorReply(messages.ErrTicketNotYetValid, "[TGS] ERROR: the TGS ticket of "+req.ServiceId+" is not valid", true), nil
+	}
+
+	//THE TICKET CAN'T OUTLIVE THE TGS TICKETS OF BOTH USERS
+	lifetime := min(
+		grantedLifetime(timestamp, req.Till),
+		tgsTicket.Timestamp+tgsTicket.Lifetime-timestamp,
+		peerTicket.Timestamp+peerTicket.Lifetime-timestamp,
+	)
+	if lifetime <= 0 {
+		return errorReply(messages.ErrTicketExpired, "[TGS] ERROR: the TGS ticket of "+req.ServiceId+" is expired or the requested end time is in the past", true), nil
+	}
+
+	//THE TICKET IS ENCRYPTED WITH THE SESSION KEY OF THE PEER, WHICH SUPPORTS ONLY THE ENCTYPE OF ITS TGS TICKET
+	enctype, ok := ticketEnctype(req.Enctypes, []security.Enctype{peerTicket.Enctype})
+	if !ok {
+		return errorReply(messages.ErrEtypeNoSupp, "[TGS] ERROR: no enctype shared by "+tgsTicket.ClientId+" and the session key of "+req.ServiceId, true), nil
+	}
+
+	flags := tgsTicket.Flags & (dto.FlagPreAuthent | dto.FlagForwarded | dto.FlagProxy)
+	flags |= req.Options & tgsTicket.Flags & (dto.FlagForwardable | dto.FlagProxiable)
+
+	ticket := dto.Ticket{
+		Key:           security.GenerateRandomKey(config.SymmKeyDim),
+		Enctype:       enctype,
+		ClientId:      tgsTicket.ClientId,
+		ClientAddress: tgsTicket.ClientAddress,
+		TargetId:      req.ServiceId,
+		Timestamp:     timestamp,
+		Lifetime:      lifetime,
+		Flags:         flags,
+	}
+
+	fmt.Println("[TGS]: OK user-to-user " + tgsTicket.ClientId + " -> " + req.ServiceId)
+	return tgsTicketReply(req, tgsTicket, ticket, dto.VersionedKey{Key: peerTicket.Key})
+}
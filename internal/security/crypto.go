@@ -5,9 +5,9 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
-	"crypto/pbkdf2"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
 	config "simple_kerberos/configs"
@@ -42,6 +42,21 @@ func GenerateRandomKey(keyDim int) []byte {
 	return key
 }
 
+// GenerateNonce returns a random non zero nonce used to bind a reply to its request
+func GenerateNonce() (uint32, error) {
+	b := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(rand.Reader, b)
+		if err != nil {
+			return 0, err
+		}
+		nonce := binary.BigEndian.Uint32(b)
+		if nonce != 0 {
+			return nonce, nil
+		}
+	}
+}
+
 func SymmetricEncryption(plaintext []byte, key []byte) ([]byte, error) {
 	//INIT AES ALGORITHM
 	block, err := aes.NewCipher(generateCryptKey(key, config.SymmKeyDim))
@@ -101,11 +116,6 @@ func SymmetricDecryption(ciphertext []byte, key []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-// in this case salt is an example, but also kerberos calculate it in a deterministic way
-func GenerateClientKeyFromPwd(pwd string, keyDim int) ([]byte, error) {
-	return pbkdf2.Key(sha256.New, pwd, []byte("salt"), 4096, keyDim/8)
-}
-
 func MacData(data []byte, key []byte) []byte {
 	mac := hmac.New(sha256.New, generateMacKey(key, config.SymmKeyDim))
 	mac.Write(data)
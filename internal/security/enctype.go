@@ -0,0 +1,252 @@
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	config "simple_kerberos/configs"
+	"slices"
+	"strings"
+)
+
+// Enctype identifies how a message is encrypted and its integrity protected, like the etype of Kerberos.
+// Messages without an enctype (0) come from older versions and use EnctypeAesCbcHmac
+type Enctype int32
+
+const (
+	// AES-CBC with PKCS#7 padding and a separate HMAC-SHA256 of the ciphertext (encrypt-then-MAC)
+	EnctypeAesCbcHmac Enctype = 1
+	// AES-GCM, the message type is bound to the ciphertext as associated data and no separate mac is needed
+	EnctypeAesGcm Enctype = 2
+)
+
+// SupportedEnctypes are the enctypes implemented, from the strongest
+var SupportedEnctypes = []Enctype{EnctypeAesGcm, EnctypeAesCbcHmac}
+
+var enctypeNames = map[Enctype]string{
+	EnctypeAesCbcHmac: "aes-cbc-hmac-sha256",
+	EnctypeAesGcm:     "aes-gcm",
+}
+
+// fileEnctypes are the numbers of the enctypes in MIT keytabs and credential caches. The numbers of this
+// implementation are the ones of des-cbc-crc and des-cbc-md4 for MIT, so the files use numbers of the range
+// reserved for local use (negative, as 16 bit integers)
+var fileEnctypes = map[Enctype]int16{
+	EnctypeAesCbcHmac: -1001,
+	EnctypeAesGcm:     -1002,
+}
+
+// FileNumber returns the number of e in MIT keytabs and credential caches
+func (e Enctype) FileNumber() uint16 {
+	return uint16(fileEnctypes[e.resolve()])
+}
+
+// EnctypeFromFile returns the enctype with number n in MIT keytabs and credential caches, false if it is the
+// enctype of another implementation
+func EnctypeFromFile(n uint16) (Enctype, bool) {
+	for enctype, number := range fileEnctypes {
+		if uint16(number) == n {
+			return enctype, true
+		}
+	}
+	return 0, false
+}
+
+// init registers the enctypes implemented, the only ones accepted in permitted_enctypes
+func init() {
+	for _, enctype := range SupportedEnctypes {
+		config.RegisterEnctype(enctypeNames[enctype])
+	}
+}
+
+// ErrModified is returned by Decrypt when the integrity check fails: the message has been modified or the key is wrong
+var ErrModified = errors.New("integrity check failed")
+
+// ErrUnsupportedEnctype is returned when an enctype is unknown or not permitted by the configuration
+var ErrUnsupportedEnctype = errors.New("enctype not supported")
+
+// Usage is the type of message encrypted. With AEAD enctypes it is the associated data, so a ciphertext
+// can't be passed off as a message of another type
+type Usage string
+
+const (
+	UsagePreAuth       Usage = "pre-auth"
+	UsageTicket        Usage = "ticket"
+	UsageASReply       Usage = "as-reply"
+	UsageTGSReply      Usage = "tgs-reply"
+	UsageAuthenticator Usage = "authenticator"
+	UsageServiceReply  Usage = "service-reply"
+	UsageCred          Usage = "cred"
+)
+
+func (e Enctype) String() string {
+	if name, ok := enctypeNames[e.resolve()]; ok {
+		return name
+	}
+	return fmt.Sprintf("enctype-%d", int32(e))
+}
+
+func (e Enctype) resolve() Enctype {
+	if e == 0 {
+		return EnctypeAesCbcHmac
+	}
+	return e
+}
+
+// ParseEnctypes parses a list of enctype names separated by commas or spaces
+func ParseEnctypes(list string) ([]Enctype, error) {
+	var enctypes []Enctype
+	for _, name := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		found := false
+		for enctype, enctypeName := range enctypeNames {
+			if name == enctypeName {
+				enctypes = append(enctypes, enctype)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown enctype %q", name)
+		}
+	}
+	return enctypes, nil
+}
+
+// FormatEnctypes returns the names of enctypes separated by commas
+func FormatEnctypes(enctypes []Enctype) string {
+	names := make([]string, len(enctypes))
+	for i, enctype := range enctypes {
+		names[i] = enctype.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// PermittedEnctypes returns the enctypes allowed by the configuration (permitted_enctypes), from the strongest
+func PermittedEnctypes() []Enctype {
+	permitted, _ := ParseEnctypes(strings.Join(config.Current().PermittedEnctypes, ","))
+	return slices.DeleteFunc(slices.Clone(SupportedEnctypes), func(e Enctype) bool { return !slices.Contains(permitted, e) })
+}
+
+// StrongestEnctype returns the strongest enctype in all the lists, an empty list stands for a peer that doesn't
+// know enctypes and supports only EnctypeAesCbcHmac. It returns false if there is no enctype in common
+func StrongestEnctype(lists ...[]Enctype) (Enctype, bool) {
+	for _, enctype := range SupportedEnctypes {
+		shared := true
+		for _, list := range lists {
+			if len(list) == 0 {
+				list = []Enctype{EnctypeAesCbcHmac}
+			}
+			shared = shared && slices.ContainsFunc(list, func(e Enctype) bool { return e.resolve() == enctype })
+		}
+		if shared {
+			return enctype, true
+		}
+	}
+	return 0, false
+}
+
+// Encrypt encrypts plaintext with key, returning the ciphertext and its mac (empty for AEAD enctypes)
+func Encrypt(enctype Enctype, key []byte, usage Usage, plaintext []byte) ([]byte, []byte, error) {
+	if !permitted(enctype) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedEnctype, enctype)
+	}
+
+	switch enctype.resolve() {
+	case EnctypeAesCbcHmac:
+		ciphertext, err := SymmetricEncryption(plaintext, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ciphertext, MacData(ciphertext, key), nil
+
+	case EnctypeAesGcm:
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		//GENERATE NONCE
+		nonce := make([]byte, gcm.NonceSize())
+		_, err = io.ReadFull(rand.Reader, nonce)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return gcm.Seal(nonce, nonce, plaintext, []byte(usage)), []byte{}, nil
+	}
+
+	return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedEnctype, enctype)
+}
+
+// Decrypt checks the integrity of ciphertext and decrypts it with key, it returns ErrModified if the check fails
+func Decrypt(enctype Enctype, key []byte, usage Usage, ciphertext []byte, mac []byte) ([]byte, error) {
+	if !permitted(enctype) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEnctype, enctype)
+	}
+
+	switch enctype.resolve() {
+	case EnctypeAesCbcHmac:
+		//CHECK MAC BEFORE DECRYPTING
+		if !hmac.Equal(MacData(ciphertext, key), mac) {
+			return nil, ErrModified
+		}
+		if len(ciphertext) < aes.BlockSize {
+			return nil, errors.New("ciphertext too short")
+		}
+		return SymmetricDecryption(ciphertext, key)
+
+	case EnctypeAesGcm:
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(ciphertext) < gcm.NonceSize() {
+			return nil, ErrModified
+		}
+
+		plaintext, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], []byte(usage))
+		if err != nil {
+			return nil, ErrModified
+		}
+		return plaintext, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedEnctype, enctype)
+}
+
+func permitted(enctype Enctype) bool {
+	return slices.Contains(PermittedEnctypes(), enctype.resolve())
+}
+
+// CheckKeySize returns an error naming the size of key if it is not the size of an AES key (16, 24 or 32 bytes)
+func CheckKeySize(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return aes.KeySizeError(len(key))
+}
+
+// newGCM returns the AEAD of key, whose AES key has the same size: keys of 16, 24 or 32 bytes created with another
+// symmetric_key_bits (e.g. those of a keytab exported before it changed) keep working, other sizes are an error
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if err := CheckKeySize(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(generateAeadKey(key, len(key)*8))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func generateAeadKey(key []byte, keyDim int) []byte {
+	sha := sha256.New()
+	sha.Write(key)
+	sha.Write([]byte("aeadKey"))
+	return sha.Sum(nil)[:keyDim/8]
+}
@@ -0,0 +1,210 @@
+package security
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Keytabs are written in the MIT format, version 0x502 (all integers big-endian):
+
+	keytab:  0x05 0x02 entry*
+	entry:   int32 size (negative for a hole of -size bytes), then size bytes of:
+	         uint16 components, data realm, data component*, uint32 nameType,
+	         uint32 timestamp, uint8 kvno, uint16 enctype, data key, [uint32 kvno]
+	data:    uint16 length, bytes
+
+The enctypes of this implementation are written with numbers of the range for local use (see FileNumber),
+the entries with the enctypes of other implementations are kept with their number
+*/
+
+// KeytabVersion is the first two bytes of a keytab file
+var KeytabVersion = []byte{0x05, 0x02}
+
+// ntPrincipal is the name type of the entries written (KRB5_NT_PRINCIPAL)
+const ntPrincipal = 1
+
+// KeytabEntry is a key of Principal (a name like "svc" or "host/svc", without the realm) for one enctype.
+// Timestamp is the time the key was written (s). Enctype is 0 if the enctype is not one of this implementation,
+// OtherEnctype is then its number in the keytab
+type KeytabEntry struct {
+	Principal    string
+	Realm        string
+	Timestamp    uint32
+	Kvno         uint32
+	Enctype      Enctype
+	OtherEnctype uint16
+	Key          []byte
+}
+
+// IsKeytab tells if data starts like a keytab file
+func IsKeytab(data []byte) bool {
+	return bytes.HasPrefix(data, KeytabVersion)
+}
+
+// ReadKeytab reads all the entries of the keytab file keytabFile
+func ReadKeytab(keytabFile string) ([]KeytabEntry, error) {
+	data, err := os.ReadFile(filepath.Clean(keytabFile))
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeytab(data)
+}
+
+// ParseKeytab parses a keytab, holes left by deleted entries are skipped
+func ParseKeytab(data []byte) ([]KeytabEntry, error) {
+	if !IsKeytab(data) {
+		return nil, errors.New("not a keytab of version 0x502")
+	}
+
+	r := bytes.NewReader(data[len(KeytabVersion):])
+	var entries []KeytabEntry
+	for r.Len() > 0 {
+		var size int32
+		err := binary.Read(r, binary.BigEndian, &size)
+		if err != nil {
+			return nil, fmt.Errorf("malformed keytab entry: %w", err)
+		}
+		if size < 0 {
+			_, err = r.Seek(int64(-size), io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if int64(size) > int64(r.Len()) {
+			return nil, errors.New("malformed keytab entry: truncated")
+		}
+
+		entryData := make([]byte, size)
+		r.Read(entryData)
+		entry, err := parseKeytabEntry(entryData)
+		if err != nil {
+			return nil, fmt.Errorf("malformed keytab entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func parseKeytabEntry(data []byte) (KeytabEntry, error) {
+	var entry KeytabEntry
+	r := bytes.NewReader(data)
+
+	var components uint16
+	err := binary.Read(r, binary.BigEndian, &components)
+	if err != nil {
+		return entry, err
+	}
+	realm, err := readKeytabData(r)
+	if err != nil {
+		return entry, err
+	}
+	entry.Realm = string(realm)
+
+	names := make([]string, components)
+	for i := range names {
+		name, err := readKeytabData(r)
+		if err != nil {
+			return entry, err
+		}
+		names[i] = string(name)
+	}
+	entry.Principal = strings.Join(names, "/")
+
+	var header struct {
+		NameType  uint32
+		Timestamp uint32
+		Kvno      uint8
+		Enctype   uint16
+	}
+	err = binary.Read(r, binary.BigEndian, &header)
+	if err != nil {
+		return entry, err
+	}
+	entry.Timestamp = header.Timestamp
+	entry.Kvno = uint32(header.Kvno)
+	if enctype, ok := EnctypeFromFile(header.Enctype); ok {
+		entry.Enctype = enctype
+	} else {
+		entry.OtherEnctype = header.Enctype
+	}
+
+	entry.Key, err = readKeytabData(r)
+	if err != nil {
+		return entry, err
+	}
+
+	//THE 32 BIT KVNO, IF PRESENT, REPLACES THE 8 BIT ONE
+	var kvno uint32
+	if r.Len() >= 4 {
+		binary.Read(r, binary.BigEndian, &kvno)
+		if kvno != 0 {
+			entry.Kvno = kvno
+		}
+	}
+
+	return entry, nil
+}
+
+func readKeytabData(r *bytes.Reader) ([]byte, error) {
+	var length uint16
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	if int(length) > r.Len() {
+		return nil, errors.New("truncated")
+	}
+	data := make([]byte, length)
+	r.Read(data)
+	return data, nil
+}
+
+// WriteKeytab writes entries to keytabFile, readable only by its owner
+func WriteKeytab(keytabFile string, entries []KeytabEntry) error {
+	return os.WriteFile(filepath.Clean(keytabFile), MarshalKeytab(entries), 0600)
+}
+
+// MarshalKeytab encodes entries as a keytab
+func MarshalKeytab(entries []KeytabEntry) []byte {
+	var buf bytes.Buffer
+	buf.Write(KeytabVersion)
+
+	for _, entry := range entries {
+		var e bytes.Buffer
+		names := strings.Split(entry.Principal, "/")
+		binary.Write(&e, binary.BigEndian, uint16(len(names)))
+		writeKeytabData(&e, []byte(entry.Realm))
+		for _, name := range names {
+			writeKeytabData(&e, []byte(name))
+		}
+		binary.Write(&e, binary.BigEndian, uint32(ntPrincipal))
+		binary.Write(&e, binary.BigEndian, entry.Timestamp)
+		binary.Write(&e, binary.BigEndian, uint8(entry.Kvno))
+		if entry.Enctype != 0 {
+			binary.Write(&e, binary.BigEndian, entry.Enctype.FileNumber())
+		} else {
+			binary.Write(&e, binary.BigEndian, entry.OtherEnctype)
+		}
+		writeKeytabData(&e, entry.Key)
+		binary.Write(&e, binary.BigEndian, entry.Kvno)
+
+		binary.Write(&buf, binary.BigEndian, int32(e.Len()))
+		buf.Write(e.Bytes())
+	}
+
+	return buf.Bytes()
+}
+
+func writeKeytabData(w *bytes.Buffer, data []byte) {
+	binary.Write(w, binary.BigEndian, uint16(len(data)))
+	w.Write(data)
+}
@@ -0,0 +1,74 @@
+package security
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestKeytabRoundTrip(t *testing.T) {
+	keytabFile := filepath.Join(t.TempDir(), "svc.keytab")
+	key := GenerateRandomKey(128)
+
+	entries := []KeytabEntry{
+		{Principal: "svc", Realm: "SIMPLE.KERBEROS", Timestamp: 1700000000, Kvno: 1, Enctype: EnctypeAesCbcHmac, Key: key},
+		{Principal: "host/svc", Realm: "SIMPLE.KERBEROS", Timestamp: 1700000000, Kvno: 300, Enctype: EnctypeAesGcm, Key: key},
+		{Principal: "svc", Realm: "SIMPLE.KERBEROS", Timestamp: 1700000000, Kvno: 2, OtherEnctype: 18, Key: make([]byte, 32)},
+	}
+	if err := WriteKeytab(keytabFile, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ReadKeytab(keytabFile)
+	if err != nil {
+		t.Fatalf("ReadKeytab: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, entries) {
+		t.Errorf("got entries %+v, want %+v", parsed, entries)
+	}
+}
+
+func TestKeytabEnctypeNumbers(t *testing.T) {
+	key := GenerateRandomKey(128)
+
+	//THE ENCTYPES OF THIS IMPLEMENTATION ARE WRITTEN WITH NEGATIVE NUMBERS
+	data := MarshalKeytab([]KeytabEntry{{Principal: "svc", Realm: "R", Kvno: 1, Enctype: EnctypeAesGcm, Key: key}})
+	enctypeOffset := len(KeytabVersion) + 4 + 2 + 2 + len("R") + 2 + len("svc") + 4 + 4 + 1
+	if n := int16(binary.BigEndian.Uint16(data[enctypeOffset:])); n >= 0 {
+		t.Errorf("aes-gcm written as enctype %d, want a number for local use", n)
+	}
+
+	//DES-CBC-CRC (1) AND DES-CBC-MD4 (2) OF MIT ARE NOT READ AS THE ENCTYPES OF THIS IMPLEMENTATION
+	for _, mitEnctype := range []uint16{1, 2} {
+		parsed, err := ParseKeytab(MarshalKeytab([]KeytabEntry{{Principal: "svc", Realm: "R", Kvno: 1, OtherEnctype: mitEnctype, Key: key}}))
+		if err != nil {
+			t.Fatalf("ParseKeytab: %v", err)
+		}
+		if parsed[0].Enctype != 0 || parsed[0].OtherEnctype != mitEnctype {
+			t.Errorf("MIT enctype %d read as %v", mitEnctype, parsed[0].Enctype)
+		}
+	}
+}
+
+func TestKeytabHole(t *testing.T) {
+	entries := []KeytabEntry{{Principal: "svc", Realm: "R", Kvno: 1, Enctype: EnctypeAesGcm, Key: GenerateRandomKey(128)}}
+
+	//A HOLE LEFT BY A DELETED ENTRY IS SKIPPED
+	data := MarshalKeytab(entries)
+	hole := []byte{0xff, 0xff, 0xff, 0xfc, 0, 0, 0, 0}
+	data = append(append(data[:2:2], hole...), data[2:]...)
+
+	parsed, err := ParseKeytab(data)
+	if err != nil {
+		t.Fatalf("ParseKeytab: %v", err)
+	}
+	if len(parsed) != 1 || !bytes.Equal(parsed[0].Key, entries[0].Key) {
+		t.Errorf("got entries %+v, want %+v", parsed, entries)
+	}
+
+	if _, err := ParseKeytab(data[:len(data)-1]); err == nil {
+		t.Error("truncated keytab parsed")
+	}
+}
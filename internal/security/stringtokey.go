@@ -0,0 +1,207 @@
+package security
+
+import (
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	config "simple_kerberos/configs"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// string-to-key algorithms, keys stored without an algorithm are derived with PBKDF2
+const (
+	StringToKeyPbkdf2   = "pbkdf2-sha256"
+	StringToKeyArgon2id = "argon2id"
+	StringToKeyScrypt   = "scrypt"
+)
+
+// scryptBlockSize is the r parameter of scrypt, the memory used is 128 * Iterations * scryptBlockSize bytes
+const scryptBlockSize = 8
+
+// ceilings of the costs: the parameters can come from an AS reply that is not authenticated, so they must not make
+// the client allocate any amount of memory or spend any amount of time. Memory is in KiB
+const (
+	maxStringToKeyMemory = 1024 * 1024
+	maxPbkdf2Iterations  = 10000000
+	maxArgon2Time        = 16
+	maxArgon2Threads     = 255
+	maxScryptN           = maxStringToKeyMemory * 1024 / (128 * scryptBlockSize)
+	maxScryptP           = 16
+)
+
+// stringToKeyStrength orders the algorithms, the memory-hard ones resist brute force on GPUs better than PBKDF2
+var stringToKeyStrength = map[string]int{
+	StringToKeyPbkdf2:   0,
+	StringToKeyArgon2id: 1,
+	StringToKeyScrypt:   1,
+}
+
+// StringToKeyParams are the parameters used to derive the key of a client from its password. The AS stores them
+// with the key and sends them to the client (like the ETYPE-INFO2 of Kerberos), so it can derive the same key.
+// The meaning of the costs depends on Algorithm:
+//   - pbkdf2-sha256: Iterations is the number of iterations
+//   - argon2id: Iterations is the time cost, Memory the memory in KiB and Parallelism the number of threads
+//   - scrypt: Iterations is the cost N (a power of 2) and Parallelism is p
+type StringToKeyParams struct {
+	Algorithm   string
+	Salt        []byte
+	Iterations  int
+	Memory      int
+	Parallelism int
+}
+
+// stringToKeyFunc derives a key of keyLen bytes from pwd, params have already been checked
+type stringToKeyFunc func(pwd string, params StringToKeyParams, keyLen int) ([]byte, error)
+
+// stringToKeyFuncs are the string-to-key algorithms implemented, by name
+var stringToKeyFuncs = map[string]stringToKeyFunc{
+	StringToKeyPbkdf2: func(pwd string, params StringToKeyParams, keyLen int) ([]byte, error) {
+		return pbkdf2.Key(sha256.New, pwd, params.Salt, params.Iterations, keyLen)
+	},
+	StringToKeyArgon2id: func(pwd string, params StringToKeyParams, keyLen int) ([]byte, error) {
+		return argon2.IDKey([]byte(pwd), params.Salt, uint32(params.Iterations), uint32(params.Memory), uint8(params.Parallelism), uint32(keyLen)), nil
+	},
+	StringToKeyScrypt: func(pwd string, params StringToKeyParams, keyLen int) ([]byte, error) {
+		return scrypt.Key([]byte(pwd), params.Salt, params.Iterations, scryptBlockSize, params.Parallelism, keyLen)
+	},
+}
+
+// init registers the string-to-key algorithms implemented, the only ones accepted in string_to_key
+func init() {
+	for _, algorithm := range []string{StringToKeyPbkdf2, StringToKeyArgon2id, StringToKeyScrypt} {
+		config.RegisterStringToKey(algorithm)
+	}
+}
+
+// LegacyStringToKeyParams are the parameters of the keys derived by the previous versions, the same for every client
+var LegacyStringToKeyParams = StringToKeyParams{Algorithm: StringToKeyPbkdf2, Salt: []byte("salt"), Iterations: 4096}
+
+// Equal reports whether p and other derive the same key from the same password
+func (p StringToKeyParams) Equal(other StringToKeyParams) bool {
+	return p.algorithm() == other.algorithm() && bytes.Equal(p.Salt, other.Salt) && p.Iterations == other.Iterations &&
+		p.Memory == other.Memory && p.Parallelism == other.Parallelism
+}
+
+// String describes the algorithm and its costs, without the salt
+func (p StringToKeyParams) String() string {
+	switch p.algorithm() {
+	case StringToKeyArgon2id:
+		return fmt.Sprintf("%s (time %d, memory %d KiB, threads %d)", p.algorithm(), p.Iterations, p.Memory, p.Parallelism)
+	case StringToKeyScrypt:
+		return fmt.Sprintf("%s (N %d, r %d, p %d)", p.algorithm(), p.Iterations, scryptBlockSize, p.Parallelism)
+	default:
+		return fmt.Sprintf("%s (%d iterations)", p.algorithm(), p.Iterations)
+	}
+}
+
+func (p StringToKeyParams) algorithm() string {
+	if p.Algorithm == "" {
+		return StringToKeyPbkdf2
+	}
+	return p.Algorithm
+}
+
+// DefaultSalt is the salt of Kerberos: the realm followed by the client ID
+func DefaultSalt(realm string, clientId string) []byte {
+	return []byte(realm + clientId)
+}
+
+// DefaultStringToKeyParams returns the parameters that the configuration gives to clientId when the salt is not
+// random, the client uses them until the AS tells it otherwise
+func DefaultStringToKeyParams(clientId string) StringToKeyParams {
+	params := StringToKeyParams{
+		Algorithm: config.StringToKey,
+		Salt:      DefaultSalt(config.Realm, clientId),
+	}
+	switch config.StringToKey {
+	case StringToKeyArgon2id:
+		params.Iterations = config.Argon2Time
+		params.Memory = config.Argon2Memory
+		params.Parallelism = config.Argon2Threads
+	case StringToKeyScrypt:
+		params.Iterations = config.ScryptN
+		params.Parallelism = config.ScryptP
+	default:
+		params.Iterations = config.StringToKeyIterations
+	}
+	return params
+}
+
+// NewStringToKeyParams returns the parameters for a new key of clientId, with the algorithm, the salt type and the
+// costs of the configuration. Keys derived with other parameters are migrated when their password is changed
+func NewStringToKeyParams(clientId string) (StringToKeyParams, error) {
+	params := DefaultStringToKeyParams(clientId)
+	if config.SaltType == "random" {
+		params.Salt = make([]byte, 16)
+		_, err := io.ReadFull(rand.Reader, params.Salt)
+		if err != nil {
+			return StringToKeyParams{}, err
+		}
+	}
+	return params, nil
+}
+
+// CheckStringToKeyHint checks the parameters of the key of the client sent by the AS in a pre-authentication error.
+// The error is not authenticated, so an attacker could ask for a cheap key and brute-force the password from the
+// next request: the algorithm can't be weaker than the configured one and the costs can't be lower than the ones
+// configured for the same algorithm
+func CheckStringToKeyHint(hint StringToKeyParams) error {
+	if stringToKeyStrength[hint.algorithm()] < stringToKeyStrength[config.StringToKey] {
+		return fmt.Errorf("string-to-key %s asked by the AS is weaker than the configured %s, refused", hint.algorithm(), config.StringToKey)
+	}
+
+	var weaker bool
+	switch hint.algorithm() {
+	case StringToKeyArgon2id:
+		weaker = hint.Iterations < config.Argon2Time || hint.Memory < config.Argon2Memory
+	case StringToKeyScrypt:
+		weaker = hint.Iterations < config.ScryptN
+	default:
+		weaker = hint.Iterations < config.StringToKeyIterations
+	}
+	if weaker {
+		return fmt.Errorf("string-to-key %v asked by the AS is weaker than the configured one, refused", hint)
+	}
+	return nil
+}
+
+// GenerateClientKeyFromPwd derives the key of a client from its password with the algorithm of params
+func GenerateClientKeyFromPwd(pwd string, params StringToKeyParams, keyDim int) ([]byte, error) {
+	stringToKey, ok := stringToKeyFuncs[params.algorithm()]
+	if !ok {
+		return nil, fmt.Errorf("unknown string-to-key algorithm %q", params.Algorithm)
+	}
+	err := params.checkLimits()
+	if err != nil {
+		return nil, err
+	}
+	return stringToKey(pwd, params, keyDim/8)
+}
+
+// checkLimits checks that the costs of p are positive and below the ceilings of its algorithm
+func (p StringToKeyParams) checkLimits() error {
+	if len(p.Salt) == 0 || p.Iterations <= 0 {
+		return errors.New("invalid string-to-key parameters")
+	}
+
+	var ok bool
+	switch p.algorithm() {
+	case StringToKeyArgon2id:
+		ok = p.Iterations <= maxArgon2Time && p.Memory > 0 && p.Memory <= maxStringToKeyMemory &&
+			p.Parallelism > 0 && p.Parallelism <= maxArgon2Threads
+	case StringToKeyScrypt:
+		ok = p.Iterations <= maxScryptN && p.Parallelism > 0 && p.Parallelism <= maxScryptP
+	default:
+		ok = p.Iterations <= maxPbkdf2Iterations
+	}
+	if !ok {
+		return fmt.Errorf("string-to-key %v exceeds the costs allowed", p)
+	}
+	return nil
+}
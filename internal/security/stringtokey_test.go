@@ -0,0 +1,23 @@
+package security
+
+import "testing"
+
+func TestStringToKeyLimits(t *testing.T) {
+	salt := []byte("SIMPLE.KERBEROSalice")
+
+	for name, params := range map[string]StringToKeyParams{
+		"pbkdf2 iterations": {Algorithm: StringToKeyPbkdf2, Salt: salt, Iterations: maxPbkdf2Iterations + 1},
+		"argon2id time":     {Algorithm: StringToKeyArgon2id, Salt: salt, Iterations: maxArgon2Time + 1, Memory: 1024, Parallelism: 1},
+		"argon2id memory":   {Algorithm: StringToKeyArgon2id, Salt: salt, Iterations: 1, Memory: maxStringToKeyMemory + 1, Parallelism: 1},
+		"argon2id threads":  {Algorithm: StringToKeyArgon2id, Salt: salt, Iterations: 1, Memory: 1024, Parallelism: maxArgon2Threads + 1},
+		"scrypt N":          {Algorithm: StringToKeyScrypt, Salt: salt, Iterations: maxScryptN * 2, Parallelism: 1},
+		"scrypt p":          {Algorithm: StringToKeyScrypt, Salt: salt, Iterations: 1024, Parallelism: maxScryptP + 1},
+		"no salt":           {Algorithm: StringToKeyPbkdf2, Iterations: 1000},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := GenerateClientKeyFromPwd("secret", params, 128); err == nil {
+				t.Errorf("key derived with %v, want the costs refused", params)
+			}
+		})
+	}
+}